@@ -2,12 +2,20 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/leonwijng/fsend/server/fsendserver"
+	"github.com/quic-go/quic-go"
 )
 
 const (
@@ -16,28 +24,97 @@ const (
 	streamFile
 	ping
 	bye
-	register   // Register client UUID
-	sendToUUID // Send file to another client's UUID
+	register     // Register client UUID
+	sendToUUID   // Send file to another client's UUID
+	quotaInfo    // Query storage usage and quota
+	shareLink    // Create a download link for the HTTP gateway
+	requestLink  // Create an upload link for the HTTP gateway
+	subscribe    // Receive events such as live sends on this connection
+	sendDirect   // Send a file live to an online client
+	answerDirect // Answer a live send offered with eventIncoming
+	listOffers   // List files sent to the client that it hasn't accepted yet
+	answerOffer  // Accept or reject a file sent to the client
+	getSenders   // Query who may send files to the client
+	setSenders   // Change who may send files to the client
+	deleteFile   // Delete one of the client's files
+)
+
+// Reply status, every reply starts with one
+const (
+	statusOK uint8 = iota
+	statusError
+	statusQuotaExceeded
+	statusShuttingDown
+	statusLimited      // Connection or rate limit hit
+	statusUnavailable  // Recipient of a live send is not online or didn't answer
+	statusNotPermitted // The recipient doesn't accept files from us
 )
 
 const uidFile = ".fsend_uid"
 const serverConfigFile = ".fsend_server"
 const defaultServer = "34.12.187.203:3002"
 
+// ServerError is a request refused by the server
+type ServerError struct {
+	Status  uint8
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// RemoteFile describes a file stored on the server
+type RemoteFile struct {
+	Name    string
+	Size    int64
+	Expires time.Time // Zero if the file never expires
+	From    string    // Sender of an offer, see ListOffers
+}
+
+// QuotaInfo describes the client's storage usage on the server
+type QuotaInfo struct {
+	Used      int64
+	Limit     int64 // 0 = unlimited
+	Available int64 // -1 = unlimited
+}
+
 // Client represents a connection to the fsend server
 type Client struct {
-	conn    net.Conn
-	address string
-	uid     string // Client UUID
+	conn     net.Conn
+	session  *quic.Conn   // Instead of conn for quic:// addresses
+	events   net.Conn     // Subscription for live sends, see Receive
+	mdns     io.Closer    // Answers queries of nearby clients, see Announce
+	pairing  net.Listener // Answers Pair of nearby clients
+	instance string       // Announced mDNS instance name, see Announce
+	address  string
+	uid      string // Client UUID
+
+	mu       sync.Mutex    // One request at a time on conn
+	done     chan struct{} // Closed to stop the keepalive
+	stopOnce sync.Once     // Close may be called more than once
+	limit    rateLimiter   // Applied to file data
+
+	offersMu sync.Mutex
+	offers   []*offer   // Live sends waiting for the user, oldest first
+	pairings []*pairing // Requests for our UUID waiting for the user
 }
 
+// notices receives the client's progress messages: stdout for the menu and
+// the GUI, stderr for subcommands so their output can be piped
+var notices io.Writer = os.Stdout
+
+// keepaliveInterval is how often an otherwise idle connection pings the
+// server, well below the server's idle timeout
+const keepaliveInterval = time.Minute
+
 // loadOrCreateUID loads the UID from file or creates a new one
 func loadOrCreateUID() (string, error) {
 	// Try to read existing UID
 	data, err := os.ReadFile(uidFile)
 	if err == nil {
 		uid := string(data)
-		fmt.Println("✓ Using existing client UID:", uid)
+		fmt.Fprintln(notices, "✓ Using existing client UID:", uid)
 		return uid, nil
 	}
 
@@ -51,7 +128,7 @@ func loadOrCreateUID() (string, error) {
 			return "", fmt.Errorf("failed to save UID: %w", err)
 		}
 
-		fmt.Println("✓ Generated new client UID:", uid)
+		fmt.Fprintln(notices, "✓ Generated new client UID:", uid)
 		return uid, nil
 	}
 
@@ -64,7 +141,7 @@ func loadOrCreateServerConfig() (string, error) {
 	data, err := os.ReadFile(serverConfigFile)
 	if err == nil {
 		server := string(data)
-		fmt.Println("✓ Using configured server:", server)
+		fmt.Fprintln(notices, "✓ Using configured server:", server)
 		return server, nil
 	}
 
@@ -76,7 +153,7 @@ func loadOrCreateServerConfig() (string, error) {
 			return defaultServer, nil // Use default even if save fails
 		}
 
-		fmt.Println("✓ Using default server:", defaultServer)
+		fmt.Fprintln(notices, "✓ Using default server:", defaultServer)
 		return defaultServer, nil
 	}
 
@@ -89,7 +166,7 @@ func SetServerAddress(address string) error {
 	if err != nil {
 		return fmt.Errorf("failed to save server address: %w", err)
 	}
-	fmt.Println("✓ Server address saved:", address)
+	fmt.Fprintln(notices, "✓ Server address saved:", address)
 	return nil
 }
 
@@ -108,68 +185,177 @@ func NewClient(address string) (*Client, error) {
 		}
 	}
 
-	return &Client{
+	c := &Client{
 		address: address,
 		uid:     uid,
-	}, nil
+	}
+	c.limit.SetRate(loadRateLimit())
+	return c, nil
+}
+
+// SetRateLimit limits uploads and downloads to bytesPerSecond (0 =
+// unlimited), including transfers that are already running
+func (c *Client) SetRateLimit(bytesPerSecond int64) {
+	c.limit.SetRate(bytesPerSecond)
+}
+
+// RateLimit returns the transfer limit in bytes per second, 0 = unlimited
+func (c *Client) RateLimit() int64 {
+	return c.limit.Rate()
 }
 
-// Connect establishes a connection to the server
+// Connect establishes a connection to the server. It never switches to
+// another server on its own, the saved UUID is only sent to the configured
+// server or one the user picked with UseServer.
 func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.address)
-	if err != nil {
-		return fmt.Errorf("failed to connect to server: %w", err)
+	return c.connect()
+}
+
+// UseServer makes Connect use address instead of the configured server for
+// this run, e.g. a nearby server the user picked when the configured one is
+// unreachable. It doesn't change .fsend_server.
+func (c *Client) UseServer(address string) {
+	c.address = address
+}
+
+// connect establishes a connection to c.address
+func (c *Client) connect() error {
+	if addr, ok := strings.CutPrefix(c.address, "quic://"); ok {
+		session, err := dialQUIC(addr)
+		if err != nil {
+			return fmt.Errorf("failed to connect to server: %w", err)
+		}
+		c.session = session
+	} else {
+		conn, err := dial(c.address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to server: %w", err)
+		}
+		c.conn = conn
 	}
-	c.conn = conn
 
-	// Register UUID with server
-	err = c.registerUID()
+	// Register UUID with server, once for all QUIC streams
+	err := c.registerUID()
 	if err != nil {
-		conn.Close()
+		c.closeConn()
 		return fmt.Errorf("failed to register with server: %w", err)
 	}
 
+	// QUIC keeps itself alive
+	if c.session == nil {
+		c.done = make(chan struct{})
+		go c.keepalive(keepaliveInterval)
+	}
+
 	return nil
 }
 
+// request returns the connection to send a request on and a function to call
+// once the reply was read. Over QUIC every request gets its own stream, so a
+// large transfer doesn't hold up the others; otherwise requests take turns
+// on conn.
+func (c *Client) request() (net.Conn, func(), error) {
+	if c.session != nil {
+		stream, err := openStream(c.session)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stream, func() { stream.Close() }, nil
+	}
+
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return nil, nil, fmt.Errorf("not connected to server")
+	}
+	return c.conn, c.mu.Unlock, nil
+}
+
 // registerUID sends the client's UUID to the server
 func (c *Client) registerUID() error {
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return registerConn(conn, c.uid)
+}
+
+// registerConn registers conn with uid
+func registerConn(conn net.Conn, uid string) error {
 	// Send register command
-	err := binary.Write(c.conn, binary.LittleEndian, register)
+	err := binary.Write(conn, binary.LittleEndian, register)
 	if err != nil {
 		return err
 	}
 
 	// Send UUID length
-	uuidLen := uint8(len(c.uid))
-	err = binary.Write(c.conn, binary.LittleEndian, uuidLen)
+	uuidLen := uint8(len(uid))
+	err = binary.Write(conn, binary.LittleEndian, uuidLen)
 	if err != nil {
 		return err
 	}
 
 	// Send UUID
-	_, err = c.conn.Write([]byte(c.uid))
+	_, err = conn.Write([]byte(uid))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return readStatus(conn)
 }
 
 // Ping sends a ping to verify the connection
 func (c *Client) Ping() error {
-	if c.conn == nil {
-		return fmt.Errorf("not connected to server")
+	conn, done, err := c.request()
+	if err != nil {
+		return err
 	}
+	defer done()
+	return sendPing(conn)
+}
+
+// keepalive pings the server every interval so the server doesn't drop an
+// idle connection. Ticks during a request are skipped, the request itself
+// keeps the connection alive.
+func (c *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	err := binary.Write(c.conn, binary.LittleEndian, ping)
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !c.mu.TryLock() {
+			continue
+		}
+		err := sendPing(c.conn)
+		c.mu.Unlock()
+
+		if err != nil {
+			fmt.Fprintln(notices, "⚠️  Keepalive failed:", err)
+			return
+		}
+	}
+}
+
+func sendPing(conn net.Conn) error {
+	err := binary.Write(conn, binary.LittleEndian, ping)
+	if err != nil {
+		return err
+	}
+
+	err = readStatus(conn)
 	if err != nil {
 		return err
 	}
 
 	// Read pong response
 	buf := make([]byte, 4)
-	_, err = c.conn.Read(buf)
+	_, err = io.ReadFull(conn, buf)
 	if err != nil {
 		return err
 	}
@@ -183,9 +369,25 @@ func (c *Client) Ping() error {
 
 // Close closes the connection to the server
 func (c *Client) Close() error {
+	if c.mdns != nil {
+		c.mdns.Close()
+		c.pairing.Close()
+	}
+	if c.events != nil {
+		c.events.Close()
+	}
+	if c.session != nil {
+		return c.session.CloseWithError(0, "bye")
+	}
 	if c.conn == nil {
 		return nil
 	}
+	if c.done != nil {
+		c.stopOnce.Do(func() { close(c.done) })
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	// Send bye message
 	binary.Write(c.conn, binary.LittleEndian, bye)
@@ -194,51 +396,298 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
-// GetConnection returns the underlying connection for file operations
+// closeConn drops the connection without saying bye
+func (c *Client) closeConn() {
+	if c.session != nil {
+		c.session.CloseWithError(0, "")
+		c.session = nil
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// readStatus reads the server's reply to a request and returns a
+// *ServerError if it was refused
+func readStatus(conn net.Conn) error {
+	var status uint8
+	err := binary.Read(conn, binary.LittleEndian, &status)
+	if err != nil {
+		return fmt.Errorf("failed to read status: %w", err)
+	}
+
+	if status == statusOK {
+		return nil
+	}
+
+	var msgLen uint8
+	err = binary.Read(conn, binary.LittleEndian, &msgLen)
+	if err != nil {
+		return fmt.Errorf("failed to read error message length: %w", err)
+	}
+
+	msg := make([]byte, msgLen)
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		return fmt.Errorf("failed to read error message: %w", err)
+	}
+
+	return &ServerError{Status: status, Message: string(msg)}
+}
+
+// GetConnection returns the underlying connection for file operations, nil
+// over QUIC
 func (c *Client) GetConnection() net.Conn {
 	return c.conn
 }
 
 // ListFiles requests and returns a list of available files from the server
-func (c *Client) ListFiles() ([]string, error) {
-	if c.conn == nil {
-		return nil, fmt.Errorf("not connected to server")
+func (c *Client) ListFiles() ([]RemoteFile, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
 	// Send listFiles command
-	err := binary.Write(c.conn, binary.LittleEndian, listFiles)
+	err = binary.Write(conn, binary.LittleEndian, listFiles)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send listFiles command: %w", err)
 	}
 
+	err = readStatus(conn)
+	if err != nil {
+		return nil, err
+	}
+
 	// Read number of files
 	var fileCount uint32
-	err = binary.Read(c.conn, binary.LittleEndian, &fileCount)
+	err = binary.Read(conn, binary.LittleEndian, &fileCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file count: %w", err)
 	}
 
-	// Read each filename
-	files := make([]string, 0, fileCount)
+	// Read each filename with its size and expiry time
+	files := make([]RemoteFile, 0, fileCount)
 	for i := uint32(0); i < fileCount; i++ {
 		var nameLen uint8
-		err = binary.Read(c.conn, binary.LittleEndian, &nameLen)
+		err = binary.Read(conn, binary.LittleEndian, &nameLen)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read filename length: %w", err)
 		}
 
 		nameBuf := make([]byte, nameLen)
-		_, err = c.conn.Read(nameBuf)
+		_, err = io.ReadFull(conn, nameBuf)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read filename: %w", err)
 		}
 
-		files = append(files, string(nameBuf))
+		var details struct {
+			Size    int64
+			Expires int64 // Unix seconds, 0 = never
+		}
+		err = binary.Read(conn, binary.LittleEndian, &details)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file details: %w", err)
+		}
+
+		file := RemoteFile{Name: string(nameBuf), Size: details.Size}
+		if details.Expires != 0 {
+			file.Expires = time.Unix(details.Expires, 0)
+		}
+		files = append(files, file)
 	}
 
 	return files, nil
 }
 
+// ListOffers returns the files other clients sent that wait for the user to
+// accept them. Expires is when an offer is discarded unless accepted.
+func (c *Client) ListOffers() ([]RemoteFile, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	err = binary.Write(conn, binary.LittleEndian, listOffers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send listOffers command: %w", err)
+	}
+
+	err = readStatus(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var count uint32
+	err = binary.Read(conn, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read offer count: %w", err)
+	}
+
+	offers := make([]RemoteFile, 0, count)
+	for range count {
+		offer, err := readOffer(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offer: %w", err)
+		}
+		offers = append(offers, offer)
+	}
+	return offers, nil
+}
+
+// readOffer reads a file waiting to be accepted:
+// [fnameLen][fname][fromLen][from][size:int64][expires:int64]
+func readOffer(conn net.Conn) (RemoteFile, error) {
+	var (
+		file RemoteFile
+		err  error
+	)
+	file.Name, err = readString(conn)
+	if err != nil {
+		return file, err
+	}
+	file.From, err = readString(conn)
+	if err != nil {
+		return file, err
+	}
+
+	var details struct {
+		Size    int64
+		Expires int64 // Unix seconds, 0 = never
+	}
+	err = binary.Read(conn, binary.LittleEndian, &details)
+	if err != nil {
+		return file, err
+	}
+
+	file.Size = details.Size
+	if details.Expires != 0 {
+		file.Expires = time.Unix(details.Expires, 0)
+	}
+	return file, nil
+}
+
+// AnswerFileOffer accepts a file from ListOffers, which then is listed and
+// can be downloaded like the others, or rejects it, which deletes it from
+// the server
+func (c *Client) AnswerFileOffer(filename string, accept bool) error {
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var answer uint8
+	if accept {
+		answer = 1
+	}
+	msg := append([]byte{answerOffer, uint8(len(filename))}, filename...)
+	_, err = conn.Write(append(msg, answer))
+	if err != nil {
+		return fmt.Errorf("failed to send answer: %w", err)
+	}
+
+	return readStatus(conn)
+}
+
+// Quota returns the client's storage usage and quota
+func (c *Client) Quota() (QuotaInfo, error) {
+
+	var info QuotaInfo
+	conn, done, err := c.request()
+	if err != nil {
+		return info, err
+	}
+	defer done()
+
+	err = binary.Write(conn, binary.LittleEndian, quotaInfo)
+	if err != nil {
+		return info, fmt.Errorf("failed to send quotaInfo command: %w", err)
+	}
+
+	err = readStatus(conn)
+	if err != nil {
+		return info, err
+	}
+
+	err = binary.Read(conn, binary.LittleEndian, &info)
+	if err != nil {
+		return info, fmt.Errorf("failed to read quota: %w", err)
+	}
+
+	return info, nil
+}
+
+// String describes the usage for humans, e.g. "1.2 MB of 2.0 GB used"
+func (q QuotaInfo) String() string {
+	if q.Limit == 0 {
+		return fsendserver.FormatSize(q.Used) + " used"
+	}
+	return fmt.Sprintf("%s of %s used", fsendserver.FormatSize(q.Used), fsendserver.FormatSize(q.Limit))
+}
+
+// ExpiresIn describes the remaining lifetime for humans, e.g. "expires in 2d 3h"
+func (f RemoteFile) ExpiresIn() string {
+	if f.Expires.IsZero() {
+		return "never expires"
+	}
+
+	left := time.Until(f.Expires)
+	switch {
+	case left <= 0:
+		return "expired"
+	case left < time.Minute:
+		return "expires in less than a minute"
+	case left >= 24*time.Hour:
+		return fmt.Sprintf("expires in %dd %dh", int(left.Hours())/24, int(left.Hours())%24)
+	case left >= time.Hour:
+		return fmt.Sprintf("expires in %dh %dm", int(left.Hours()), int(left.Minutes())%60)
+	}
+	return fmt.Sprintf("expires in %dm", int(left.Minutes()))
+}
+
+// parseTTL parses a file lifetime such as "30m", "12h" or "7d". An empty
+// string means the server's default and returns 0.
+func parseTTL(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid lifetime %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid lifetime %q", s)
+	}
+	return d, nil
+}
+
+// ttlSeconds converts a lifetime for the wire, 0 = server default
+func ttlSeconds(ttl time.Duration) uint32 {
+	return uint32(min(ttl/time.Second, math.MaxUint32))
+}
+
+// UploadFile uploads a file to the client's own storage, kept for ttl (0 =
+// the server's default)
+func (c *Client) UploadFile(filePath string, ttl time.Duration) error {
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
+	return putFile(filePath, throttledConn{conn, &c.limit}, 1024, ttl)
+}
+
 // GetUID returns the client's UID
 func (c *Client) GetUID() string {
 	return c.uid
@@ -246,49 +695,78 @@ func (c *Client) GetUID() string {
 
 // DownloadFile downloads a specific file from the server
 func (c *Client) DownloadFile(filename string, savePath string) error {
-	if c.conn == nil {
-		return fmt.Errorf("not connected to server")
+	var f *os.File
+	_, err := c.download(filename, func() (io.Writer, error) {
+		var err error
+		f, err = os.Create(savePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local file: %w", err)
+		}
+		return f, nil
+	})
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// DownloadTo downloads a specific file from the server and writes it to w,
+// e.g. stdout, and returns its size
+func (c *Client) DownloadTo(filename string, w io.Writer) (int64, error) {
+	return c.download(filename, func() (io.Writer, error) {
+		return w, nil
+	})
+}
+
+// download streams filename to the writer returned by create, which is
+// called once the server found the file
+func (c *Client) download(filename string, create func() (io.Writer, error)) (int64, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return 0, err
 	}
+	defer done()
 
 	// Send streamFile command
-	err := binary.Write(c.conn, binary.LittleEndian, streamFile)
+	err = binary.Write(conn, binary.LittleEndian, streamFile)
 	if err != nil {
-		return fmt.Errorf("failed to send streamFile command: %w", err)
+		return 0, fmt.Errorf("failed to send streamFile command: %w", err)
 	}
 
 	// Send filename length
 	fnameLen := uint8(len(filename))
-	err = binary.Write(c.conn, binary.LittleEndian, fnameLen)
+	err = binary.Write(conn, binary.LittleEndian, fnameLen)
 	if err != nil {
-		return fmt.Errorf("failed to send filename length: %w", err)
+		return 0, fmt.Errorf("failed to send filename length: %w", err)
 	}
 
 	// Send filename
-	_, err = c.conn.Write([]byte(filename))
+	_, err = conn.Write([]byte(filename))
 	if err != nil {
-		return fmt.Errorf("failed to send filename: %w", err)
+		return 0, fmt.Errorf("failed to send filename: %w", err)
 	}
 
-	// Read file size
-	var fsize uint64
-	err = binary.Read(c.conn, binary.LittleEndian, &fsize)
+	err = readStatus(conn)
 	if err != nil {
-		return fmt.Errorf("failed to read file size: %w", err)
+		return 0, err
 	}
 
-	// Check if file was found (size 0 = not found)
-	if fsize == 0 {
-		return fmt.Errorf("file not found on server: %s", filename)
+	// Read file size
+	var fsize uint64
+	err = binary.Read(conn, binary.LittleEndian, &fsize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file size: %w", err)
 	}
 
-	// Create local file
-	f, err := os.Create(savePath)
+	w, err := create()
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
+		return 0, err
 	}
-	defer f.Close()
 
 	// Read file data
+	in := throttledConn{conn, &c.limit}
 	buf := make([]byte, 32*1024)
 	remaining := fsize
 	for remaining > 0 {
@@ -297,88 +775,234 @@ func (c *Client) DownloadFile(filename string, savePath string) error {
 			toRead = int(remaining)
 		}
 
-		n, err := c.conn.Read(buf[:toRead])
+		n, err := in.Read(buf[:toRead])
 		if err != nil {
-			return fmt.Errorf("failed to read file data: %w", err)
+			return 0, fmt.Errorf("failed to read file data: %w", err)
 		}
 
-		_, err = f.Write(buf[:n])
+		_, err = w.Write(buf[:n])
 		if err != nil {
-			return fmt.Errorf("failed to write file data: %w", err)
+			return 0, fmt.Errorf("failed to write file data: %w", err)
 		}
 
 		remaining -= uint64(n)
 	}
 
-	fmt.Printf("✓ Downloaded %s (%d bytes)\n", filename, fsize)
-	return nil
+	fmt.Fprintf(notices, "✓ Downloaded %s (%d bytes)\n", filename, fsize)
+	return int64(fsize), nil
 }
 
-// SendFileToUUID sends a file to another client's UUID
-func (c *Client) SendFileToUUID(filePath string, targetUUID string) error {
-	if c.conn == nil {
-		return fmt.Errorf("not connected to server")
+// DeleteFile deletes one of the client's files from the server
+func (c *Client) DeleteFile(filename string) error {
+	if len(filename) > 255 {
+		return fmt.Errorf("filename too long: %s", filename)
+	}
+
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	_, err = conn.Write(append([]byte{deleteFile, uint8(len(filename))}, filename...))
+	if err != nil {
+		return fmt.Errorf("failed to send deleteFile command: %w", err)
+	}
+	return readStatus(conn)
+}
+
+// ShareLink asks the server for a link that downloads one of the client's
+// files in any browser. The link is valid for ttl, or the server's default if
+// ttl is 0, and stops working once the file was downloaded.
+func (c *Client) ShareLink(filename string, ttl time.Duration) (string, time.Time, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer done()
+	if len(filename) > 255 {
+		return "", time.Time{}, fmt.Errorf("filename too long (max 255 chars)")
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, shareLink)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to send shareLink command: %w", err)
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, uint8(len(filename)))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to send filename length: %w", err)
+	}
+
+	_, err = conn.Write([]byte(filename))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to send filename: %w", err)
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, ttlSeconds(ttl))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to send TTL: %w", err)
+	}
+
+	return readLink(conn)
+}
+
+// RequestLink asks the server for a link to a web page where anyone can send
+// the client one file without installing fsend. The link is valid for ttl, or
+// the server's default if ttl is 0, and works once.
+func (c *Client) RequestLink(ttl time.Duration) (string, time.Time, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer done()
+
+	err = binary.Write(conn, binary.LittleEndian, requestLink)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to send requestLink command: %w", err)
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, ttlSeconds(ttl))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to send TTL: %w", err)
+	}
+
+	return readLink(conn)
+}
+
+// readLink reads the reply to shareLink and requestLink
+func readLink(conn net.Conn) (string, time.Time, error) {
+	err := readStatus(conn)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var expires int64
+	err = binary.Read(conn, binary.LittleEndian, &expires)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read link expiry: %w", err)
+	}
+
+	var urlLen uint16
+	err = binary.Read(conn, binary.LittleEndian, &urlLen)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read link length: %w", err)
+	}
+
+	url := make([]byte, urlLen)
+	_, err = io.ReadFull(conn, url)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read link: %w", err)
+	}
+
+	return string(url), time.Unix(expires, 0), nil
+}
+
+// SendFileLive sends a file to another client's UUID only if the recipient
+// is online and accepts it. The file is never stored on the server.
+func (c *Client) SendFileLive(filePath string, targetUUID string) error {
+	fileInfo, err := sendable(filePath, targetUUID)
+	if err != nil {
+		return err
+	}
+
+	err = c.sendFileLive(filePath, fileInfo.Name(), fileInfo.Size(), targetUUID)
+	if err != nil {
+		return err
 	}
+	fmt.Fprintf(notices, "✓ Sent %s to %s live (%d bytes)\n", fileInfo.Name(), targetUUID, fileInfo.Size())
+	return nil
+}
 
+// sendable checks that filePath can be sent to targetUUID
+func sendable(filePath string, targetUUID string) (os.FileInfo, error) {
 	// Get file info
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to stat file: %w", err)
+		return nil, fmt.Errorf("failed to stat file: %w", err)
 	}
 
 	if fileInfo.IsDir() {
-		return fmt.Errorf("cannot send directory: %s", filePath)
+		return nil, fmt.Errorf("cannot send directory: %s", filePath)
 	}
 
-	filename := fileInfo.Name()
-	filesize := fileInfo.Size()
-
 	// Validate lengths
-	if len(filename) > 255 {
-		return fmt.Errorf("filename too long (max 255 chars)")
+	if len(fileInfo.Name()) > 255 {
+		return nil, fmt.Errorf("filename too long (max 255 chars)")
 	}
 	if len(targetUUID) > 255 {
-		return fmt.Errorf("UUID too long")
+		return nil, fmt.Errorf("UUID too long")
 	}
+	return fileInfo, nil
+}
+
+// SendFileToUUID sends a file to another client's UUID. The server keeps it
+// for ttl, or its default if ttl is 0, and offers it to the recipient who
+// accepts or rejects it. SendFileLive sends to an online recipient instead.
+func (c *Client) SendFileToUUID(filePath string, targetUUID string, ttl time.Duration) error {
+	fileInfo, err := sendable(filePath, targetUUID)
+	if err != nil {
+		return err
+	}
+	filename := fileInfo.Name()
+	filesize := fileInfo.Size()
+
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
 
 	// Send sendToUUID command
-	err = binary.Write(c.conn, binary.LittleEndian, sendToUUID)
+	err = binary.Write(conn, binary.LittleEndian, sendToUUID)
 	if err != nil {
 		return fmt.Errorf("failed to send command: %w", err)
 	}
 
 	// Send target UUID length
 	targetUUIDLen := uint8(len(targetUUID))
-	err = binary.Write(c.conn, binary.LittleEndian, targetUUIDLen)
+	err = binary.Write(conn, binary.LittleEndian, targetUUIDLen)
 	if err != nil {
 		return fmt.Errorf("failed to send target UUID length: %w", err)
 	}
 
 	// Send target UUID
-	_, err = c.conn.Write([]byte(targetUUID))
+	_, err = conn.Write([]byte(targetUUID))
 	if err != nil {
 		return fmt.Errorf("failed to send target UUID: %w", err)
 	}
 
 	// Send filename length
 	fnameLen := uint8(len(filename))
-	err = binary.Write(c.conn, binary.LittleEndian, fnameLen)
+	err = binary.Write(conn, binary.LittleEndian, fnameLen)
 	if err != nil {
 		return fmt.Errorf("failed to send filename length: %w", err)
 	}
 
 	// Send filename
-	_, err = c.conn.Write([]byte(filename))
+	_, err = conn.Write([]byte(filename))
 	if err != nil {
 		return fmt.Errorf("failed to send filename: %w", err)
 	}
 
 	// Send file size
-	err = binary.Write(c.conn, binary.LittleEndian, uint64(filesize))
+	err = binary.Write(conn, binary.LittleEndian, uint64(filesize))
 	if err != nil {
 		return fmt.Errorf("failed to send file size: %w", err)
 	}
 
+	// Send requested lifetime
+	err = binary.Write(conn, binary.LittleEndian, ttlSeconds(ttl))
+	if err != nil {
+		return fmt.Errorf("failed to send TTL: %w", err)
+	}
+
+	// Wait until the server accepts the file (e.g. recipient's quota)
+	err = readStatus(conn)
+	if err != nil {
+		return err
+	}
+
 	// Open and send file
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -386,25 +1010,26 @@ func (c *Client) SendFileToUUID(filePath string, targetUUID string) error {
 	}
 	defer f.Close()
 
+	out := throttledConn{conn, &c.limit}
 	buf := make([]byte, 32*1024)
 	sent := int64(0)
 	for {
 		n, err := f.Read(buf)
 		if n > 0 {
-			_, writeErr := c.conn.Write(buf[:n])
+			_, writeErr := out.Write(buf[:n])
 			if writeErr != nil {
 				return fmt.Errorf("failed to send file data: %w", writeErr)
 			}
 			sent += int64(n)
 		}
 		if err != nil {
-			if err.Error() == "EOF" {
+			if errors.Is(err, io.EOF) {
 				break
 			}
 			return fmt.Errorf("failed to read file: %w", err)
 		}
 	}
 
-	fmt.Printf("✓ Sent %s to %s (%d bytes)\n", filename, targetUUID, sent)
+	fmt.Fprintf(notices, "✓ Sent %s to %s (%d bytes), waiting for the recipient to accept it\n", filename, targetUUID, sent)
 	return nil
 }
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leonwijng/fsend/server/fsendserver"
+)
+
+// Exit codes of the subcommands
+const (
+	exitOK    = 0
+	exitError = 1 // The operation failed, e.g. the server refused it
+	exitUsage = 2 // Invalid arguments
+)
+
+// command is a non-interactive subcommand for scripts. run gets the
+// arguments after the name and returns the exit code.
+type command struct {
+	name string
+	args string // Shown in the usage after the name
+	help string
+	run  func(args []string, rateLimit int64) int
+}
+
+// commands are the subcommands besides interactive and serve, which main
+// handles itself
+var commands = []command{
+	{"send", "FILE --to UUID [--ttl 7d] [--live]", "Send a file to another UUID, FILE - reads stdin", runSend},
+	{"upload", "FILE [--ttl 7d]", "Upload a file to your own storage, FILE - reads stdin", runUpload},
+	{"ls", "", "List your files", runList},
+	{"get", "NAME [-o PATH]", "Download one of your files, which deletes it from the server; -o - writes stdout", runGet},
+	{"rm", "NAME", "Delete one of your files", runDelete},
+	{"ping", "", "Check that the server answers", runPing},
+}
+
+// printUsage describes the flags and all subcommands
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nWithout a command the GUI starts. Commands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-11s %-36s %s\n", cmd.name, cmd.args, cmd.help)
+	}
+	fmt.Fprintf(out, "  %-11s %-36s %s\n", "interactive", "", "The numbered menu, like --cli")
+	fmt.Fprintf(out, "  %-11s %-36s %s\n", "serve", "[-listen :3002] [-dir PATH]", "Host a server for the local network")
+	fmt.Fprintln(out, "\nWith --json the commands besides interactive and serve print their result or\nerror as one JSON object.")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// runCommand runs the subcommand name and returns the exit code
+func runCommand(name string, args []string, rateLimit int64) int {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args, rateLimit)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Unknown command:", name)
+	printUsage()
+	return exitUsage
+}
+
+// errUsage reports invalid arguments after the usage was printed
+var errUsage = errors.New("invalid arguments")
+
+// newFlagSet returns the flag set of a subcommand, usage describes its
+// arguments
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses args with flags before, between or after the n
+// positional arguments, which it returns
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) != n {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// stdio as FILE or PATH means stdin or stdout
+const stdio = "-"
+
+// streamName returns the name of the file uploaded from file: name, which is
+// required to read stdin, or the file's own
+func streamName(file, name string) (string, error) {
+	switch {
+	case file == stdio && name == "":
+		return "", errors.New("--name is required to read from stdin")
+	case file != stdio && name != "":
+		return "", errors.New("--name only applies to - (stdin)")
+	case file == stdio:
+		return name, nil
+	}
+	return filepath.Base(file), nil
+}
+
+// connectClient connects with the saved UUID and server for a subcommand
+func connectClient(rateLimit int64) (*Client, error) {
+	notices = os.Stderr
+
+	client, err := NewClient("")
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit >= 0 {
+		client.SetRateLimit(rateLimit)
+	}
+
+	err = client.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errConnection, err)
+	}
+	return client, nil
+}
+
+func runSend(args []string, rateLimit int64) int {
+	fs := newFlagSet("send", "FILE --to UUID [--name NAME] [--ttl 7d] [--live] [--json]")
+	to := fs.String("to", "", "UUID of the recipient (required)")
+	nameFlag := fs.String("name", "", "Name of the file when FILE is - (stdin)")
+	ttlFlag := fs.String("ttl", "", "Keep the file for this long, e.g. 12h or 7d (default: the server's)")
+	live := fs.Bool("live", false, "Send live to the online recipient, never store the file on the server")
+	o := newOutput(fs)
+	files, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return o.usage(err)
+	}
+	ttl, err := parseTTL(*ttlFlag)
+	if err == nil && *to == "" {
+		err = errors.New("--to is required")
+	}
+	if err == nil && *live && files[0] == stdio {
+		err = errors.New("--live can't read from stdin")
+	}
+	name, nameErr := streamName(files[0], *nameFlag)
+	if err == nil {
+		err = nameErr
+	}
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return o.usage(err)
+	}
+
+	var size int64
+	var hash string
+	if files[0] != stdio {
+		size, hash, err = o.localFile(files[0])
+		if err != nil {
+			return o.fail("Send failed", err)
+		}
+	}
+	client, err := connectClient(rateLimit)
+	if err != nil {
+		return o.fail("Send failed", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	switch {
+	case files[0] == stdio:
+		d := newDigest()
+		size, err = client.SendStreamToUUID(io.TeeReader(os.Stdin, d), name, *to, ttl)
+		hash = d.sum()
+	case *live:
+		err = client.SendFileLive(files[0], *to)
+	default:
+		err = client.SendFileToUUID(files[0], *to, ttl)
+	}
+	if err != nil {
+		return o.fail("Send failed", err)
+	}
+	if o.json {
+		o.print(jsonTransfer{jsonStatus: o.ok(), Name: name, To: *to,
+			Size: size, SHA256: hash, DurationMS: time.Since(start).Milliseconds()})
+	}
+	return exitOK
+}
+
+func runUpload(args []string, rateLimit int64) int {
+	fs := newFlagSet("upload", "FILE [--name NAME] [--ttl 7d] [--json]")
+	nameFlag := fs.String("name", "", "Name of the file when FILE is - (stdin)")
+	ttlFlag := fs.String("ttl", "", "Keep the file for this long, e.g. 12h or 7d (default: the server's)")
+	o := newOutput(fs)
+	files, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return o.usage(err)
+	}
+	ttl, err := parseTTL(*ttlFlag)
+	name, nameErr := streamName(files[0], *nameFlag)
+	if err == nil {
+		err = nameErr
+	}
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return o.usage(err)
+	}
+
+	var size int64
+	var hash string
+	if files[0] != stdio {
+		size, hash, err = o.localFile(files[0])
+		if err != nil {
+			return o.fail("Upload failed", err)
+		}
+	}
+	client, err := connectClient(rateLimit)
+	if err != nil {
+		return o.fail("Upload failed", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	if files[0] == stdio {
+		d := newDigest()
+		size, err = client.UploadStream(io.TeeReader(os.Stdin, d), name, ttl)
+		hash = d.sum()
+	} else {
+		err = client.UploadFile(files[0], ttl)
+	}
+	if err != nil {
+		return o.fail("Upload failed", err)
+	}
+	if o.json {
+		o.print(jsonTransfer{jsonStatus: o.ok(), Name: name,
+			Size: size, SHA256: hash, DurationMS: time.Since(start).Milliseconds()})
+		return exitOK
+	}
+	if files[0] != stdio {
+		fmt.Fprintln(notices, "✓ Uploaded", name) // UploadStream says so itself
+	}
+	return exitOK
+}
+
+func runList(args []string, rateLimit int64) int {
+	fs := newFlagSet("ls", "[--json]")
+	o := newOutput(fs)
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return o.usage(err)
+	}
+
+	client, err := connectClient(rateLimit)
+	if err != nil {
+		return o.fail("Failed to list files", err)
+	}
+	defer client.Close()
+
+	files, err := client.ListFiles()
+	if err != nil {
+		return o.fail("Failed to list files", err)
+	}
+	if o.json {
+		list := jsonList{jsonStatus: o.ok(), Files: []jsonFile{}}
+		for _, file := range files {
+			f := jsonFile{Name: file.Name, Size: file.Size}
+			if !file.Expires.IsZero() {
+				f.Expires = &file.Expires
+			}
+			list.Files = append(list.Files, f)
+		}
+		o.print(list)
+		return exitOK
+	}
+	for _, file := range files {
+		fmt.Printf("%s\t%s\t%s\n", file.Name, fsendserver.FormatSize(file.Size), file.ExpiresIn())
+	}
+	return exitOK
+}
+
+func runGet(args []string, rateLimit int64) int {
+	fs := newFlagSet("get", "NAME [-o PATH] [--json]")
+	out := fs.String("o", "", "Save the file here, - for stdout (default: NAME in the current directory)")
+	o := newOutput(fs)
+	names, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return o.usage(err)
+	}
+	if *out == "" {
+		*out = filepath.Base(names[0])
+	}
+
+	client, err := connectClient(rateLimit)
+	if err != nil {
+		return o.fail("Download failed", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	if *out == stdio {
+		// The file takes stdout, so JSON goes to stderr
+		o.w = os.Stderr
+		d := newDigest()
+		_, err = client.DownloadTo(names[0], io.MultiWriter(os.Stdout, d))
+		if err != nil {
+			return o.fail("Download failed", err)
+		}
+		if o.json {
+			o.print(jsonTransfer{jsonStatus: o.ok(), Name: names[0], Path: stdio,
+				Size: d.n, SHA256: d.sum(), DurationMS: time.Since(start).Milliseconds()})
+		}
+		return exitOK
+	}
+
+	err = client.DownloadFile(names[0], *out)
+	if err != nil {
+		return o.fail("Download failed", err)
+	}
+	if o.json {
+		duration := time.Since(start)
+		size, hash, err := o.localFile(*out)
+		if err != nil {
+			return o.fail("Download failed", err)
+		}
+		o.print(jsonTransfer{jsonStatus: o.ok(), Name: names[0], Path: *out,
+			Size: size, SHA256: hash, DurationMS: duration.Milliseconds()})
+	}
+	return exitOK
+}
+
+func runDelete(args []string, rateLimit int64) int {
+	fs := newFlagSet("rm", "NAME [--json]")
+	o := newOutput(fs)
+	names, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return o.usage(err)
+	}
+
+	client, err := connectClient(rateLimit)
+	if err != nil {
+		return o.fail("Delete failed", err)
+	}
+	defer client.Close()
+
+	err = client.DeleteFile(names[0])
+	if err != nil {
+		return o.fail("Delete failed", err)
+	}
+	if o.json {
+		o.print(jsonDeleted{jsonStatus: o.ok(), Name: names[0]})
+		return exitOK
+	}
+	fmt.Fprintln(notices, "✓ Deleted", names[0])
+	return exitOK
+}
+
+func runPing(args []string, rateLimit int64) int {
+	fs := newFlagSet("ping", "[--json]")
+	o := newOutput(fs)
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return o.usage(err)
+	}
+
+	client, err := connectClient(rateLimit)
+	if err != nil {
+		return o.fail("Ping failed", err)
+	}
+	defer client.Close()
+
+	start := time.Now()
+	err = client.Ping()
+	if err != nil {
+		return o.fail("Ping failed", err)
+	}
+	duration := time.Since(start)
+	if o.json {
+		o.print(jsonPing{jsonStatus: o.ok(), DurationMS: duration.Milliseconds()})
+		return exitOK
+	}
+	fmt.Printf("pong (%s)\n", duration.Round(time.Millisecond))
+	return exitOK
+}
@@ -5,14 +5,19 @@ go 1.25.2
 require (
 	gioui.org v0.9.0
 	github.com/atotto/clipboard v0.1.4
+	github.com/coder/websocket v1.8.14
 	github.com/google/uuid v1.6.0
+	github.com/leonwijng/fsend/server v0.0.0
+	github.com/quic-go/quic-go v0.59.1
 	github.com/sqweek/dialog v0.0.0-20240226140203-065105509627
+	golang.org/x/net v0.43.0
 )
 
 require (
 	gioui.org/shader v1.0.8 // indirect
 	github.com/TheTitanrain/w32 v0.0.0-20180517000239-4f5cfb03fabf // indirect
 	github.com/go-text/typesetting v0.3.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/exp/shiny v0.0.0-20250408133849-7e4ce0ab07d0 // indirect
 	golang.org/x/image v0.32.0 // indirect
 	golang.org/x/sys v0.37.0 // indirect
@@ -20,3 +25,5 @@ require (
 )
 
 replace github.com/go-gl/gl => github.com/go-gl/gl v0.0.0-20211210172815-726fda9656d6
+
+replace github.com/leonwijng/fsend/server => ../server
@@ -4,11 +4,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"image/color"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"gioui.org/app"
 	"gioui.org/font/gofont"
@@ -19,25 +22,52 @@ import (
 	"gioui.org/widget"
 	"gioui.org/widget/material"
 	"github.com/atotto/clipboard"
+	"github.com/leonwijng/fsend/server/fsendserver"
 )
 
 type GioUI struct {
 	client            *Client
 	theme             *material.Theme
 	statusText        string
-	currentFiles      []string
+	quotaText         string
+	currentFiles      []RemoteFile
+	offers            []RemoteFile // Sent to us, waiting to be accepted
 	selectedFile      int
 	uploadBtn         widget.Clickable
 	sendBtn           widget.Clickable
 	refreshBtn        widget.Clickable
 	downloadBtn       widget.Clickable
+	linkBtn           widget.Clickable
+	requestBtn        widget.Clickable
 	copyUUIDBtn       widget.Clickable
 	settingsBtn       widget.Clickable
+	acceptBtn         widget.Clickable
+	declineBtn        widget.Clickable
+	keepBtn           widget.Clickable // Accepts the first of offers
+	rejectBtn         widget.Clickable
+	pairBtn           widget.Clickable // Gives our UUID to PendingPairing
+	unpairBtn         widget.Clickable
+	liveOnly          widget.Bool // Send without storing on the server
 	fileList          widget.List
 	fileListButtons   []widget.Clickable
 	uuidEntry         widget.Editor
 	filePathEntry     widget.Editor
+	ttlEntry          widget.Editor
 	serverEntry       widget.Editor
+	rateLimitEntry    widget.Editor
+	allowEnum         widget.Enum // SenderPolicy.Allow as a number
+	allowlistEntry    widget.Editor
+	blocklistEntry    widget.Editor
+	sendersLoaded     bool // The settings panel shows the server's sender policy
+	nearbyServers     []NearbyServer
+	nearbyServerBtns  []widget.Clickable // Fill serverEntry, or pick one in pickServer
+	searchBtn         widget.Clickable   // Looks for nearby servers again
+	nearbyPeers       []NearbyPeer
+	nearbyPeerBtns    []widget.Clickable // Ask for the UUID, see pair
+	pairedUUID        string             // Answer to pair, for uuidEntry
+	hostServer        widget.Bool        // Run localServer, applied on save
+	localServer       *LocalServer       // Hosted for the local network
+	announce          bool               // Let nearby clients find us and localServer
 	showInputPanel    bool
 	showSettingsPanel bool
 	inputMode         string // "upload" or "send"
@@ -67,10 +97,26 @@ func NewGioUI(client *Client) *GioUI {
 			SingleLine: true,
 			Submit:     true,
 		},
+		ttlEntry: widget.Editor{
+			SingleLine: true,
+			Submit:     true,
+		},
 		serverEntry: widget.Editor{
 			SingleLine: true,
 			Submit:     true,
 		},
+		rateLimitEntry: widget.Editor{
+			SingleLine: true,
+			Submit:     true,
+		},
+		allowlistEntry: widget.Editor{
+			SingleLine: true,
+			Submit:     true,
+		},
+		blocklistEntry: widget.Editor{
+			SingleLine: true,
+			Submit:     true,
+		},
 		showInputPanel:    false,
 		showSettingsPanel: false,
 		inputMode:         "",
@@ -91,6 +137,21 @@ func (ui *GioUI) refreshFiles() {
 	}
 
 	ui.statusText = fmt.Sprintf("✓ %d files available", len(files))
+
+	offers, err := ui.client.ListOffers()
+	if err == nil {
+		ui.offers = offers
+	}
+
+	quota, err := ui.client.Quota()
+	if err != nil {
+		ui.quotaText = ""
+		return
+	}
+	ui.quotaText = "Storage: " + quota.String()
+	if quota.Available >= 0 {
+		ui.quotaText += fmt.Sprintf(" (%s available)", fsendserver.FormatSize(quota.Available))
+	}
 }
 
 func (ui *GioUI) Run(w *app.Window) error {
@@ -105,21 +166,9 @@ func (ui *GioUI) Run(w *app.Window) error {
 
 			// Handle button clicks
 			if ui.uploadBtn.Clicked(gtx) {
-				// Open file picker
-				go func() {
-					filename, err := openFileDialog("Select file to upload")
-					if err == nil && filename != "" {
-						ui.statusText = "⏳ Uploading..."
-						err = putFile(filename, ui.client.GetConnection(), 1024)
-						if err != nil {
-							ui.statusText = "❌ Upload failed: " + err.Error()
-						} else {
-							ui.statusText = "✓ File uploaded successfully!"
-							ui.refreshFiles()
-						}
-						w.Invalidate()
-					}
-				}()
+				ui.showInputPanel = true
+				ui.inputMode = "upload"
+				ui.ttlEntry.SetText("")
 			}
 
 			if ui.sendBtn.Clicked(gtx) {
@@ -127,6 +176,45 @@ func (ui *GioUI) Run(w *app.Window) error {
 				ui.inputMode = "send"
 				ui.filePathEntry.SetText("")
 				ui.uuidEntry.SetText("")
+				ui.ttlEntry.SetText("")
+				ui.liveOnly.Value = false
+				ui.findNearby(w)
+			}
+
+			peers, servers := ui.nearbyPeers, ui.nearbyServers
+			for i := range peers {
+				if ui.nearbyPeerBtns[i].Clicked(gtx) {
+					ui.pair(w, peers[i])
+				}
+			}
+			if ui.pairedUUID != "" {
+				ui.uuidEntry.SetText(ui.pairedUUID)
+				ui.pairedUUID = ""
+			}
+			for i := range servers {
+				if ui.nearbyServerBtns[i].Clicked(gtx) {
+					ui.serverEntry.SetText(servers[i].Address)
+				}
+			}
+
+			if ui.acceptBtn.Clicked(gtx) {
+				ui.client.AnswerOffer(true)
+			}
+			if ui.declineBtn.Clicked(gtx) {
+				ui.client.AnswerOffer(false)
+			}
+			if ui.pairBtn.Clicked(gtx) {
+				ui.client.AnswerPairing(true)
+			}
+			if ui.unpairBtn.Clicked(gtx) {
+				ui.client.AnswerPairing(false)
+			}
+
+			if ui.keepBtn.Clicked(gtx) {
+				ui.answerFileOffer(true)
+			}
+			if ui.rejectBtn.Clicked(gtx) {
+				ui.answerFileOffer(false)
 			}
 
 			if ui.refreshBtn.Clicked(gtx) {
@@ -147,11 +235,24 @@ func (ui *GioUI) Run(w *app.Window) error {
 				// Load current server address
 				server, _ := loadOrCreateServerConfig()
 				ui.serverEntry.SetText(server)
+
+				ui.rateLimitEntry.SetText("")
+				if limit := ui.client.RateLimit(); limit > 0 {
+					ui.rateLimitEntry.SetText(fsendserver.FormatSize(limit))
+				}
+
+				policy, err := ui.client.GetSenders()
+				ui.sendersLoaded = err == nil
+				ui.allowEnum.Value = strconv.Itoa(int(policy.Allow))
+				ui.allowlistEntry.SetText(strings.Join(policy.Allowlist, ", "))
+				ui.blocklistEntry.SetText(strings.Join(policy.Blocklist, ", "))
+				ui.hostServer.Value = ui.localServer != nil
+				ui.findNearby(w)
 			}
 
 			if ui.downloadBtn.Clicked(gtx) {
 				if ui.selectedFile >= 0 && ui.selectedFile < len(ui.currentFiles) {
-					filename := ui.currentFiles[ui.selectedFile]
+					filename := ui.currentFiles[ui.selectedFile].Name
 					savePath := "downloaded_" + filepath.Base(filename)
 
 					ui.statusText = "⏳ Downloading..."
@@ -167,10 +268,57 @@ func (ui *GioUI) Run(w *app.Window) error {
 				}
 			}
 
-			// Handle submit button (for send mode - needs file selection)
+			if ui.linkBtn.Clicked(gtx) {
+				if ui.selectedFile >= 0 && ui.selectedFile < len(ui.currentFiles) {
+					url, expires, err := ui.client.ShareLink(ui.currentFiles[ui.selectedFile].Name, 0)
+					if err != nil {
+						ui.statusText = "❌ Failed to create link: " + err.Error()
+					} else if clipboard.WriteAll(url) != nil {
+						ui.statusText = "🔗 " + url
+					} else {
+						ui.statusText = "✓ Download link copied, valid until " + expires.Format("2006-01-02 15:04")
+					}
+				} else {
+					ui.statusText = "⚠️ Please select a file first"
+				}
+			}
+
+			if ui.requestBtn.Clicked(gtx) {
+				url, expires, err := ui.client.RequestLink(0)
+				if err != nil {
+					ui.statusText = "❌ Failed to create link: " + err.Error()
+				} else if clipboard.WriteAll(url) != nil {
+					ui.statusText = "📥 " + url
+				} else {
+					ui.statusText = "✓ Upload link copied, valid until " + expires.Format("2006-01-02 15:04")
+				}
+			}
+
+			// Handle submit button (both modes continue with file selection)
 			if ui.submitBtn.Clicked(gtx) {
-				if ui.inputMode == "send" {
+				ttl, err := parseTTL(ui.ttlEntry.Text())
+				if err != nil {
+					ui.statusText = "⚠️ " + err.Error()
+				} else if ui.inputMode == "upload" {
+					// Open file picker
+					go func() {
+						filename, err := openFileDialog("Select file to upload")
+						if err == nil && filename != "" {
+							ui.statusText = "⏳ Uploading..."
+							err = ui.client.UploadFile(filename, ttl)
+							if err != nil {
+								ui.statusText = "❌ Upload failed: " + err.Error()
+							} else {
+								ui.statusText = "✓ File uploaded successfully!"
+								ui.showInputPanel = false
+								ui.refreshFiles()
+							}
+							w.Invalidate()
+						}
+					}()
+				} else if ui.inputMode == "send" {
 					targetUUID := ui.uuidEntry.Text()
+					liveOnly := ui.liveOnly.Value
 					if targetUUID == "" {
 						ui.statusText = "⚠️ Please enter a target UUID"
 					} else {
@@ -179,7 +327,12 @@ func (ui *GioUI) Run(w *app.Window) error {
 							filename, err := openFileDialog("Select file to send")
 							if err == nil && filename != "" {
 								ui.statusText = "⏳ Sending file..."
-								err = ui.client.SendFileToUUID(filename, targetUUID)
+								if liveOnly {
+									ui.statusText = "⏳ Waiting for the recipient to accept..."
+									err = ui.client.SendFileLive(filename, targetUUID)
+								} else {
+									err = ui.client.SendFileToUUID(filename, targetUUID, ttl)
+								}
 								if err != nil {
 									ui.statusText = "❌ Send failed: " + err.Error()
 								} else {
@@ -256,6 +409,17 @@ func (ui *GioUI) Layout(gtx layout.Context) layout.Dimensions {
 							}),
 						)
 					}),
+					layout.Rigid(ui.layoutPairing),
+					layout.Rigid(ui.layoutOffer),
+					layout.Rigid(ui.layoutFileOffer),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						if ui.quotaText == "" {
+							return layout.Dimensions{}
+						}
+						label := material.Caption(ui.theme, ui.quotaText)
+						label.Color = color.NRGBA{R: 100, G: 100, B: 100, A: 255}
+						return label.Layout(gtx)
+					}),
 					layout.Rigid(layout.Spacer{Height: unit.Dp(16)}.Layout),
 				)
 			}),
@@ -296,10 +460,20 @@ func (ui *GioUI) Layout(gtx layout.Context) layout.Dimensions {
 								ui.selectedFile = index
 							}
 
+							file := ui.currentFiles[index]
 							return btn.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
 								return layout.UniformInset(unit.Dp(12)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-									label := material.Body2(ui.theme, ui.currentFiles[index])
-									return label.Layout(gtx)
+									return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+										layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+											label := material.Body2(ui.theme, file.Name)
+											return label.Layout(gtx)
+										}),
+										layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+											label := material.Caption(ui.theme, fsendserver.FormatSize(file.Size)+" · "+file.ExpiresIn())
+											label.Color = color.NRGBA{R: 120, G: 120, B: 120, A: 255}
+											return label.Layout(gtx)
+										}),
+									)
 								})
 							})
 						})
@@ -324,6 +498,12 @@ func (ui *GioUI) Layout(gtx layout.Context) layout.Dimensions {
 								btn.Background = color.NRGBA{R: 33, G: 150, B: 243, A: 255}
 								return btn.Layout(gtx)
 							}),
+							layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+							layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+								btn := material.Button(ui.theme, &ui.requestBtn, "📥 Request file")
+								btn.Background = color.NRGBA{R: 103, G: 58, B: 183, A: 255}
+								return btn.Layout(gtx)
+							}),
 						)
 					}),
 					layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
@@ -340,6 +520,12 @@ func (ui *GioUI) Layout(gtx layout.Context) layout.Dimensions {
 								btn.Background = color.NRGBA{R: 255, G: 152, B: 0, A: 255}
 								return btn.Layout(gtx)
 							}),
+							layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+							layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+								btn := material.Button(ui.theme, &ui.linkBtn, "🔗 Copy link")
+								btn.Background = color.NRGBA{R: 0, G: 150, B: 136, A: 255}
+								return btn.Layout(gtx)
+							}),
 						)
 					}),
 				)
@@ -381,6 +567,42 @@ func (ui *GioUI) layoutInputPanel(gtx layout.Context) layout.Dimensions {
 							editor.Color = color.NRGBA{R: 0, G: 0, B: 0, A: 255}
 							return editor.Layout(gtx)
 						}),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							names := make([]string, len(ui.nearbyPeers))
+							for i, peer := range ui.nearbyPeers {
+								names[i] = peer.Name
+							}
+							return ui.layoutNearby(gtx, "📡 Nearby:", ui.nearbyPeerBtns, names)
+						}),
+					)
+				}),
+				layout.Rigid(layout.Spacer{Height: unit.Dp(12)}.Layout),
+
+				// Live only (only for send mode)
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					if ui.inputMode != "send" {
+						return layout.Dimensions{}
+					}
+					return material.CheckBox(ui.theme, &ui.liveOnly, "Live only: never store on the server, the recipient must be online").Layout(gtx)
+				}),
+				layout.Rigid(layout.Spacer{Height: unit.Dp(12)}.Layout),
+
+				// Lifetime input
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					if ui.liveOnly.Value && ui.inputMode == "send" {
+						return layout.Dimensions{}
+					}
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							label := material.Body2(ui.theme, "Keep for:")
+							return label.Layout(gtx)
+						}),
+						layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							editor := material.Editor(ui.theme, &ui.ttlEntry, "e.g. 12h or 7d (empty = server default)")
+							editor.Color = color.NRGBA{R: 0, G: 0, B: 0, A: 255}
+							return editor.Layout(gtx)
+						}),
 					)
 				}),
 				layout.Rigid(layout.Spacer{Height: unit.Dp(20)}.Layout),
@@ -410,17 +632,296 @@ func (ui *GioUI) layoutInputPanel(gtx layout.Context) layout.Dimensions {
 	})
 }
 
-func RunGUI() {
+// layoutOffer shows the oldest live send waiting for the user's decision
+func (ui *GioUI) layoutOffer(gtx layout.Context) layout.Dimensions {
+	in, ok := ui.client.PendingOffer()
+	if !ok {
+		return layout.Dimensions{}
+	}
+
+	return layout.Inset{Top: unit.Dp(8)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+			layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+				label := material.Body2(ui.theme, fmt.Sprintf("📥 %s wants to send you %s (%s)", in.From, in.Name, fsendserver.FormatSize(in.Size)))
+				return label.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &ui.acceptBtn, "Accept")
+				btn.Background = color.NRGBA{R: 76, G: 175, B: 80, A: 255}
+				return btn.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &ui.declineBtn, "Decline")
+				btn.Background = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+				return btn.Layout(gtx)
+			}),
+		)
+	})
+}
+
+// layoutPairing shows the oldest request for our UUID waiting for the
+// user's decision
+func (ui *GioUI) layoutPairing(gtx layout.Context) layout.Dimensions {
+	from, ok := ui.client.PendingPairing()
+	if !ok {
+		return layout.Dimensions{}
+	}
+
+	return layout.Inset{Top: unit.Dp(8)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+			layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+				label := material.Body2(ui.theme, fmt.Sprintf("🤝 %s nearby asks for your UUID to send you files", from))
+				return label.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &ui.pairBtn, "Give")
+				btn.Background = color.NRGBA{R: 76, G: 175, B: 80, A: 255}
+				return btn.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &ui.unpairBtn, "Decline")
+				btn.Background = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+				return btn.Layout(gtx)
+			}),
+		)
+	})
+}
+
+// layoutFileOffer shows the first file sent to us that waits on the server
+// for the user to accept it
+func (ui *GioUI) layoutFileOffer(gtx layout.Context) layout.Dimensions {
+	if len(ui.offers) == 0 {
+		return layout.Dimensions{}
+	}
+	offer := ui.offers[0]
+
+	text := fmt.Sprintf("📨 %s sent you %s (%s)", offer.From, offer.Name, fsendserver.FormatSize(offer.Size))
+	if len(ui.offers) > 1 {
+		text += fmt.Sprintf(", %d more waiting", len(ui.offers)-1)
+	}
+
+	return layout.Inset{Top: unit.Dp(8)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+			layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+				label := material.Body2(ui.theme, text)
+				return label.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &ui.keepBtn, "Accept")
+				btn.Background = color.NRGBA{R: 76, G: 175, B: 80, A: 255}
+				return btn.Layout(gtx)
+			}),
+			layout.Rigid(layout.Spacer{Width: unit.Dp(8)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &ui.rejectBtn, "Reject")
+				btn.Background = color.NRGBA{R: 244, G: 67, B: 54, A: 255}
+				return btn.Layout(gtx)
+			}),
+		)
+	})
+}
+
+// answerFileOffer accepts or rejects the offer layoutFileOffer shows
+func (ui *GioUI) answerFileOffer(accept bool) {
+	if len(ui.offers) == 0 {
+		return
+	}
+	name := ui.offers[0].Name
+
+	err := ui.client.AnswerFileOffer(name, accept)
+	if err != nil {
+		ui.statusText = "❌ Failed to answer: " + err.Error()
+		return
+	}
+	ui.refreshFiles()
+	if accept {
+		ui.statusText = fmt.Sprintf("✓ Accepted %s", name)
+	} else {
+		ui.statusText = fmt.Sprintf("✓ Rejected %s", name)
+	}
+}
+
+// findNearby looks for servers and people on the local network in the
+// background, for the send and settings panels to offer
+func (ui *GioUI) findNearby(w *app.Window) {
+	go func() {
+		servers, peers, err := ui.client.FindNearby(discoveryTimeout)
+		if err != nil {
+			return
+		}
+
+		// Enough clickables before the lists grow
+		for len(ui.nearbyServerBtns) < len(servers) {
+			ui.nearbyServerBtns = append(ui.nearbyServerBtns, widget.Clickable{})
+		}
+		for len(ui.nearbyPeerBtns) < len(peers) {
+			ui.nearbyPeerBtns = append(ui.nearbyPeerBtns, widget.Clickable{})
+		}
+		ui.nearbyServers, ui.nearbyPeers = servers, peers
+		w.Invalidate()
+	}()
+}
+
+// pair asks peer for its UUID in the background and fills it in once its
+// user agreed
+func (ui *GioUI) pair(w *app.Window, peer NearbyPeer) {
+	ui.statusText = fmt.Sprintf("⏳ Asking %s for their UUID, they have to agree...", peer.Name)
+	go func() {
+		uuid, server, err := ui.client.Pair(peer)
+		switch {
+		case errors.Is(err, errDeclined):
+			ui.statusText = fmt.Sprintf("✗ %s declined", peer.Name)
+		case err != nil:
+			ui.statusText = "❌ Pairing failed: " + err.Error()
+		case server != ui.client.address:
+			ui.pairedUUID = uuid
+			ui.statusText = fmt.Sprintf("⚠️ %s uses server %s, files sent through ours won't reach them", peer.Name, server)
+		default:
+			ui.pairedUUID = uuid
+			ui.statusText = fmt.Sprintf("✓ %s gave you their UUID", peer.Name)
+		}
+		w.Invalidate()
+	}()
+}
+
+// pickServer shows the servers on the local network when the configured
+// server couldn't be reached, until the user picked one that Connect could
+// reach. It returns false if the window was closed first. The pick is only
+// used for this run, .fsend_server stays unchanged.
+func (ui *GioUI) pickServer(w *app.Window, connErr error) bool {
+	var ops op.Ops
+	ui.searchServers(w)
+
+	for {
+		switch e := w.Event().(type) {
+		case app.DestroyEvent:
+			return false
+		case app.FrameEvent:
+			gtx := app.NewContext(&ops, e)
+
+			servers := ui.nearbyServers
+			for i := range servers {
+				if !ui.nearbyServerBtns[i].Clicked(gtx) {
+					continue
+				}
+				ui.client.UseServer(servers[i].Address)
+				err := ui.client.Connect()
+				if err == nil {
+					ui.statusText = "✓ Connected to " + servers[i].Name
+					return true
+				}
+				ui.statusText = fmt.Sprintf("❌ Connecting to %s failed: %v", servers[i].Name, err)
+			}
+			if ui.searchBtn.Clicked(gtx) {
+				ui.searchServers(w)
+			}
+
+			layout.UniformInset(unit.Dp(10)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+				return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						title := material.H6(ui.theme, "Can't reach the server")
+						title.Color = color.NRGBA{R: 63, G: 81, B: 181, A: 255}
+						return title.Layout(gtx)
+					}),
+					layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						return material.Body2(ui.theme, "❌ "+connErr.Error()).Layout(gtx)
+					}),
+					layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						return material.Body2(ui.theme, ui.statusText).Layout(gtx)
+					}),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						names := make([]string, len(servers))
+						for i, server := range servers {
+							names[i] = fmt.Sprintf("%s (%s)", server.Name, server.Address)
+						}
+						return ui.layoutNearby(gtx, "📡 On the local network:", ui.nearbyServerBtns, names)
+					}),
+					layout.Rigid(layout.Spacer{Height: unit.Dp(12)}.Layout),
+					layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+						btn := material.Button(ui.theme, &ui.searchBtn, "🔄 Search again")
+						btn.Background = color.NRGBA{R: 158, G: 158, B: 158, A: 255}
+						return btn.Layout(gtx)
+					}),
+				)
+			})
+			e.Frame(gtx.Ops)
+		}
+	}
+}
+
+// searchServers looks for servers on the local network in the background,
+// for pickServer
+func (ui *GioUI) searchServers(w *app.Window) {
+	ui.statusText = "🔍 Looking for servers on the local network..."
+	go func() {
+		servers, _, err := findNearby(discoveryTimeout)
+		for len(ui.nearbyServerBtns) < len(servers) {
+			ui.nearbyServerBtns = append(ui.nearbyServerBtns, widget.Clickable{})
+		}
+		ui.nearbyServers = servers
+
+		switch {
+		case err != nil:
+			ui.statusText = "❌ Failed to look around: " + err.Error()
+		case len(servers) == 0:
+			ui.statusText = "No servers found on the local network"
+		default:
+			ui.statusText = "Pick a server to use for this run, .fsend_server stays unchanged:"
+		}
+		w.Invalidate()
+	}()
+}
+
+// layoutNearby shows label and a button for each of names
+func (ui *GioUI) layoutNearby(gtx layout.Context, label string, btns []widget.Clickable, names []string) layout.Dimensions {
+	if len(names) == 0 {
+		return layout.Dimensions{}
+	}
+
+	children := []layout.FlexChild{
+		layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+			return material.Caption(ui.theme, label).Layout(gtx)
+		}),
+	}
+	for i, name := range names {
+		children = append(children,
+			layout.Rigid(layout.Spacer{Width: unit.Dp(6)}.Layout),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				btn := material.Button(ui.theme, &btns[i], name)
+				btn.TextSize = unit.Sp(12)
+				btn.Background = color.NRGBA{R: 0, G: 150, B: 136, A: 255}
+				return btn.Layout(gtx)
+			}),
+		)
+	}
+
+	return layout.Inset{Top: unit.Dp(4)}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx, children...)
+	})
+}
+
+// RunGUI runs the GUI client. rateLimit overrides the saved transfer limit
+// unless it is negative. With announce, others on the local network see the
+// client in their nearby list.
+func RunGUI(rateLimit int64, announce bool) {
 	// Connect to server
 	client, err := NewClient("")
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
-
-	err = client.Connect()
-	if err != nil {
-		log.Fatalf("Connection failed: %v", err)
+	if rateLimit >= 0 {
+		client.SetRateLimit(rateLimit)
 	}
+
+	// Another server is only used if the user picks it, see pickServer
+	connErr := client.Connect()
 	defer client.Close()
 
 	// Create window
@@ -430,9 +931,47 @@ func RunGUI() {
 		w.Option(app.Size(unit.Dp(600), unit.Dp(500)))
 
 		ui := NewGioUI(client)
+		if connErr != nil && !ui.pickServer(w, connErr) {
+			os.Exit(1)
+		}
+		ui.announce = announce
 		ui.refreshFiles()
 
-		if err := ui.Run(w); err != nil {
+		if announce {
+			err := client.Announce(func(string) {
+				w.Invalidate() // Shows the request
+			})
+			if err != nil {
+				ui.statusText = "⚠️ Others nearby won't see you: " + err.Error()
+			}
+		}
+
+		err := client.Receive(func(Incoming) {
+			w.Invalidate() // Shows the offer
+		}, func(in Incoming, err error) {
+			switch {
+			case errors.Is(err, errDeclined):
+				ui.statusText = fmt.Sprintf("✗ Declined %s", in.Name)
+			case err != nil:
+				ui.statusText = fmt.Sprintf("❌ Receiving %s failed: %v", in.Name, err)
+			default:
+				ui.statusText = fmt.Sprintf("📥 Received %s from %s, saved as %s", in.Name, in.From, in.SavedAs)
+			}
+			w.Invalidate()
+		}, func(file RemoteFile) {
+			ui.refreshFiles() // Shows the offer
+			ui.statusText = fmt.Sprintf("📨 %s sent you %s", file.From, file.Name)
+			w.Invalidate()
+		})
+		if err != nil {
+			ui.statusText = "⚠️ Live sends can't be received: " + err.Error()
+		}
+
+		err = ui.Run(w)
+		if ui.localServer != nil {
+			ui.localServer.Stop()
+		}
+		if err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
@@ -449,7 +988,7 @@ func (ui *GioUI) layoutSettingsPanel(gtx layout.Context) layout.Dimensions {
 		return layout.UniformInset(unit.Dp(20)).Layout(gtx, func(gtx layout.Context) layout.Dimensions {
 			return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
 				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
-					label := material.H6(ui.theme, "⚙️ Server Settings")
+					label := material.H6(ui.theme, "⚙️ Settings")
 					return label.Layout(gtx)
 				}),
 				layout.Rigid(layout.Spacer{Height: unit.Dp(16)}.Layout),
@@ -467,6 +1006,13 @@ func (ui *GioUI) layoutSettingsPanel(gtx layout.Context) layout.Dimensions {
 							editor.Color = color.NRGBA{R: 0, G: 0, B: 0, A: 255}
 							return editor.Layout(gtx)
 						}),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							names := make([]string, len(ui.nearbyServers))
+							for i, server := range ui.nearbyServers {
+								names[i] = server.Name
+							}
+							return ui.layoutNearby(gtx, "📡 On the local network:", ui.nearbyServerBtns, names)
+						}),
 					)
 				}),
 				layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
@@ -477,6 +1023,67 @@ func (ui *GioUI) layoutSettingsPanel(gtx layout.Context) layout.Dimensions {
 					label.Color = color.NRGBA{R: 200, G: 100, B: 0, A: 255}
 					return label.Layout(gtx)
 				}),
+				layout.Rigid(layout.Spacer{Height: unit.Dp(16)}.Layout),
+
+				// Transfer speed limit input
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							label := material.Body2(ui.theme, "Speed limit per second (applies right away):")
+							return label.Layout(gtx)
+						}),
+						layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							editor := material.Editor(ui.theme, &ui.rateLimitEntry, "e.g. 500K or 2M, empty = unlimited")
+							editor.Color = color.NRGBA{R: 0, G: 0, B: 0, A: 255}
+							return editor.Layout(gtx)
+						}),
+					)
+				}),
+				layout.Rigid(layout.Spacer{Height: unit.Dp(16)}.Layout),
+
+				// Embedded server
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					return material.CheckBox(ui.theme, &ui.hostServer, "Host a server on this computer for the local network").Layout(gtx)
+				}),
+				layout.Rigid(layout.Spacer{Height: unit.Dp(16)}.Layout),
+
+				// Who may send files
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					if !ui.sendersLoaded {
+						return layout.Dimensions{}
+					}
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							label := material.Body2(ui.theme, "Who may send me files:")
+							return label.Layout(gtx)
+						}),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							return layout.Flex{Axis: layout.Horizontal}.Layout(gtx,
+								layout.Rigid(material.RadioButton(ui.theme, &ui.allowEnum, strconv.Itoa(int(allowEveryone)), "Everyone").Layout),
+								layout.Rigid(material.RadioButton(ui.theme, &ui.allowEnum, strconv.Itoa(int(allowContacts)), "Contacts").Layout),
+								layout.Rigid(material.RadioButton(ui.theme, &ui.allowEnum, strconv.Itoa(int(allowAllowlist)), "Allowlist only").Layout),
+							)
+						}),
+						layout.Rigid(layout.Spacer{Height: unit.Dp(4)}.Layout),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							editor := material.Editor(ui.theme, &ui.allowlistEntry, "Allowlist: UUIDs separated by commas")
+							editor.Color = color.NRGBA{R: 0, G: 0, B: 0, A: 255}
+							return editor.Layout(gtx)
+						}),
+						layout.Rigid(layout.Spacer{Height: unit.Dp(8)}.Layout),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							editor := material.Editor(ui.theme, &ui.blocklistEntry, "Blocklist: UUIDs separated by commas")
+							editor.Color = color.NRGBA{R: 0, G: 0, B: 0, A: 255}
+							return editor.Layout(gtx)
+						}),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							label := material.Caption(ui.theme, "Contacts are people you sent files to or accepted files from. Blocked UUIDs can never send you files.")
+							label.Color = color.NRGBA{R: 100, G: 100, B: 100, A: 255}
+							return label.Layout(gtx)
+						}),
+					)
+				}),
 				layout.Rigid(layout.Spacer{Height: unit.Dp(20)}.Layout),
 
 				// Buttons
@@ -484,16 +1091,7 @@ func (ui *GioUI) layoutSettingsPanel(gtx layout.Context) layout.Dimensions {
 					return layout.Flex{Axis: layout.Horizontal, Spacing: layout.SpaceEvenly}.Layout(gtx,
 						layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
 							if ui.submitBtn.Clicked(gtx) {
-								newServer := ui.serverEntry.Text()
-								if newServer != "" {
-									err := SetServerAddress(newServer)
-									if err != nil {
-										ui.statusText = "❌ Failed to save: " + err.Error()
-									} else {
-										ui.statusText = "✓ Server saved! Please restart the app."
-										ui.showSettingsPanel = false
-									}
-								}
+								ui.saveSettings()
 							}
 
 							btn := material.Button(ui.theme, &ui.submitBtn, "Save")
@@ -512,3 +1110,83 @@ func (ui *GioUI) layoutSettingsPanel(gtx layout.Context) layout.Dimensions {
 		})
 	})
 }
+
+// saveSettings stores the settings panel. The speed limit and who may send
+// files apply right away, a new server only after a restart.
+func (ui *GioUI) saveSettings() {
+	var limit int64
+	if text := strings.TrimSpace(ui.rateLimitEntry.Text()); text != "" {
+		var err error
+		limit, err = parseRate(text)
+		if err != nil {
+			ui.statusText = "❌ Invalid speed limit: " + text
+			return
+		}
+	}
+
+	err := SaveRateLimit(limit)
+	if err != nil {
+		ui.statusText = "❌ Failed to save: " + err.Error()
+		return
+	}
+	ui.client.SetRateLimit(limit)
+	ui.statusText = "✓ Settings saved"
+
+	if ui.sendersLoaded {
+		allow, _ := strconv.Atoi(ui.allowEnum.Value)
+		err = ui.client.SetSenders(SenderPolicy{
+			Allow:     uint8(allow),
+			Allowlist: parseUUIDs(ui.allowlistEntry.Text()),
+			Blocklist: parseUUIDs(ui.blocklistEntry.Text()),
+		})
+		if err != nil {
+			ui.statusText = "❌ Failed to save who may send you files: " + err.Error()
+			return
+		}
+	}
+
+	newServer := ui.serverEntry.Text()
+	if newServer != "" && newServer != ui.client.address {
+		err = SetServerAddress(newServer)
+		if err != nil {
+			ui.statusText = "❌ Failed to save: " + err.Error()
+			return
+		}
+		ui.statusText = "✓ Server saved! Please restart the app."
+	}
+
+	if ui.hostServer.Value != (ui.localServer != nil) {
+		ui.setHosting(ui.hostServer.Value)
+	}
+	ui.showSettingsPanel = false
+}
+
+// setHosting starts or stops the server hosted for the local network. Files
+// on it are deleted when it stops.
+func (ui *GioUI) setHosting(host bool) {
+	if !host {
+		err := ui.localServer.Stop()
+		ui.localServer = nil
+		if err != nil {
+			ui.statusText = "⚠️ Stopped hosting, aborted unfinished transfers"
+		} else {
+			ui.statusText = "✓ Stopped hosting"
+		}
+		return
+	}
+
+	server, err := StartLocalServer(defaultServeAddress, "")
+	if err != nil {
+		ui.statusText = "❌ Failed to host a server: " + err.Error()
+		return
+	}
+	ui.localServer = server
+	ui.statusText = "✓ Hosting, others connect to " + strings.Join(server.Addresses(), ", ")
+
+	if ui.announce {
+		err = server.Announce()
+		if err != nil {
+			ui.statusText += " (nearby clients won't find it)"
+		}
+	}
+}
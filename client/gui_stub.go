@@ -5,7 +5,7 @@ package main
 
 import "fmt"
 
-func RunGUI() {
+func RunGUI(rateLimit int64, announce bool) {
 fmt.Println("GUI mode not available.")
 fmt.Println("Rebuild with: go build -tags gio")
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/leonwijng/fsend/server/fsendserver"
+)
+
+// defaultServeAddress is where a local server accepts clients unless told
+// otherwise, the port the server uses by default
+const defaultServeAddress = ":3002"
+
+// LocalServer is an fsend server running inside the client, so one machine
+// on the local network can host ad-hoc transfers without deploying the
+// server
+type LocalServer struct {
+	server *fsendserver.ServerContext
+	config fsendserver.Config
+	mdns   io.Closer // Set by Announce
+	dir    string
+	temp   bool // dir is removed by Stop
+	port   int
+}
+
+// StartLocalServer runs a server accepting clients on listen. It keeps files
+// in dir, or in a temporary directory that Stop removes if dir is empty.
+// Sender policies are kept in memory only.
+func StartLocalServer(listen, dir string) (*LocalServer, error) {
+	l := &LocalServer{dir: dir}
+	if dir == "" {
+		var err error
+		l.dir, err = os.MkdirTemp("", "fsend-serve-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+		l.temp = true
+	}
+
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		l.removeTemp()
+		return nil, err
+	}
+	l.port = lis.Addr().(*net.TCPAddr).Port
+
+	l.config = fsendserver.DefaultConfig()
+	l.config.Listen = lis.Addr().String()
+	l.config.Storage.Path = l.dir
+	l.config.Senders.File = ""
+	l.config.MDNS.Name = fmt.Sprintf("fsend on %s (%s)", fsendserver.HostLabel(), userName())
+
+	l.server, err = fsendserver.NewServer(l.config)
+	if err != nil {
+		lis.Close()
+		l.removeTemp()
+		return nil, err
+	}
+	go l.server.Serve(lis)
+	return l, nil
+}
+
+// Announce lets nearby clients find the server until Stop
+func (l *LocalServer) Announce() error {
+	conn, err := fsendserver.AnnounceServer(&l.config)
+	if err != nil {
+		return fmt.Errorf("failed to announce on the local network: %w", err)
+	}
+	l.mdns = conn
+	return nil
+}
+
+// Addresses returns the addresses others on the local network connect to
+func (l *LocalServer) Addresses() []string {
+	port := strconv.Itoa(l.port)
+
+	var addrs []string
+	for _, ip := range fsendserver.LocalIPv4s() {
+		addrs = append(addrs, net.JoinHostPort(net.IP(ip[:]).String(), port))
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort("localhost", port))
+	}
+	return addrs
+}
+
+// Dir returns the directory the server keeps files in
+func (l *LocalServer) Dir() string {
+	return l.dir
+}
+
+// Stop tells the connected clients that the server is going away, lets
+// running transfers finish for the server's shutdown timeout and removes
+// the temporary directory
+func (l *LocalServer) Stop() error {
+	if l.mdns != nil {
+		l.mdns.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(l.config.Timeouts.Shutdown))
+	defer cancel()
+
+	err := l.server.Shutdown(ctx)
+	l.removeTemp()
+	return err
+}
+
+// removeTemp removes the storage directory if StartLocalServer created it
+func (l *LocalServer) removeTemp() {
+	if l.temp {
+		os.RemoveAll(l.dir)
+	}
+}
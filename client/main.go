@@ -2,16 +2,27 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leonwijng/fsend/server/fsendserver"
 )
 
-func putFile(filePath string, conn net.Conn, bufSize uint32) (err error) {
+// putFile uploads a file to the client's own storage, kept for ttl (0 = the
+// server's default)
+func putFile(filePath string, conn net.Conn, bufSize uint32, ttl time.Duration) (err error) {
 	fn, err := os.Stat(filePath)
 	if err != nil {
 		return
@@ -56,6 +67,17 @@ func putFile(filePath string, conn net.Conn, bufSize uint32) (err error) {
 		return
 	}
 
+	err = binary.Write(conn, binary.LittleEndian, ttlSeconds(ttl))
+	if err != nil {
+		return
+	}
+
+	// Wait until the server accepts the file (e.g. quota)
+	err = readStatus(conn)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Open(filePath)
 	if err != nil {
 		return
@@ -81,6 +103,226 @@ func putFile(filePath string, conn net.Conn, bufSize uint32) (err error) {
 	return nil
 }
 
+// scanTTL asks how long an uploaded file should be kept
+func scanTTL(scanner *bufio.Scanner) (time.Duration, bool) {
+	fmt.Print("Keep for (e.g. 12h, 7d; empty = server default): ")
+	if !scanner.Scan() {
+		return 0, false
+	}
+
+	ttl, err := parseTTL(scanner.Text())
+	if err != nil {
+		fmt.Println("❌", err)
+		return 0, false
+	}
+	return ttl, true
+}
+
+// editSenders shows who may send files to the client and lets the user
+// change it
+func editSenders(client *Client, scanner *bufio.Scanner) {
+	policy, err := client.GetSenders()
+	if err != nil {
+		fmt.Println("❌ Failed to get sender settings:", err)
+		return
+	}
+
+	fmt.Println("\nWho may send you files:", policy)
+	fmt.Printf("  Allowlist: %s\n", strings.Join(policy.Allowlist, ", "))
+	fmt.Printf("  Blocklist: %s\n", strings.Join(policy.Blocklist, ", "))
+	fmt.Printf("  Contacts:  %d (people you sent files to or accepted files from)\n", len(policy.Contacts))
+
+	fmt.Println("\n1. Everyone")
+	fmt.Println("2. Contacts and allowlist only")
+	fmt.Println("3. Allowlist only")
+	fmt.Println("4. Add UUIDs to the allowlist")
+	fmt.Println("5. Remove UUIDs from the allowlist")
+	fmt.Println("6. Block UUIDs")
+	fmt.Println("7. Unblock UUIDs")
+	fmt.Print("\nChoose option (empty = back): ")
+	if !scanner.Scan() {
+		return
+	}
+	choice := strings.TrimSpace(scanner.Text())
+
+	var list *[]string
+	add := choice == "4" || choice == "6"
+	switch choice {
+	case "":
+		return
+	case "1", "2", "3":
+		policy.Allow = choice[0] - '1'
+	case "4", "5":
+		list = &policy.Allowlist
+	case "6", "7":
+		list = &policy.Blocklist
+	default:
+		fmt.Println("❌ Invalid option")
+		return
+	}
+
+	if list != nil {
+		fmt.Print("Enter UUIDs (separated by commas): ")
+		if !scanner.Scan() {
+			return
+		}
+		for _, uuid := range parseUUIDs(scanner.Text()) {
+			i := slices.Index(*list, uuid)
+			if add && i < 0 {
+				*list = append(*list, uuid)
+			} else if !add && i >= 0 {
+				*list = slices.Delete(*list, i, i+1)
+			}
+		}
+	}
+
+	err = client.SetSenders(policy)
+	if err != nil {
+		fmt.Println("❌ Failed to save sender settings:", err)
+		return
+	}
+	fmt.Println("✓ Saved, who may send you files:", policy)
+}
+
+// chooseNearbyServer offers the servers on the local network when the
+// configured server couldn't be reached, and reports whether the user picked
+// one to use for this run. Nothing is sent to a server the user didn't pick.
+func chooseNearbyServer(client *Client, scanner *bufio.Scanner, connErr error) bool {
+	fmt.Println("❌ Connection failed:", connErr)
+	fmt.Println("🔍 Looking for servers on the local network...")
+	servers, _, err := findNearby(discoveryTimeout)
+	if err != nil || len(servers) == 0 {
+		return false
+	}
+
+	fmt.Println("\nServers nearby:")
+	for i, server := range servers {
+		fmt.Printf("  %d. %s (%s)\n", i+1, server.Name, server.Address)
+	}
+
+	fmt.Print("\nEnter number to use for this run (empty = quit): ")
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) == "" {
+		return false
+	}
+	var serverNum int
+	_, err = fmt.Sscanf(scanner.Text(), "%d", &serverNum)
+	if err != nil || serverNum < 1 || serverNum > len(servers) {
+		fmt.Println("❌ Invalid number")
+		return false
+	}
+
+	client.UseServer(servers[serverNum-1].Address)
+	return true
+}
+
+// showNearby lists the servers and clients on the local network and lets
+// the user send a file to one of the clients
+func showNearby(client *Client, scanner *bufio.Scanner) {
+	fmt.Println("🔍 Looking around the local network...")
+	servers, peers, err := client.FindNearby(discoveryTimeout)
+	if err != nil {
+		fmt.Println("❌ Failed to look around:", err)
+		return
+	}
+
+	if len(servers) > 0 {
+		fmt.Println("\nServers nearby:")
+		for _, server := range servers {
+			fmt.Printf("  %s (%s)\n", server.Name, server.Address)
+		}
+	}
+
+	if len(peers) == 0 {
+		fmt.Println("\nNobody nearby is running fsend")
+		return
+	}
+
+	fmt.Println("\nPeople nearby:")
+	for i, peer := range peers {
+		fmt.Printf("  %d. %s\n", i+1, peer.Name)
+	}
+
+	fmt.Print("\nEnter number to send a file to (empty = back): ")
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) == "" {
+		return
+	}
+	var peerNum int
+	_, err = fmt.Sscanf(scanner.Text(), "%d", &peerNum)
+	if err != nil || peerNum < 1 || peerNum > len(peers) {
+		fmt.Println("❌ Invalid number")
+		return
+	}
+	peer := peers[peerNum-1]
+
+	fmt.Printf("⏳ Asking %s for their UUID, they have to agree...\n", peer.Name)
+	uuid, server, err := client.Pair(peer)
+	if errors.Is(err, errDeclined) {
+		fmt.Printf("✗ %s declined\n", peer.Name)
+		return
+	}
+	if err != nil {
+		fmt.Println("❌ Pairing failed:", err)
+		return
+	}
+	fmt.Printf("✓ %s is %s\n", peer.Name, uuid)
+	if server != client.address {
+		fmt.Printf("⚠️ They use server %s, files sent through ours won't reach them\n", server)
+	}
+
+	fmt.Print("Enter filename to send: ")
+	if !scanner.Scan() {
+		return
+	}
+	filename := scanner.Text()
+
+	ttl, ok := scanTTL(scanner)
+	if !ok {
+		return
+	}
+
+	err = client.SendFileToUUID(filename, uuid, ttl)
+	if err != nil {
+		fmt.Println("❌ Send failed:", err)
+	} else {
+		fmt.Printf("✓ File sent to %s\n", peer.Name)
+	}
+}
+
+// serve hosts a server for the local network in this process until
+// interrupted, for `fsend serve`
+func serve(args []string, announce bool) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", defaultServeAddress, "Address to accept clients on")
+	dir := fs.String("dir", "", "Keep files in this directory (default: a temporary one, deleted when stopping)")
+	fs.Parse(args)
+
+	server, err := StartLocalServer(*listen, *dir)
+	if err != nil {
+		log.Fatalln("Failed to start the server:", err)
+	}
+
+	if announce {
+		err = server.Announce()
+		if err != nil {
+			fmt.Println("⚠️ Nearby clients won't find the server:", err)
+		}
+	}
+
+	fmt.Println("✓ Serving files from", server.Dir())
+	fmt.Println("Others connect to:", strings.Join(server.Addresses(), ", "))
+	fmt.Println("Press Ctrl+C to stop")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop() // A second signal stops right away
+
+	fmt.Println("Stopping, waiting for running transfers...")
+	err = server.Stop()
+	if err != nil {
+		fmt.Println("⚠️ Aborted unfinished transfers:", err)
+	}
+}
+
 func showMenu() {
 	fmt.Println("\n=== fsend Menu ===")
 	fmt.Println("1. Upload file (to my storage)")
@@ -88,18 +330,49 @@ func showMenu() {
 	fmt.Println("3. List my files")
 	fmt.Println("4. Download file")
 	fmt.Println("5. Ping server")
-	fmt.Println("6. Exit")
+	fmt.Println("6. Show storage usage")
+	fmt.Println("7. Create download link")
+	fmt.Println("8. Create upload link (request a file)")
+	fmt.Println("9. Send file live (never stored on the server)")
+	fmt.Println("10. Files sent to me (accept or reject)")
+	fmt.Println("11. Who may send me files")
+	fmt.Println("12. Nearby (people and servers on the local network)")
+	fmt.Println("13. Exit")
 	fmt.Print("\nChoose option: ")
 }
 
 func main() {
 	// Check if CLI mode is explicitly requested
 	useCLI := flag.Bool("cli", false, "Use CLI mode instead of GUI")
+	rateLimitFlag := flag.String("ratelimit", "", "Limit transfer speed, e.g. 2M for 2 MB/s (0 = unlimited, default from "+rateLimitFile+")")
+	announce := flag.Bool("announce", false, "Show up in the nearby list of others on the local network, and announce servers hosted here")
+	flag.StringVar(&webSocketFallback, "ws-fallback", "", "WebSocket URL to try when TCP is blocked, or off (default wss://<server host>:443/ws)")
+	flag.Usage = printUsage
 	flag.Parse()
 
+	rateLimit := int64(-1) // Saved setting
+	if *rateLimitFlag != "" {
+		var err error
+		rateLimit, err = parseRate(*rateLimitFlag)
+		if err != nil {
+			log.Fatalln("Invalid -ratelimit:", err)
+		}
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case "serve":
+		serve(flag.Args()[1:], *announce)
+		return
+	case "interactive":
+		*useCLI = true
+	default:
+		os.Exit(runCommand(cmd, flag.Args()[1:], rateLimit))
+	}
+
 	// Default to GUI mode (when double-clicked)
 	if !*useCLI {
-		RunGUI()
+		RunGUI(rateLimit, *announce)
 		return
 	}
 
@@ -110,7 +383,17 @@ func main() {
 		log.Fatalln("Failed to create client:", err)
 	}
 
+	if rateLimit >= 0 {
+		client.SetRateLimit(rateLimit)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+
 	err = client.Connect()
+	var serverErr *ServerError
+	if err != nil && !errors.As(err, &serverErr) && chooseNearbyServer(client, scanner, err) {
+		err = client.Connect()
+	}
 	if err != nil {
 		log.Fatalln("Connection failed:", err)
 	}
@@ -119,7 +402,40 @@ func main() {
 	fmt.Println("✓ Connected to server")
 	fmt.Printf("Your UUID: %s\n", client.GetUID())
 
-	scanner := bufio.NewScanner(os.Stdin)
+	// Someone nearby asking for the UUID is answered like a live send
+	if *announce {
+		err = client.Announce(func(from string) {
+			fmt.Printf("\n🤝 %s nearby asks for your UUID to send you files. Give it? (y/n): ", from)
+		})
+		if err != nil {
+			fmt.Println("⚠️ Others nearby won't see you:", err)
+		}
+	}
+
+	// Files sent live arrive while the menu runs, the next choice answers
+	// the offer
+	err = client.Receive(func(in Incoming) {
+		fmt.Printf("\n📥 %s wants to send you %s (%s) live. Accept? (y/n): ", in.From, in.Name, fsendserver.FormatSize(in.Size))
+	}, func(in Incoming, err error) {
+		switch {
+		case errors.Is(err, errDeclined):
+			fmt.Printf("✗ Declined %s from %s\n", in.Name, in.From)
+		case err != nil:
+			fmt.Printf("\n❌ Receiving %s from %s failed: %v\n", in.Name, in.From, err)
+		default:
+			fmt.Printf("\n📥 Received %s (%s) from %s, saved as %s\n", in.Name, fsendserver.FormatSize(in.Size), in.From, in.SavedAs)
+		}
+	}, func(file RemoteFile) {
+		fmt.Printf("\n📨 %s sent you %s (%s), choose 10 to accept or reject it\n", file.From, file.Name, fsendserver.FormatSize(file.Size))
+	})
+	if err != nil {
+		fmt.Println("⚠️ Live sends can't be received:", err)
+	}
+
+	offers, err := client.ListOffers()
+	if err == nil && len(offers) > 0 {
+		fmt.Printf("📨 Files sent to you wait for your answer (%d), choose 10\n", len(offers))
+	}
 
 	// Interactive menu loop
 	for {
@@ -130,6 +446,15 @@ func main() {
 		}
 		choice := scanner.Text()
 
+		if _, ok := client.PendingPairing(); ok {
+			client.AnswerPairing(strings.HasPrefix(strings.ToLower(choice), "y"))
+			continue
+		}
+		if _, ok := client.PendingOffer(); ok {
+			client.AnswerOffer(strings.HasPrefix(strings.ToLower(choice), "y"))
+			continue
+		}
+
 		switch choice {
 		case "1": // Upload to my storage
 			fmt.Print("Enter filename to upload: ")
@@ -138,7 +463,12 @@ func main() {
 			}
 			filename := scanner.Text()
 
-			err = putFile(filename, client.GetConnection(), 1024)
+			ttl, ok := scanTTL(scanner)
+			if !ok {
+				continue
+			}
+
+			err = client.UploadFile(filename, ttl)
 			if err != nil {
 				fmt.Println("❌ Upload failed:", err)
 			} else {
@@ -158,7 +488,12 @@ func main() {
 			}
 			targetUUID := scanner.Text()
 
-			err = client.SendFileToUUID(filename, targetUUID)
+			ttl, ok := scanTTL(scanner)
+			if !ok {
+				continue
+			}
+
+			err = client.SendFileToUUID(filename, targetUUID, ttl)
 			if err != nil {
 				fmt.Println("❌ Send failed:", err)
 			} else {
@@ -177,7 +512,7 @@ func main() {
 				fmt.Println("  (No files)")
 			} else {
 				for i, file := range files {
-					fmt.Printf("  %d. %s\n", i+1, file)
+					fmt.Printf("  %d. %s (%s, %s)\n", i+1, file.Name, fsendserver.FormatSize(file.Size), file.ExpiresIn())
 				}
 			}
 
@@ -195,7 +530,7 @@ func main() {
 
 			fmt.Println("\nAvailable files:")
 			for i, file := range files {
-				fmt.Printf("  %d. %s\n", i+1, file)
+				fmt.Printf("  %d. %s\n", i+1, file.Name)
 			}
 
 			fmt.Print("\nEnter file number to download: ")
@@ -209,7 +544,7 @@ func main() {
 				continue
 			}
 
-			downloadName := files[fileNum-1]
+			downloadName := files[fileNum-1].Name
 			savePath := "downloaded_" + downloadName
 
 			fmt.Printf("Downloading %s...\n", downloadName)
@@ -228,7 +563,158 @@ func main() {
 				fmt.Println("✓ Pong!")
 			}
 
-		case "6": // Exit
+		case "6": // Storage usage
+			quota, err := client.Quota()
+			if err != nil {
+				fmt.Println("❌ Failed to get storage usage:", err)
+				continue
+			}
+
+			fmt.Printf("✓ Storage: %s\n", quota)
+			if quota.Available >= 0 {
+				fmt.Printf("  %s available\n", fsendserver.FormatSize(quota.Available))
+			}
+
+		case "7": // Download link
+			files, err := client.ListFiles()
+			if err != nil {
+				fmt.Println("❌ Failed to list files:", err)
+				continue
+			}
+
+			if len(files) == 0 {
+				fmt.Println("No files to share")
+				continue
+			}
+
+			fmt.Println("\nAvailable files:")
+			for i, file := range files {
+				fmt.Printf("  %d. %s\n", i+1, file.Name)
+			}
+
+			fmt.Print("\nEnter file number to share: ")
+			if !scanner.Scan() {
+				break
+			}
+			var fileNum int
+			_, err = fmt.Sscanf(scanner.Text(), "%d", &fileNum)
+			if err != nil || fileNum < 1 || fileNum > len(files) {
+				fmt.Println("❌ Invalid file number")
+				continue
+			}
+
+			fmt.Print("Link valid for (e.g. 1h, 2d; empty = server default): ")
+			if !scanner.Scan() {
+				break
+			}
+			ttl, err := parseTTL(scanner.Text())
+			if err != nil {
+				fmt.Println("❌", err)
+				continue
+			}
+
+			url, expires, err := client.ShareLink(files[fileNum-1].Name, ttl)
+			if err != nil {
+				fmt.Println("❌ Failed to create link:", err)
+			} else {
+				fmt.Println("✓ Download link (works once):")
+				fmt.Println(" ", url)
+				fmt.Printf("  Valid until %s\n", expires.Format("2006-01-02 15:04"))
+			}
+
+		case "8": // Upload link
+			fmt.Print("Link valid for (e.g. 1h, 2d; empty = server default): ")
+			if !scanner.Scan() {
+				break
+			}
+			ttl, err := parseTTL(scanner.Text())
+			if err != nil {
+				fmt.Println("❌", err)
+				continue
+			}
+
+			url, expires, err := client.RequestLink(ttl)
+			if err != nil {
+				fmt.Println("❌ Failed to create link:", err)
+			} else {
+				fmt.Println("✓ Upload link (works once), files sent with it arrive in your storage:")
+				fmt.Println(" ", url)
+				fmt.Printf("  Valid until %s\n", expires.Format("2006-01-02 15:04"))
+			}
+
+		case "9": // Send live
+			fmt.Print("Enter filename to send: ")
+			if !scanner.Scan() {
+				break
+			}
+			filename := scanner.Text()
+
+			fmt.Print("Enter target UUID: ")
+			if !scanner.Scan() {
+				break
+			}
+			targetUUID := scanner.Text()
+
+			fmt.Println("Waiting for the recipient to accept...")
+			err = client.SendFileLive(filename, targetUUID)
+			if err != nil {
+				fmt.Println("❌ Live send failed:", err)
+			} else {
+				fmt.Printf("✓ File sent live to %s\n", targetUUID)
+			}
+
+		case "10": // Offers
+			offers, err := client.ListOffers()
+			if err != nil {
+				fmt.Println("❌ Failed to list files sent to you:", err)
+				continue
+			}
+
+			if len(offers) == 0 {
+				fmt.Println("No files waiting for you")
+				continue
+			}
+
+			fmt.Println("\nFiles sent to you:")
+			for i, offer := range offers {
+				fmt.Printf("  %d. %s (%s) from %s, %s unless accepted\n", i+1, offer.Name, fsendserver.FormatSize(offer.Size), offer.From, offer.ExpiresIn())
+			}
+
+			fmt.Print("\nEnter file number: ")
+			if !scanner.Scan() {
+				break
+			}
+			var fileNum int
+			_, err = fmt.Sscanf(scanner.Text(), "%d", &fileNum)
+			if err != nil || fileNum < 1 || fileNum > len(offers) {
+				fmt.Println("❌ Invalid file number")
+				continue
+			}
+			offer := offers[fileNum-1]
+
+			fmt.Print("Accept? (y/n): ")
+			if !scanner.Scan() {
+				break
+			}
+			accept := strings.HasPrefix(strings.ToLower(scanner.Text()), "y")
+
+			err = client.AnswerFileOffer(offer.Name, accept)
+			switch {
+			case err != nil:
+				fmt.Println("❌ Failed to answer:", err)
+			case accept:
+				fmt.Printf("✓ Accepted %s, it is in your files now\n", offer.Name)
+			default:
+				fmt.Printf("✓ Rejected %s, it was deleted\n", offer.Name)
+			}
+
+		case "11": // Sender settings
+			editSenders(client, scanner)
+
+		case "12": // Nearby
+			showNearby(client, scanner)
+
+		case "13": // Exit
 			fmt.Println("Bye!")
 			return
 
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonwijng/fsend/server/fsendserver"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Just enough mDNS (RFC 6762) and DNS-SD (RFC 6763) to find servers and
+// other clients on the local network. Clients are announced the way
+// fsendserver announces servers.
+
+const clientService = "_fsend-client._tcp.local."
+
+// discoveryTimeout is how long the local network is given to answer
+const discoveryTimeout = 2 * time.Second
+
+// NearbyServer is an fsend server announcing itself on the local network
+type NearbyServer struct {
+	Name    string
+	Address string // As for .fsend_server
+}
+
+// NearbyPeer is a client announcing itself on the local network, see
+// Client.Announce. Its UUID is only given out through Pair.
+type NearbyPeer struct {
+	Name    string // Who and where, e.g. "alice on desk-12"
+	Address string // Where Pair asks for the UUID
+
+	instance string
+}
+
+// Announce makes the client visible to FindNearby on the other computers of
+// the local network until Close. Only a display name is announced: asked is
+// called when someone nearby asks for the UUID with Pair, which they get
+// once the user agrees with AnswerPairing.
+func (c *Client) Announce(asked func(from string)) error {
+	lis, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		return fmt.Errorf("failed to listen for pairing: %w", err)
+	}
+
+	// The suffix tells apart clients of one user on one host
+	name := displayName()
+	c.instance = fmt.Sprintf("%s (%04x)", name, rand.Uint32N(1<<16))
+	port := uint16(lis.Addr().(*net.TCPAddr).Port)
+	conn, err := fsendserver.Announce(clientService, c.instance, port, []string{"name=" + name})
+	if err != nil {
+		lis.Close()
+		return fmt.Errorf("failed to announce on the local network: %w", err)
+	}
+	c.mdns, c.pairing = conn, lis
+
+	go c.listenPairing(lis, asked)
+	return nil
+}
+
+// FindNearby looks for servers and other clients on the local network,
+// waiting timeout for answers
+func (c *Client) FindNearby(timeout time.Duration) ([]NearbyServer, []NearbyPeer, error) {
+	servers, peers, err := findNearby(timeout)
+	peers = slices.DeleteFunc(peers, func(p NearbyPeer) bool {
+		return c.instance != "" && p.instance == c.instance
+	})
+	return servers, peers, err
+}
+
+// findNearby looks for servers and clients on the local network
+func findNearby(timeout time.Duration) ([]NearbyServer, []NearbyPeer, error) {
+	found, err := browse(timeout, fsendserver.ServerService, clientService)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var servers []NearbyServer
+	var peers []NearbyPeer
+	for _, f := range found {
+		if f.service == fsendserver.ServerService {
+			address := net.JoinHostPort(f.ip.String(), strconv.Itoa(int(f.port)))
+			if f.txt["proto"] == "tls" {
+				address = "tls://" + address
+			}
+			server := NearbyServer{Name: f.name, Address: address}
+			if !slices.Contains(servers, server) {
+				servers = append(servers, server)
+			}
+			continue
+		}
+
+		if f.port == 0 || slices.ContainsFunc(peers, func(p NearbyPeer) bool { return p.instance == f.name }) {
+			continue
+		}
+		name := f.txt["name"]
+		if name == "" {
+			name = f.name
+		}
+		address := net.JoinHostPort(f.ip.String(), strconv.Itoa(int(f.port)))
+		peers = append(peers, NearbyPeer{Name: name, Address: address, instance: f.name})
+	}
+	return servers, peers, nil
+}
+
+// mdnsInstance is a service instance found by browse
+type mdnsInstance struct {
+	service string
+	name    string // Instance name without the service
+	ip      net.IP // The answer came from here
+	port    uint16
+	txt     map[string]string
+}
+
+// browse asks the local network once for instances of the services and
+// collects the answers until timeout
+func browse(timeout time.Duration, services ...string) ([]mdnsInstance, error) {
+	group, err := net.ResolveUDPAddr("udp4", fsendserver.MDNSGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Uint32())})
+	err = b.StartQuestions()
+	for _, service := range services {
+		var name dnsmessage.Name
+		if err == nil {
+			name, err = dnsmessage.NewName(service)
+		}
+		if err == nil {
+			err = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	// Not from port 5353, so responders answer by unicast
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteToUDP(query, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the local network: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var found []mdnsInstance
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return found, nil // Timed out
+		}
+		found = appendInstances(found, buf[:n], src.IP, services)
+	}
+}
+
+// appendInstances adds the instances of services answered in msg
+func appendInstances(found []mdnsInstance, msg []byte, ip net.IP, services []string) []mdnsInstance {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response || p.SkipAllQuestions() != nil {
+		return found
+	}
+	answers, err := p.AllAnswers()
+	if err != nil || p.SkipAllAuthorities() != nil {
+		return found
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return found
+	}
+	records := append(answers, additionals...)
+
+	for _, r := range records {
+		ptr, ok := r.Body.(*dnsmessage.PTRResource)
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(services, func(s string) bool {
+			return strings.EqualFold(s, r.Header.Name.String())
+		})
+		if i < 0 {
+			continue
+		}
+		full := ptr.PTR.String()
+		name, ok := strings.CutSuffix(full, "."+services[i])
+		if !ok {
+			continue
+		}
+
+		instance := mdnsInstance{service: services[i], name: name, ip: ip, txt: make(map[string]string)}
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Header.Name.String(), full) {
+				continue
+			}
+			switch body := rr.Body.(type) {
+			case *dnsmessage.SRVResource:
+				instance.port = body.Port
+			case *dnsmessage.TXTResource:
+				for _, kv := range body.TXT {
+					k, v, _ := strings.Cut(kv, "=")
+					instance.txt[k] = v
+				}
+			}
+		}
+		found = append(found, instance)
+	}
+	return found
+}
+
+// displayName is how the client shows up in the nearby lists of others
+func displayName() string {
+	return userName() + " on " + fsendserver.HostLabel()
+}
+
+// userName returns the login name of the user, without a Windows domain
+func userName() string {
+	u, err := user.Current()
+	if err != nil {
+		return "someone"
+	}
+	return u.Username[strings.LastIndex(u.Username, `\`)+1:]
+}
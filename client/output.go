@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// errConnection marks errors of subcommands that couldn't reach the server
+var errConnection = errors.New("connection failed")
+
+// errorCodes name the server's reply statuses for --json
+var errorCodes = map[uint8]string{
+	statusError:         "server_error",
+	statusQuotaExceeded: "quota_exceeded",
+	statusShuttingDown:  "shutting_down",
+	statusLimited:       "limited",
+	statusUnavailable:   "unavailable",
+	statusNotPermitted:  "not_permitted",
+}
+
+// jsonStatus starts every JSON result of a subcommand
+type jsonStatus struct {
+	OK      bool       `json:"ok"`
+	Command string     `json:"command"`
+	Error   *jsonError `json:"error,omitempty"`
+}
+
+// jsonError describes why a subcommand failed. Code is one of errorCodes,
+// "usage", "connection_failed", "local_file" or "failed".
+type jsonError struct {
+	Code    string `json:"code"`
+	Status  uint8  `json:"status,omitempty"` // The server's reply status if it refused
+	Message string `json:"message"`
+}
+
+// jsonTransfer is the result of send, upload and get
+type jsonTransfer struct {
+	jsonStatus
+	Name       string `json:"name"`
+	To         string `json:"to,omitempty"`   // send
+	Path       string `json:"path,omitempty"` // get
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// jsonList is the result of ls
+type jsonList struct {
+	jsonStatus
+	Files []jsonFile `json:"files"`
+}
+
+type jsonFile struct {
+	Name    string     `json:"name"`
+	Size    int64      `json:"size"`
+	Expires *time.Time `json:"expires"` // Null if the file never expires
+}
+
+// jsonDeleted is the result of rm
+type jsonDeleted struct {
+	jsonStatus
+	Name string `json:"name"`
+}
+
+// jsonPing is the result of ping
+type jsonPing struct {
+	jsonStatus
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// output prints the result of a subcommand: text for people, or with --json
+// a single JSON object on stdout, also when the command fails
+type output struct {
+	command string
+	json    bool
+	w       io.Writer // Where JSON goes, stderr if the command writes a file to stdout
+}
+
+// newOutput adds --json to the flags of a subcommand
+func newOutput(fs *flag.FlagSet) *output {
+	o := &output{command: fs.Name(), w: os.Stdout}
+	fs.BoolVar(&o.json, "json", false, "Print the result or error as JSON on stdout")
+	return o
+}
+
+// ok returns the jsonStatus of a successful command
+func (o *output) ok() jsonStatus {
+	return jsonStatus{OK: true, Command: o.command}
+}
+
+// print writes v as JSON
+func (o *output) print(v any) {
+	enc := json.NewEncoder(o.w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+// fail reports err and returns exitError
+func (o *output) fail(what string, err error) int {
+	if !o.json {
+		fmt.Fprintf(os.Stderr, "❌ %s: %v\n", what, err)
+		return exitError
+	}
+
+	jsonErr := &jsonError{Code: "failed", Message: err.Error()}
+	var serverErr *ServerError
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &serverErr):
+		jsonErr.Code = errorCodes[serverErr.Status]
+		jsonErr.Status = serverErr.Status
+	case errors.Is(err, errConnection):
+		jsonErr.Code = "connection_failed"
+	case errors.As(err, &pathErr):
+		jsonErr.Code = "local_file"
+	}
+	o.print(jsonStatus{Command: o.command, Error: jsonErr})
+	return exitError
+}
+
+// usage reports invalid arguments, after the flag set printed its usage,
+// and returns the exit code
+func (o *output) usage(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if o.json {
+		o.print(jsonStatus{Command: o.command, Error: &jsonError{Code: "usage", Message: err.Error()}})
+	}
+	return exitUsage
+}
+
+// localFile returns the size and, for --json, the SHA-256 of the file at
+// path
+func (o *output) localFile(path string) (int64, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, "", err
+	}
+	if !o.json {
+		return info.Size(), "", nil
+	}
+	hash, err := hashFile(path)
+	return info.Size(), hash, err
+}
+
+// digest counts and hashes the data streamed through it, for --json
+type digest struct {
+	hash.Hash
+	n int64
+}
+
+func newDigest() *digest {
+	return &digest{Hash: sha256.New()}
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return d.Hash.Write(p)
+}
+
+// sum returns the SHA-256 in hex
+func (d *digest) sum() string {
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// hashFile returns the SHA-256 of the file at path in hex
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events the server sends to a subscription, each after a status
+const (
+	eventIncoming uint8 = iota // A client wants to send a file live
+	eventOffer                 // A client sent a file that waits for AnswerFileOffer
+)
+
+// Answers to eventIncoming
+const (
+	answerConnected uint8 = iota // Connected to the sender directly
+	answerRelay                  // Direct failed, relay through the server
+	answerReject                 // The user declined the file
+)
+
+// How a live send goes, from the reply to sendDirect
+const (
+	modeDirect uint8 = iota
+	modeRelay
+)
+
+// offerTimeout is how long the user has to accept a live send, a bit less
+// than the server waits for the answer
+const offerTimeout = 25 * time.Second
+
+// errDeclined is reported for live sends the user declined
+var errDeclined = errors.New("declined")
+
+// errNotAnswered is reported for live sends the user didn't decide on in
+// time, the send then fails
+var errNotAnswered = errors.New("not answered in time")
+
+// peerDialTimeout bounds connecting to a sender directly, the relay is the
+// fallback so it is short
+const peerDialTimeout = 3 * time.Second
+
+// Incoming is a file another client sends live
+type Incoming struct {
+	From    string
+	Name    string
+	Size    int64
+	SavedAs string // Path the file was saved to, once received
+
+	token      string   // Answers the server with
+	secret     string   // Proves to the sender that we are the recipient
+	candidates []string // Where the sender listens
+}
+
+// offer is a live send waiting for the user's decision
+type offer struct {
+	in     Incoming
+	answer chan bool
+}
+
+// Receive subscribes to files other clients send live. offered is called
+// when one arrives; the user then has offerTimeout to decide with
+// AnswerOffer. Accepted files are saved in the working directory, at
+// Incoming.SavedAs, and done is called when a transfer is over. stored is called for files sent while the client
+// was offline or didn't answer, which wait on the server for
+// AnswerFileOffer. The subscription uses its own connection and ends with
+// Close.
+func (c *Client) Receive(offered func(Incoming), done func(Incoming, error), stored func(RemoteFile)) error {
+	conn, err := c.subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	c.events = conn
+
+	go c.keepSubscribed(conn)
+	go func() {
+		for {
+			err := c.handleEvent(conn, offered, done, stored)
+			if err != nil {
+				var serverErr *ServerError
+				if errors.As(err, &serverErr) {
+					fmt.Fprintln(notices, "⚠️ Live sends stopped:", err)
+				}
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe opens the connection events arrive on
+func (c *Client) subscribe() (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.session != nil {
+		conn, err = openStream(c.session)
+	} else {
+		conn, err = dial(c.address)
+		if err == nil {
+			err = registerConn(conn, c.uid)
+		}
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+
+	// Servers without live sends don't answer
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = binary.Write(conn, binary.LittleEndian, subscribe)
+	if err == nil {
+		err = readStatus(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// keepSubscribed sends a byte every keepaliveInterval, so the server doesn't
+// drop the subscription as idle
+func (c *Client) keepSubscribed(conn net.Conn) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := conn.Write([]byte{ping})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleEvent reads the next event and passes it on to the callbacks of
+// Receive
+func (c *Client) handleEvent(conn net.Conn, offered func(Incoming), done func(Incoming, error), stored func(RemoteFile)) error {
+	err := readStatus(conn)
+	if err != nil {
+		return err
+	}
+
+	var event uint8
+	err = binary.Read(conn, binary.LittleEndian, &event)
+	if err != nil {
+		return err
+	}
+
+	switch event {
+	case eventIncoming:
+		in, err := readIncoming(conn)
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := c.receive(&in, offered)
+			done(in, err)
+		}()
+	case eventOffer:
+		file, err := readOffer(conn)
+		if err != nil {
+			return err
+		}
+		stored(file)
+	default:
+		return fmt.Errorf("unknown event %d", event)
+	}
+	return nil
+}
+
+// readIncoming reads the rest of an eventIncoming
+func readIncoming(conn net.Conn) (Incoming, error) {
+	var (
+		in  Incoming
+		err error
+	)
+
+	var fields [3]string // Token, sender, filename
+	for i := range fields {
+		fields[i], err = readString(conn)
+		if err != nil {
+			return in, err
+		}
+	}
+	in.token, in.From, in.Name = fields[0], fields[1], fields[2]
+
+	var size uint64
+	err = binary.Read(conn, binary.LittleEndian, &size)
+	if err != nil {
+		return in, err
+	}
+	in.Size = int64(size)
+
+	in.secret, err = readString(conn)
+	if err != nil {
+		return in, err
+	}
+
+	var count uint8
+	err = binary.Read(conn, binary.LittleEndian, &count)
+	if err != nil {
+		return in, err
+	}
+	for range count {
+		addr, err := readString(conn)
+		if err != nil {
+			return in, err
+		}
+		in.candidates = append(in.candidates, addr)
+	}
+	return in, nil
+}
+
+// readString reads a string with a uint8 length
+func readString(conn net.Conn) (string, error) {
+	var n uint8
+	err := binary.Read(conn, binary.LittleEndian, &n)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(conn, b)
+	return string(b), err
+}
+
+// createReceived creates the file an incoming file is saved to:
+// received_<name>, or received_<name> (2) and so on if that exists, so
+// nothing already there is overwritten
+func createReceived(name string) (*os.File, error) {
+	base := "received_" + filepath.Base(name)
+	ext := filepath.Ext(base)
+	path := base
+	for n := 2; ; n++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, os.ErrExist) || n > 1000 {
+			return f, err
+		}
+		path = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), n, ext)
+	}
+}
+
+// PendingOffer returns the oldest live send waiting for the user's decision
+func (c *Client) PendingOffer() (Incoming, bool) {
+	c.offersMu.Lock()
+	defer c.offersMu.Unlock()
+
+	if len(c.offers) == 0 {
+		return Incoming{}, false
+	}
+	return c.offers[0].in, true
+}
+
+// AnswerOffer accepts or declines the oldest live send waiting for the
+// user's decision and reports whether there was one
+func (c *Client) AnswerOffer(accept bool) bool {
+	c.offersMu.Lock()
+	defer c.offersMu.Unlock()
+
+	if len(c.offers) == 0 {
+		return false
+	}
+	c.offers[0].answer <- accept
+	c.offers = c.offers[1:]
+	return true
+}
+
+// ask waits for the user to decide on in
+func (c *Client) ask(in Incoming, offered func(Incoming)) (bool, error) {
+	o := &offer{in: in, answer: make(chan bool, 1)}
+	c.offersMu.Lock()
+	c.offers = append(c.offers, o)
+	c.offersMu.Unlock()
+
+	offered(in)
+
+	select {
+	case accept := <-o.answer:
+		return accept, nil
+	case <-time.After(offerTimeout):
+	}
+
+	c.offersMu.Lock()
+	defer c.offersMu.Unlock()
+	for i := range c.offers {
+		if c.offers[i] == o {
+			c.offers = append(c.offers[:i], c.offers[i+1:]...)
+			return false, errNotAnswered
+		}
+	}
+	return <-o.answer, nil // Answered just now
+}
+
+// receive asks the user about an incoming file and gets it directly from the
+// sender, or through the server's relay if no direct connection can be made
+func (c *Client) receive(in *Incoming, offered func(Incoming)) error {
+	accept, err := c.ask(*in, offered)
+	if err != nil {
+		return err
+	}
+	if !accept {
+		err = c.answerDirect(in.token, answerReject, func(net.Conn) error { return nil })
+		if err != nil {
+			return err
+		}
+		return errDeclined
+	}
+
+	peer, err := dialPeer(in.candidates, in.secret)
+	if err == nil {
+		defer peer.Close()
+
+		err = c.answerDirect(in.token, answerConnected, func(net.Conn) error { return nil })
+		if err != nil {
+			return err
+		}
+		return c.saveData(peer, in)
+	}
+
+	return c.answerDirect(in.token, answerRelay, func(conn net.Conn) error {
+		return c.saveData(conn, in)
+	})
+}
+
+// answerDirect tells the server how a live send goes and reads the rest of
+// the reply with read
+func (c *Client) answerDirect(token string, answer uint8, read func(net.Conn) error) error {
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	msg := append([]byte{answerDirect, uint8(len(token))}, token...)
+	_, err = conn.Write(append(msg, answer))
+	if err != nil {
+		return fmt.Errorf("failed to send answer: %w", err)
+	}
+
+	err = readStatus(conn)
+	if err != nil {
+		return err
+	}
+	return read(conn)
+}
+
+// dialPeer connects to the first sender address that answers and proves to
+// the sender that it is the recipient: [secretLen][secret], answered by a
+// status
+func dialPeer(candidates []string, secret string) (net.Conn, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("sender has no addresses")
+	}
+
+	conns := make(chan net.Conn, len(candidates))
+	for _, addr := range candidates {
+		go func() {
+			conn, err := net.DialTimeout("tcp", addr, peerDialTimeout)
+			if err != nil {
+				conns <- nil
+				return
+			}
+			conns <- conn
+		}()
+	}
+
+	var peer net.Conn
+	for range candidates {
+		conn := <-conns
+		if conn == nil {
+			continue
+		}
+		if peer != nil {
+			conn.Close()
+			continue
+		}
+		peer = conn
+	}
+	if peer == nil {
+		return nil, errors.New("no direct connection to the sender")
+	}
+
+	peer.SetDeadline(time.Now().Add(peerDialTimeout))
+	_, err := peer.Write(append([]byte{uint8(len(secret))}, secret...))
+	if err == nil {
+		err = readStatus(peer)
+	}
+	peer.SetDeadline(time.Time{})
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	return peer, nil
+}
+
+// saveData writes the data of in from conn to a file of its own and sets
+// in.SavedAs
+func (c *Client) saveData(conn net.Conn, in *Incoming) error {
+	f, err := createReceived(in.Name)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+
+	_, err = io.CopyN(f, throttledConn{conn, &c.limit}, in.Size)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to read file data: %w", err)
+	}
+	in.SavedAs = f.Name()
+	return f.Close()
+}
+
+// sendFileLive opens filePath and sends it with sendLive
+func (c *Client) sendFileLive(filePath, filename string, size int64, targetUUID string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	return c.sendLive(f, filename, size, targetUUID)
+}
+
+// sendLive sends a file to an online client, directly if it can connect to
+// this client, otherwise through the server without storing it. A
+// *ServerError with statusUnavailable means the recipient isn't online.
+func (c *Client) sendLive(f *os.File, filename string, size int64, targetUUID string) error {
+	// The recipient connects here for a direct transfer and proves it got
+	// the offer with secret
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return fmt.Errorf("failed to listen for the recipient: %w", err)
+	}
+	defer lis.Close()
+	secret := rand.Text()
+
+	peers := make(chan net.Conn, 1)
+	go func() {
+		peers <- acceptPeer(lis, secret)
+	}()
+
+	mode, err := c.offerLive(f, filename, size, targetUUID, secret, localCandidates(lis.Addr().(*net.TCPAddr).Port))
+	lis.Close()
+	peer := <-peers
+	if err != nil || mode != modeDirect {
+		if peer != nil {
+			peer.Close()
+		}
+		return err // Relayed already
+	}
+	if peer == nil {
+		return errors.New("the recipient didn't connect")
+	}
+	defer peer.Close()
+
+	_, err = io.CopyN(throttledConn{peer, &c.limit}, f, size)
+	if err != nil {
+		return fmt.Errorf("failed to send file data: %w", err)
+	}
+	return nil
+}
+
+// offerLive asks the server to offer the file to targetUUID and returns the
+// mode it chose. For the relay it sends the file through the server before
+// returning, a direct transfer follows once the connection is free again.
+func (c *Client) offerLive(f *os.File, filename string, size int64, targetUUID, secret string, candidates []string) (uint8, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	msg := []byte{sendDirect, uint8(len(targetUUID))}
+	msg = append(msg, targetUUID...)
+	msg = append(msg, uint8(len(filename)))
+	msg = append(msg, filename...)
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(size))
+	msg = append(msg, uint8(len(secret)))
+	msg = append(msg, secret...)
+	msg = append(msg, uint8(len(candidates)))
+	for _, addr := range candidates {
+		msg = append(msg, uint8(len(addr)))
+		msg = append(msg, addr...)
+	}
+	_, err = conn.Write(msg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	err = readStatus(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	var mode uint8
+	err = binary.Read(conn, binary.LittleEndian, &mode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read mode: %w", err)
+	}
+	if mode == modeDirect {
+		return mode, nil
+	}
+
+	// The recipient couldn't connect to us
+	_, err = io.CopyN(throttledConn{conn, &c.limit}, f, size)
+	if err != nil {
+		return mode, fmt.Errorf("failed to send file data: %w", err)
+	}
+	return mode, readStatus(conn)
+}
+
+// acceptPeer accepts connections on lis until one proves it is the recipient
+// with secret and answers it with statusOK. It returns nil once lis is
+// closed.
+func acceptPeer(lis net.Listener, secret string) net.Conn {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return nil
+		}
+
+		conn.SetDeadline(time.Now().Add(peerDialTimeout))
+		got, err := readString(conn)
+		if err != nil || got != secret {
+			conn.Close()
+			continue
+		}
+		_, err = conn.Write([]byte{statusOK})
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(time.Time{})
+		return conn
+	}
+}
+
+// localCandidates returns the addresses of this machine with port, for
+// recipients on the same network
+func localCandidates(port int) []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var candidates []string
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		candidates = append(candidates, net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port)))
+	}
+	return candidates
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Pairing gives someone nearby our UUID and server, once the user agrees.
+// Announce only puts a display name on the local network; the port in its
+// SRV record is where Pair connects to ask. The asker sends its display
+// name, and the reply is statusOK with the UUID and server address, or
+// statusNotPermitted if the user declined.
+
+// maxPendingPairings bounds the requests waiting for the user, so nobody on
+// the network can pile them up
+const maxPendingPairings = 3
+
+// pairing is a request for our UUID waiting for the user's decision
+type pairing struct {
+	from   string
+	answer chan bool
+}
+
+// listenPairing accepts pairing requests until lis is closed. asked is
+// called when one waits for PendingPairing.
+func (c *Client) listenPairing(lis net.Listener, asked func(from string)) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go c.handlePairing(conn, asked)
+	}
+}
+
+// handlePairing answers one pairing request
+func (c *Client) handlePairing(conn net.Conn, asked func(from string)) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(peerDialTimeout))
+	from, err := readString(conn)
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(offerTimeout + peerDialTimeout))
+	if !c.askPairing(from, asked) {
+		msg := "declined"
+		conn.Write(append([]byte{statusNotPermitted, uint8(len(msg))}, msg...))
+		return
+	}
+
+	reply := []byte{statusOK, uint8(len(c.uid))}
+	reply = append(reply, c.uid...)
+	reply = append(reply, uint8(len(c.address)))
+	reply = append(reply, c.address...)
+	conn.Write(reply)
+}
+
+// askPairing waits up to offerTimeout for the user to decide on a pairing
+// request from from
+func (c *Client) askPairing(from string, asked func(from string)) bool {
+	p := &pairing{from: from, answer: make(chan bool, 1)}
+	c.offersMu.Lock()
+	if len(c.pairings) >= maxPendingPairings {
+		c.offersMu.Unlock()
+		return false
+	}
+	c.pairings = append(c.pairings, p)
+	c.offersMu.Unlock()
+
+	asked(from)
+
+	select {
+	case accept := <-p.answer:
+		return accept
+	case <-time.After(offerTimeout):
+	}
+
+	c.offersMu.Lock()
+	defer c.offersMu.Unlock()
+	for i := range c.pairings {
+		if c.pairings[i] == p {
+			c.pairings = append(c.pairings[:i], c.pairings[i+1:]...)
+			return false
+		}
+	}
+	// Answered while timing out
+	return <-p.answer
+}
+
+// PendingPairing returns who asks for our UUID in the oldest pairing
+// request waiting for the user's decision
+func (c *Client) PendingPairing() (string, bool) {
+	c.offersMu.Lock()
+	defer c.offersMu.Unlock()
+
+	if len(c.pairings) == 0 {
+		return "", false
+	}
+	return c.pairings[0].from, true
+}
+
+// AnswerPairing gives out or withholds our UUID for the oldest pairing
+// request and reports whether there was one
+func (c *Client) AnswerPairing(accept bool) bool {
+	c.offersMu.Lock()
+	defer c.offersMu.Unlock()
+
+	if len(c.pairings) == 0 {
+		return false
+	}
+	c.pairings[0].answer <- accept
+	c.pairings = c.pairings[1:]
+	return true
+}
+
+// Pair asks peer for its UUID and the address of the server it uses. Its
+// user has to agree first, errDeclined is returned if they don't.
+func (c *Client) Pair(peer NearbyPeer) (uid, server string, err error) {
+	conn, err := net.DialTimeout("tcp", peer.Address, peerDialTimeout)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to reach %s: %w", peer.Name, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(offerTimeout + 2*peerDialTimeout))
+	name := displayName()
+	name = name[:min(255, len(name))]
+	_, err = conn.Write(append([]byte{uint8(len(name))}, name...))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to ask %s: %w", peer.Name, err)
+	}
+
+	err = readStatus(conn)
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && serverErr.Status == statusNotPermitted {
+		return "", "", errDeclined
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	uid, err = readString(conn)
+	if err == nil {
+		server, err = readString(conn)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the answer: %w", err)
+	}
+	return uid, server, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leonwijng/fsend/server/fsendserver"
+)
+
+const rateLimitFile = ".fsend_ratelimit"
+
+// rateLimiter limits transfers to a number of bytes per second. The rate can
+// be changed at any time, running transfers pick it up within maxRateSleep.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int64   // Bytes per second, 0 = unlimited
+	tokens float64 // Bytes that may be sent right now, negative = debt
+	last   time.Time
+}
+
+// maxRateSleep bounds a single wait, so rate changes apply quickly
+const maxRateSleep = 100 * time.Millisecond
+
+// SetRate changes the limit, 0 = unlimited
+func (l *rateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = max(bytesPerSecond, 0)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate returns the limit in bytes per second, 0 = unlimited
+func (l *rateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n more bytes may be transferred
+func (l *rateLimiter) Wait(n int) {
+	for {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return
+		}
+
+		// Earn tokens for the time passed, at most one second's worth
+		now := time.Now()
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+		l.last = now
+
+		if l.tokens >= 0 {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return
+		}
+
+		delay := min(time.Duration(-l.tokens/float64(l.rate)*float64(time.Second)), maxRateSleep)
+		l.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// throttledConn applies a rateLimiter to the file data sent and received
+// over a connection
+type throttledConn struct {
+	net.Conn
+	limit *rateLimiter
+}
+
+func (c throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limit.Wait(n)
+	return n, err
+}
+
+func (c throttledConn) Write(p []byte) (int, error) {
+	c.limit.Wait(len(p))
+	return c.Conn.Write(p)
+}
+
+// loadRateLimit loads the saved transfer limit, 0 = unlimited
+func loadRateLimit() int64 {
+	data, err := os.ReadFile(rateLimitFile)
+	if err != nil {
+		return 0
+	}
+
+	limit, err := parseRate(string(data))
+	if err != nil {
+		fmt.Fprintln(notices, "⚠️  Ignoring invalid rate limit in", rateLimitFile)
+		return 0
+	}
+	if limit > 0 {
+		fmt.Fprintf(notices, "✓ Limiting transfers to %s/s\n", fsendserver.FormatSize(limit))
+	}
+	return limit
+}
+
+// SaveRateLimit saves the transfer limit used from the next start on
+func SaveRateLimit(bytesPerSecond int64) error {
+	err := os.WriteFile(rateLimitFile, []byte(strconv.FormatInt(bytesPerSecond, 10)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to save rate limit: %w", err)
+	}
+	return nil
+}
+
+// parseRate parses transfer rates like "512", "100K", "2MB" or "1.5M/s"
+// (powers of 1024)
+func parseRate(rate string) (int64, error) {
+	s := strings.TrimSpace(rate)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "/S")
+	return fsendserver.ParseSize(s)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Who may send files to the client, see SenderPolicy
+const (
+	allowEveryone  uint8 = iota
+	allowContacts        // Contacts and the allowlist
+	allowAllowlist       // Only the allowlist
+)
+
+// SenderPolicy decides on the server who may send files to the client. The
+// blocklist applies in every mode.
+type SenderPolicy struct {
+	Allow     uint8 // allowEveryone, allowContacts or allowAllowlist
+	Allowlist []string
+	Blocklist []string
+	Contacts  []string // UUIDs the client sent files to or accepted files from, kept by the server
+}
+
+// String describes the allow mode for humans
+func (p SenderPolicy) String() string {
+	switch p.Allow {
+	case allowContacts:
+		return "contacts and allowlist"
+	case allowAllowlist:
+		return "allowlist only"
+	}
+	return "everyone"
+}
+
+// GetSenders returns who may send files to the client
+func (c *Client) GetSenders() (SenderPolicy, error) {
+	var p SenderPolicy
+	conn, done, err := c.request()
+	if err != nil {
+		return p, err
+	}
+	defer done()
+
+	err = binary.Write(conn, binary.LittleEndian, getSenders)
+	if err != nil {
+		return p, fmt.Errorf("failed to send getSenders command: %w", err)
+	}
+
+	err = readStatus(conn)
+	if err != nil {
+		return p, err
+	}
+
+	err = binary.Read(conn, binary.LittleEndian, &p.Allow)
+	if err != nil {
+		return p, fmt.Errorf("failed to read allow mode: %w", err)
+	}
+	for _, list := range []*[]string{&p.Allowlist, &p.Blocklist, &p.Contacts} {
+		*list, err = readUUIDList(conn)
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// SetSenders changes who may send files to the client. The server keeps
+// the contacts itself, p.Contacts is ignored.
+func (c *Client) SetSenders(p SenderPolicy) error {
+	msg := []byte{setSenders, p.Allow}
+	for _, list := range [][]string{p.Allowlist, p.Blocklist} {
+		msg = binary.LittleEndian.AppendUint16(msg, uint16(len(list)))
+		for _, uuid := range list {
+			if len(uuid) > 255 {
+				return fmt.Errorf("UUID too long: %s", uuid)
+			}
+			msg = append(msg, uint8(len(uuid)))
+			msg = append(msg, uuid...)
+		}
+	}
+
+	conn, done, err := c.request()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	_, err = conn.Write(msg)
+	if err != nil {
+		return fmt.Errorf("failed to send setSenders command: %w", err)
+	}
+	return readStatus(conn)
+}
+
+// readUUIDList reads [count:uint16] UUIDs of [len][uuid]
+func readUUIDList(conn net.Conn) ([]string, error) {
+	var count uint16
+	err := binary.Read(conn, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UUID count: %w", err)
+	}
+
+	list := make([]string, 0, count)
+	for range count {
+		uuid, err := readString(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UUID: %w", err)
+		}
+		list = append(list, uuid)
+	}
+	return list, nil
+}
+
+// parseUUIDs splits a comma or space separated list of UUIDs
+func parseUUIDs(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// sizeUnknown as the file size of putfile or sendToUUID starts a chunked
+// upload: the data follows as chunks of [len:uint32][bytes], ended by a
+// chunk of length 0, and the server replies a final status once the file is
+// stored
+const sizeUnknown = math.MaxUint64
+
+// chunkSize is the most data sent in one chunk
+const chunkSize = 32 * 1024
+
+// UploadStream uploads everything read from r as name to the client's own
+// storage, for data of unknown length such as a pipe. The file is kept for
+// ttl, or the server's default if ttl is 0.
+func (c *Client) UploadStream(r io.Reader, name string, ttl time.Duration) (int64, error) {
+	if len(name) > 255 {
+		return 0, fmt.Errorf("filename too long (max 255 chars)")
+	}
+
+	msg := []byte{putfile, uint8(len(name))}
+	msg = append(msg, name...)
+	msg = binary.LittleEndian.AppendUint64(msg, sizeUnknown)
+	msg = binary.LittleEndian.AppendUint32(msg, 0) // The server's buffer size
+	msg = binary.LittleEndian.AppendUint32(msg, ttlSeconds(ttl))
+
+	n, err := c.sendStream(msg, r)
+	if err != nil {
+		return n, err
+	}
+	fmt.Fprintf(notices, "✓ Uploaded %s (%d bytes)\n", name, n)
+	return n, nil
+}
+
+// SendStreamToUUID sends everything read from r as name to another client's
+// UUID, for data of unknown length such as a pipe. Unlike SendFileToUUID it
+// never goes live: the server keeps the file for ttl, or its default if ttl
+// is 0, until the recipient accepts or rejects it.
+func (c *Client) SendStreamToUUID(r io.Reader, name string, targetUUID string, ttl time.Duration) (int64, error) {
+	if len(name) > 255 {
+		return 0, fmt.Errorf("filename too long (max 255 chars)")
+	}
+	if len(targetUUID) > 255 {
+		return 0, fmt.Errorf("UUID too long")
+	}
+
+	msg := []byte{sendToUUID, uint8(len(targetUUID))}
+	msg = append(msg, targetUUID...)
+	msg = append(msg, uint8(len(name)))
+	msg = append(msg, name...)
+	msg = binary.LittleEndian.AppendUint64(msg, sizeUnknown)
+	msg = binary.LittleEndian.AppendUint32(msg, ttlSeconds(ttl))
+
+	n, err := c.sendStream(msg, r)
+	if err != nil {
+		return n, err
+	}
+	fmt.Fprintf(notices, "✓ Sent %s to %s (%d bytes), waiting for the recipient to accept it\n", name, targetUUID, n)
+	return n, nil
+}
+
+// sendStream sends the request msg announcing a chunked upload, then the
+// data read from r in chunks, and returns how many bytes were sent
+func (c *Client) sendStream(msg []byte, r io.Reader) (int64, error) {
+	conn, done, err := c.request()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	_, err = conn.Write(msg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	// Wait until the server accepts the file (e.g. quota)
+	err = readStatus(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := writeChunks(throttledConn{conn, &c.limit}, r)
+	if err != nil {
+		return n, err
+	}
+
+	// The server tells once it stored the file, it may have run out of room
+	return n, readStatus(conn)
+}
+
+// writeChunks copies r to conn as the chunks of a chunked upload, followed
+// by the end marker. If reading r fails the upload can't be ended, the
+// server would take the next request for more chunks, so conn is closed to
+// abort it.
+func writeChunks(conn net.Conn, r io.Reader) (int64, error) {
+	src := &sourceReader{r: r}
+	w := bufio.NewWriterSize(chunkWriter{conn}, chunkSize)
+	n, err := io.Copy(w, src)
+	if src.err != nil {
+		conn.Close()
+		return n, fmt.Errorf("failed to read data, upload aborted: %w", src.err)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = binary.Write(conn, binary.LittleEndian, uint32(0))
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to send file data: %w", err)
+	}
+	return n, nil
+}
+
+// sourceReader keeps the error of reading the data, to tell it apart from
+// errors sending it
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// chunkWriter writes every Write as one chunk
+type chunkWriter struct {
+	conn net.Conn
+}
+
+func (w chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil // A chunk of length 0 would end the upload
+	}
+	chunk := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(p)), uint32(len(p)))
+	_, err := w.conn.Write(append(chunk, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/quic-go/quic-go"
+)
+
+// dialTimeout bounds connecting to the server, firewalls often drop blocked
+// connections without an answer
+const dialTimeout = 10 * time.Second
+
+// webSocketFallback is the WebSocket URL dial tries when TCP is blocked, set
+// with -ws-fallback. Empty means wss://host/ws on port 443 of the server,
+// "off" disables the fallback.
+var webSocketFallback string
+
+// dial connects to address: host:port for TCP, tls://host:port for TLS or a
+// ws:// or wss:// URL for WebSocket. QUIC, quic://host:port, is dialed by
+// Connect with dialQUIC. If TCP is blocked, as on many corporate
+// networks, it falls back to webSocketFallback through the HTTPS proxy if
+// one is set.
+func dial(address string) (net.Conn, error) {
+	if strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://") {
+		return dialWebSocket(address)
+	}
+
+	addr, useTLS := strings.CutPrefix(address, "tls://")
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err == nil {
+		return conn, nil
+	}
+
+	fallback := webSocketFallback
+	switch fallback {
+	case "off":
+		return nil, err
+	case "":
+		host, _, splitErr := net.SplitHostPort(addr)
+		if splitErr != nil {
+			return nil, err
+		}
+		fallback = "wss://" + net.JoinHostPort(host, "443") + "/ws"
+	}
+	fmt.Fprintln(notices, "⚠️ TCP connection failed, trying", fallback)
+
+	conn, wsErr := dialWebSocket(fallback)
+	if wsErr != nil {
+		return nil, fmt.Errorf("%w (WebSocket fallback: %v)", err, wsErr)
+	}
+	return conn, nil
+}
+
+// dialWebSocket connects to the server's WebSocket endpoint at url
+func dialWebSocket(url string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The timeout only applies to the handshake
+	return websocket.NetConn(context.Background(), c, websocket.MessageBinary), nil
+}
+
+// quicALPN is the application protocol the server's QUIC listener expects
+const quicALPN = "fsend"
+
+// quicKeepalive keeps an idle QUIC connection open, well below the server's
+// idle timeout. Unlike a ping request it doesn't need a stream.
+const quicKeepalive = 15 * time.Second
+
+// dialQUIC connects to the server's QUIC listener at addr (host:port)
+func dialQUIC(addr string) (*quic.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	return quic.DialAddr(ctx, addr, &tls.Config{NextProtos: []string{quicALPN}}, &quic.Config{
+		KeepAlivePeriod: quicKeepalive,
+	})
+}
+
+// quicStream is a stream of a QUIC connection used as a net.Conn for one
+// request
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// openStream opens the stream for a request on conn
+func openStream(conn *quic.Conn) (quicStream, error) {
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return quicStream{}, quicError(err)
+	}
+	return quicStream{stream, conn}, nil
+}
+
+func (s quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s quicStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	return n, quicError(err)
+}
+
+func (s quicStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	return n, quicError(err)
+}
+
+// Close ends the request in both directions
+func (s quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// quicError turns the server closing the connection into a *ServerError, it
+// sends the status as the error code, e.g. when shutting down
+func quicError(err error) error {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode != 0 {
+		return &ServerError{Status: uint8(appErr.ErrorCode), Message: appErr.ErrorMessage}
+	}
+	return err
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -16,12 +17,39 @@ const (
 	streamFile
 	ping
 	bye
-	register   // Register client UUID
-	sendToUUID // Send file to another client's UUID
+	register     // Register client UUID
+	sendToUUID   // Send file to another client's UUID
+	quotaInfo    // Query storage usage and quota
+	shareLink    // Create a download link for the HTTP gateway
+	requestLink  // Create an upload link for the HTTP gateway
+	subscribe    // Receive events such as live sends on this connection
+	sendDirect   // Send a file live to an online client
+	answerDirect // Answer a live send offered with eventIncoming
+	listOffers   // List files sent to the client that it hasn't accepted yet
+	answerOffer  // Accept or reject a file sent to the client
+)
+
+// Reply status, every reply starts with one
+const (
+	statusOK uint8 = iota
+	statusError
+	statusQuotaExceeded
+	statusShuttingDown
+	statusLimited // Connection or rate limit hit
 )
 
 const uidFile = ".fsend_uid"
 
+// ServerError is a request refused by the server
+type ServerError struct {
+	Status  uint8
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
 // Client represents a connection to the fsend server
 type Client struct {
 	conn    net.Conn
@@ -108,7 +136,7 @@ func (c *Client) registerUID() error {
 		return err
 	}
 
-	return nil
+	return readStatus(c.conn)
 }
 
 // Ping sends a ping to verify the connection
@@ -122,9 +150,14 @@ func (c *Client) Ping() error {
 		return err
 	}
 
+	err = readStatus(c.conn)
+	if err != nil {
+		return err
+	}
+
 	// Read pong response
 	buf := make([]byte, 4)
-	_, err = c.conn.Read(buf)
+	_, err = io.ReadFull(c.conn, buf)
 	if err != nil {
 		return err
 	}
@@ -149,6 +182,34 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
+// readStatus reads the server's reply to a request and returns a
+// *ServerError if it was refused
+func readStatus(conn net.Conn) error {
+	var status uint8
+	err := binary.Read(conn, binary.LittleEndian, &status)
+	if err != nil {
+		return fmt.Errorf("failed to read status: %w", err)
+	}
+
+	if status == statusOK {
+		return nil
+	}
+
+	var msgLen uint8
+	err = binary.Read(conn, binary.LittleEndian, &msgLen)
+	if err != nil {
+		return fmt.Errorf("failed to read error message length: %w", err)
+	}
+
+	msg := make([]byte, msgLen)
+	_, err = io.ReadFull(conn, msg)
+	if err != nil {
+		return fmt.Errorf("failed to read error message: %w", err)
+	}
+
+	return &ServerError{Status: status, Message: string(msg)}
+}
+
 // GetConnection returns the underlying connection for file operations
 func (c *Client) GetConnection() net.Conn {
 	return c.conn
@@ -166,6 +227,11 @@ func (c *Client) ListFiles() ([]string, error) {
 		return nil, fmt.Errorf("failed to send listFiles command: %w", err)
 	}
 
+	err = readStatus(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
 	// Read number of files
 	var fileCount uint32
 	err = binary.Read(c.conn, binary.LittleEndian, &fileCount)
@@ -183,11 +249,18 @@ func (c *Client) ListFiles() ([]string, error) {
 		}
 
 		nameBuf := make([]byte, nameLen)
-		_, err = c.conn.Read(nameBuf)
+		_, err = io.ReadFull(c.conn, nameBuf)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read filename: %w", err)
 		}
 
+		// Size and expiry time aren't shown by this client
+		var details [2]int64
+		err = binary.Read(c.conn, binary.LittleEndian, &details)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file details: %w", err)
+		}
+
 		files = append(files, string(nameBuf))
 	}
 
@@ -224,6 +297,11 @@ func (c *Client) DownloadFile(filename string, savePath string) error {
 		return fmt.Errorf("failed to send filename: %w", err)
 	}
 
+	err = readStatus(c.conn)
+	if err != nil {
+		return err
+	}
+
 	// Read file size
 	var fsize uint64
 	err = binary.Read(c.conn, binary.LittleEndian, &fsize)
@@ -231,11 +309,6 @@ func (c *Client) DownloadFile(filename string, savePath string) error {
 		return fmt.Errorf("failed to read file size: %w", err)
 	}
 
-	// Check if file was found (size 0 = not found)
-	if fsize == 0 {
-		return fmt.Errorf("file not found on server: %s", filename)
-	}
-
 	// Create local file
 	f, err := os.Create(savePath)
 	if err != nil {
@@ -334,6 +407,18 @@ func (c *Client) SendFileToUUID(filePath string, targetUUID string) error {
 		return fmt.Errorf("failed to send file size: %w", err)
 	}
 
+	// Send requested lifetime (0 = server default)
+	err = binary.Write(c.conn, binary.LittleEndian, uint32(0))
+	if err != nil {
+		return fmt.Errorf("failed to send TTL: %w", err)
+	}
+
+	// Wait until the server accepts the file (e.g. recipient's quota)
+	err = readStatus(c.conn)
+	if err != nil {
+		return err
+	}
+
 	// Open and send file
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -363,3 +448,108 @@ func (c *Client) SendFileToUUID(filePath string, targetUUID string) error {
 	fmt.Printf("✓ Sent %s to %s (%d bytes)\n", filename, targetUUID, sent)
 	return nil
 }
+
+// Offer is a file another client sent that waits for the user to accept it
+type Offer struct {
+	Name string
+	From string // UUID of the sender
+	Size int64
+}
+
+// ListOffers returns the files sent to this client that it hasn't accepted
+// or rejected yet
+func (c *Client) ListOffers() ([]Offer, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("not connected to server")
+	}
+
+	err := binary.Write(c.conn, binary.LittleEndian, listOffers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send listOffers command: %w", err)
+	}
+
+	err = readStatus(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var count uint32
+	err = binary.Read(c.conn, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read offer count: %w", err)
+	}
+
+	offers := make([]Offer, 0, count)
+	for i := uint32(0); i < count; i++ {
+		offer, err := readOffer(c.conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offer: %w", err)
+		}
+		offers = append(offers, offer)
+	}
+	return offers, nil
+}
+
+// readOffer reads a file waiting to be accepted:
+// [fnameLen][fname][fromLen][from][size:int64][expires:int64]
+func readOffer(conn net.Conn) (Offer, error) {
+	var (
+		offer Offer
+		err   error
+	)
+	offer.Name, err = readString(conn)
+	if err != nil {
+		return offer, err
+	}
+	offer.From, err = readString(conn)
+	if err != nil {
+		return offer, err
+	}
+
+	var details struct {
+		Size    int64
+		Expires int64 // Unix seconds, 0 = never
+	}
+	err = binary.Read(conn, binary.LittleEndian, &details)
+	if err != nil {
+		return offer, err
+	}
+	offer.Size = details.Size
+	return offer, nil
+}
+
+// readString reads a string sent as [len:uint8][bytes]
+func readString(conn net.Conn) (string, error) {
+	var n uint8
+	err := binary.Read(conn, binary.LittleEndian, &n)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(conn, b)
+	return string(b), err
+}
+
+// AnswerOffer accepts a file from ListOffers, which then is listed and can
+// be downloaded like the others, or rejects it, which deletes it from the
+// server
+func (c *Client) AnswerOffer(filename string, accept bool) error {
+	if c.conn == nil {
+		return fmt.Errorf("not connected to server")
+	}
+	if len(filename) > 255 {
+		return fmt.Errorf("filename too long (max 255 chars)")
+	}
+
+	var answer uint8
+	if accept {
+		answer = 1
+	}
+	msg := append([]byte{answerOffer, uint8(len(filename))}, filename...)
+	_, err := c.conn.Write(append(msg, answer))
+	if err != nil {
+		return fmt.Errorf("failed to send answer: %w", err)
+	}
+
+	return readStatus(c.conn)
+}
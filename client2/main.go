@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 )
 
 func putFile(filePath string, conn net.Conn, bufSize uint32) (err error) {
@@ -56,6 +57,18 @@ func putFile(filePath string, conn net.Conn, bufSize uint32) (err error) {
 		return
 	}
 
+	// Lifetime in seconds (0 = server default)
+	err = binary.Write(conn, binary.LittleEndian, uint32(0))
+	if err != nil {
+		return
+	}
+
+	// Wait until the server accepts the file (e.g. quota)
+	err = readStatus(conn)
+	if err != nil {
+		return err
+	}
+
 	f, err := os.Open(filePath)
 	if err != nil {
 		return
@@ -88,7 +101,8 @@ func showMenu() {
 	fmt.Println("3. List my files")
 	fmt.Println("4. Download file")
 	fmt.Println("5. Ping server")
-	fmt.Println("6. Exit")
+	fmt.Println("6. Files sent to me (accept or reject)")
+	fmt.Println("7. Exit")
 	fmt.Print("\nChoose option: ")
 }
 
@@ -228,7 +242,52 @@ func main() {
 				fmt.Println("✓ Pong!")
 			}
 
-		case "6": // Exit
+		case "6": // Offers
+			offers, err := client.ListOffers()
+			if err != nil {
+				fmt.Println("❌ Failed to list files sent to you:", err)
+				continue
+			}
+
+			if len(offers) == 0 {
+				fmt.Println("No files waiting for you")
+				continue
+			}
+
+			fmt.Println("\nFiles sent to you:")
+			for i, offer := range offers {
+				fmt.Printf("  %d. %s (%d bytes) from %s\n", i+1, offer.Name, offer.Size, offer.From)
+			}
+
+			fmt.Print("\nEnter file number: ")
+			if !scanner.Scan() {
+				break
+			}
+			var fileNum int
+			_, err = fmt.Sscanf(scanner.Text(), "%d", &fileNum)
+			if err != nil || fileNum < 1 || fileNum > len(offers) {
+				fmt.Println("❌ Invalid file number")
+				continue
+			}
+			offer := offers[fileNum-1]
+
+			fmt.Print("Accept? (y/n): ")
+			if !scanner.Scan() {
+				break
+			}
+			accept := strings.HasPrefix(strings.ToLower(scanner.Text()), "y")
+
+			err = client.AnswerOffer(offer.Name, accept)
+			switch {
+			case err != nil:
+				fmt.Println("❌ Failed to answer:", err)
+			case accept:
+				fmt.Printf("✓ Accepted %s, it is in your files now\n", offer.Name)
+			default:
+				fmt.Printf("✓ Rejected %s, it was deleted\n", offer.Name)
+			}
+
+		case "7": // Exit
 			fmt.Println("Bye!")
 			return
 
@@ -0,0 +1,193 @@
+package fsendserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit events
+const (
+	auditRegister = "register"
+	auditUpload   = "upload"
+	auditSend     = "send"
+	auditDownload = "download"
+	auditDelete   = "delete"
+	auditAccept   = "accept" // The recipient accepted a file sent to it
+	auditDirect   = "direct" // Live send connected directly, the data bypasses the server
+	auditRelay    = "relay"  // Sent live through the server
+)
+
+// auditGenesis is the prev hash of the first entry
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// auditEntry is one line of the audit log. Prev is the SHA-256 of the
+// previous line, so changing, inserting or removing a line breaks the chain
+// from there on.
+type auditEntry struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	UUID       string    `json:"uuid,omitempty"`      // Who acted, or whose file was deleted
+	Recipient  string    `json:"recipient,omitempty"` // Who a file was sent to
+	Filename   string    `json:"filename,omitempty"`
+	Hash       string    `json:"hash,omitempty"` // SHA-256 of the file
+	Size       int64     `json:"size,omitempty"`
+	Reason     string    `json:"reason,omitempty"` // Why a file was deleted
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Prev       string    `json:"prev"`
+}
+
+// auditLog appends entries to a JSON lines file. A nil *auditLog records
+// nothing.
+type auditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64 // Of the last entry
+	prev string // Hash of the last line
+}
+
+// openAuditLog opens the log at path for appending, continuing its chain
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{prev: auditGenesis}
+
+	f, err := os.Open(path)
+	if err == nil {
+		// The chain continues from the last line
+		err = scanAuditLog(f, func(entry auditEntry, line []byte) error {
+			a.seq = entry.Seq
+			a.prev = lineHash(line)
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("audit log %s is damaged, check it with 'audit verify': %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	a.f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Record appends entry, filling in its sequence number, time and chain hash.
+// The entry is synced to disk before Record returns.
+func (a *auditLog) Record(entry auditEntry) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry.Seq = a.seq + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev = a.prev
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		err = a.append(line)
+	}
+	if err != nil {
+		// The entry is missing from the audit log, keep it in the server log
+		slog.Error("failed to write audit log, entry lost", "error", err,
+			"event", entry.Event, "uuid", entry.UUID, "recipient", entry.Recipient,
+			"filename", entry.Filename, "hash", entry.Hash, "size", entry.Size)
+		return
+	}
+
+	a.seq = entry.Seq
+	a.prev = lineHash(line)
+}
+
+// append writes line and syncs it to disk. A line written in part is cut
+// off again so the chain stays intact.
+func (a *auditLog) append(line []byte) error {
+	info, err := a.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = a.f.Write(append(line, '\n'))
+	if err == nil {
+		err = a.f.Sync()
+	}
+	if err != nil {
+		a.f.Truncate(info.Size())
+	}
+	return err
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// scanAuditLog calls fn for every entry in r with the line it was read from,
+// checking the chain on the way
+func scanAuditLog(r io.Reader, fn func(entry auditEntry, line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	prev, seq := auditGenesis, uint64(0)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+
+		var entry auditEntry
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&entry)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid entry: %w", n, err)
+		}
+		if entry.Prev != prev {
+			return fmt.Errorf("line %d: chain broken, the line before it was changed or lines were inserted or removed", n)
+		}
+		if entry.Seq != seq+1 {
+			return fmt.Errorf("line %d: expected seq %d, found %d", n, seq+1, entry.Seq)
+		}
+
+		err = fn(entry, line)
+		if err != nil {
+			return err
+		}
+		prev, seq = lineHash(line), entry.Seq
+	}
+	return scanner.Err()
+}
+
+// runAuditCommand implements "fsend-server audit verify|query"
+func runAuditCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: fsend-server audit verify|query [flags]")
+	}
+
+	switch args[0] {
+	case "verify":
+		return auditVerify(args[1:])
+	case "query":
+		return auditQuery(args[1:])
+	}
+	return fmt.Errorf("unknown audit command %q, want verify or query", args[0])
+}
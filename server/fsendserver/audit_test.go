@@ -0,0 +1,179 @@
+package fsendserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestAuditLog records n upload entries in a new log and returns its
+// lines
+func writeTestAuditLog(t *testing.T, n int) (path string, lines []string) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		a.Record(auditEntry{Event: auditUpload, UUID: "alice", Filename: string(rune('a'+i)) + ".txt", Size: int64(i)})
+	}
+	a.Close()
+	return path, readLines(t, path)
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// TestAuditChain checks that verifying the chain finds changed, inserted and
+// removed lines
+func TestAuditChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		err    string // Part of the error, empty if the log is intact
+	}{
+		{
+			name:   "intact",
+			tamper: func(lines []string) []string { return lines },
+		},
+		{
+			name: "changed line",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], "b.txt", "x.txt", 1)
+				return lines
+			},
+			err: "line 3: chain broken",
+		},
+		{
+			name: "removed line",
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			err: "line 2: chain broken",
+		},
+		{
+			name: "inserted line",
+			tamper: func(lines []string) []string {
+				return append(lines[:2], append([]string{lines[1]}, lines[2:]...)...)
+			},
+			err: "line 3: chain broken",
+		},
+		{
+			name: "swapped lines",
+			tamper: func(lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			err: "line 2: chain broken",
+		},
+		{
+			name: "changed last sequence number",
+			tamper: func(lines []string) []string {
+				lines[3] = strings.Replace(lines[3], `"seq":4`, `"seq":5`, 1)
+				return lines
+			},
+			err: "line 4: expected seq 4, found 5",
+		},
+		{
+			name: "unknown field",
+			tamper: func(lines []string) []string {
+				lines[0] = strings.Replace(lines[0], "{", `{"admin":true,`, 1)
+				return lines
+			},
+			err: "line 1: invalid entry",
+		},
+		{
+			// Only an anchor noted earlier shows this, see TestAuditVerifyAnchor
+			name: "removed last line",
+			tamper: func(lines []string) []string {
+				return lines[:len(lines)-1]
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, lines := writeTestAuditLog(t, 4)
+			log := strings.Join(tt.tamper(lines), "\n") + "\n"
+
+			err := scanAuditLog(strings.NewReader(log), func(auditEntry, []byte) error {
+				return nil
+			})
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("verifying failed: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("verifying returned %v, want an error with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestAuditLogReopen checks that a reopened log continues the chain
+func TestAuditLogReopen(t *testing.T) {
+	path, _ := writeTestAuditLog(t, 2)
+
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(auditEntry{Event: auditDelete, UUID: "alice", Filename: "a.txt", Reason: "deleted"})
+	a.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var last auditEntry
+	err = scanAuditLog(f, func(entry auditEntry, _ []byte) error {
+		last = entry
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("chain broken after reopening: %v", err)
+	}
+	if last.Seq != 3 || last.Event != auditDelete {
+		t.Errorf("last entry is %d %s, want 3 %s", last.Seq, last.Event, auditDelete)
+	}
+}
+
+func TestAuditVerifyAnchor(t *testing.T) {
+	path, lines := writeTestAuditLog(t, 3)
+
+	tests := []struct {
+		name   string
+		anchor string
+		keep   int // Lines left in the log
+		ok     bool
+	}{
+		{"no anchor", "", 3, true},
+		{"anchor at the head", lineHash([]byte(lines[2])), 3, true},
+		{"anchor in the middle", lineHash([]byte(lines[1])), 3, true},
+		{"anchor removed", lineHash([]byte(lines[2])), 2, false},
+		{"unknown anchor", auditGenesis, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.WriteFile(path, []byte(strings.Join(lines[:tt.keep], "\n")+"\n"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = auditVerify([]string{"-file", path, "-anchor", tt.anchor})
+			if tt.ok != (err == nil) {
+				t.Errorf("auditVerify = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
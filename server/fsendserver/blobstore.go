@@ -0,0 +1,520 @@
+package fsendserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blobsDir = "blobs" // content, named by SHA-256
+	refsDir  = "refs"  // refs/{uuid}/{name} -> blob hash
+	tmpDir   = "tmp"   // uploads in progress
+)
+
+var errInvalidName = errors.New("invalid name")
+
+// refEntry is the content of a reference file under refs/{uuid}/
+type refEntry struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+	From    string    `json:"from,omitempty"`
+}
+
+// blobStore is the filesystem Storage. It stores every distinct file body
+// once under blobs/, named by its SHA-256. Each UUID only owns small
+// reference entries under refs/{uuid}/ that point at a blob, so sending the
+// same file to many clients costs one copy. Blobs are reference counted and
+// removed once the last entry is gone.
+type blobStore struct {
+	root string
+
+	mu   sync.Mutex
+	refs map[string]int // blob hash -> number of reference entries
+}
+
+// openBlobStore prepares the store under root, migrates files from the old
+// files/{uuid}/{name} layout and removes blobs nothing refers to anymore
+func openBlobStore(root string) (*blobStore, error) {
+	b := &blobStore{
+		root: root,
+		refs: make(map[string]int),
+	}
+
+	for _, dir := range []string{blobsDir, refsDir, tmpDir} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Leftovers of interrupted uploads
+	err := clearDirectory(filepath.Join(root, tmpDir))
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.countRefs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read references: %w", err)
+	}
+
+	err = b.migrateLegacyLayout()
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate files: %w", err)
+	}
+
+	err = b.collectGarbage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+
+	return b, nil
+}
+
+// validName reports whether s can be used as a single path element
+func validName(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+func (b *blobStore) ownerDir(uuid string) string {
+	return filepath.Join(b.root, refsDir, uuid)
+}
+
+func (b *blobStore) refPath(uuid, name string) string {
+	return filepath.Join(b.root, refsDir, uuid, name)
+}
+
+func (b *blobStore) blobPath(hash string) string {
+	return filepath.Join(b.root, blobsDir, hash[:2], hash)
+}
+
+func (ref refEntry) info(name string) FileInfo {
+	return FileInfo{
+		Name:    name,
+		Size:    ref.Size,
+		Hash:    ref.Hash,
+		Created: ref.Created,
+		Expires: ref.Expires,
+		From:    ref.From,
+	}
+}
+
+func (b *blobStore) Put(uuid string, meta FileInfo, r io.Reader) (FileInfo, error) {
+	name := meta.Name
+	if !validName(uuid) || !validName(name) {
+		return FileInfo{}, errInvalidName
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(b.root, tmpDir), "upload-*")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once the blob has been moved into place
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if meta.Size >= 0 && n != meta.Size {
+		return FileInfo{}, fmt.Errorf("received %d of %d bytes: %w", n, meta.Size, io.ErrUnexpectedEOF)
+	}
+
+	ref := refEntry{
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+		Size:    n,
+		Created: time.Now().UTC(),
+		Expires: meta.Expires,
+		From:    meta.From,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blob := b.blobPath(ref.Hash)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(blob), 0755)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		err = os.Rename(tmp.Name(), blob)
+		if err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	err = os.MkdirAll(b.ownerDir(uuid), 0755)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	old, oldErr := b.readRef(uuid, name)
+	err = b.writeRef(uuid, name, ref)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	b.refs[ref.Hash]++
+	if oldErr == nil {
+		b.release(old.Hash)
+	}
+
+	return ref.info(name), nil
+}
+
+func (b *blobStore) Get(uuid, name string, offset, length int64) (io.ReadCloser, FileInfo, error) {
+	if !validName(uuid) || !validName(name) {
+		return nil, FileInfo{}, os.ErrNotExist
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ref, err := b.readRef(uuid, name)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	f, err := os.Open(b.blobPath(ref.Hash))
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, FileInfo{}, err
+	}
+
+	if length < 0 {
+		return f, ref.info(name), nil
+	}
+	return limitedFile{io.LimitReader(f, length), f}, ref.info(name), nil
+}
+
+// limitedFile reads a section of a file
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+func (b *blobStore) List(uuid string) ([]FileInfo, error) {
+	names, err := b.names(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	files := make([]FileInfo, 0, len(names))
+	for _, name := range names {
+		ref, err := b.readRef(uuid, name)
+		if err != nil {
+			continue // Removed meanwhile
+		}
+		files = append(files, ref.info(name))
+	}
+	return files, nil
+}
+
+func (b *blobStore) Stat(uuid, name string) (FileInfo, error) {
+	if !validName(uuid) || !validName(name) {
+		return FileInfo{}, os.ErrNotExist
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ref, err := b.readRef(uuid, name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return ref.info(name), nil
+}
+
+func (b *blobStore) Accept(uuid, name string) error {
+	if !validName(uuid) || !validName(name) {
+		return os.ErrNotExist
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ref, err := b.readRef(uuid, name)
+	if err != nil {
+		return err
+	}
+	ref.From = ""
+	return b.writeRef(uuid, name, ref)
+}
+
+func (b *blobStore) Owners() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(b.root, refsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			owners = append(owners, entry.Name())
+		}
+	}
+	return owners, nil
+}
+
+func (b *blobStore) Prune(uuid string) error {
+	if !validName(uuid) {
+		return errInvalidName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names, err := b.names(uuid)
+	if err != nil || len(names) > 0 {
+		return err
+	}
+
+	err = os.Remove(b.ownerDir(uuid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// names returns the names of all reference entries of uuid
+func (b *blobStore) names(uuid string) ([]string, error) {
+	if !validName(uuid) {
+		return nil, errInvalidName
+	}
+
+	entries, err := os.ReadDir(b.ownerDir(uuid))
+	if os.IsNotExist(err) {
+		return []string{}, nil // No files yet
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete removes a file of uuid, and its blob if nothing else refers to it
+func (b *blobStore) Delete(uuid, name string) error {
+	if !validName(uuid) || !validName(name) {
+		return os.ErrNotExist
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ref, err := b.readRef(uuid, name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(b.refPath(uuid, name))
+	if err != nil {
+		return err
+	}
+
+	b.release(ref.Hash)
+	return nil
+}
+
+// release drops one reference to a blob. Caller must hold b.mu.
+func (b *blobStore) release(hash string) {
+	b.refs[hash]--
+	if b.refs[hash] > 0 {
+		return
+	}
+
+	delete(b.refs, hash)
+	err := os.Remove(b.blobPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to remove blob", "hash", hash, "error", err)
+	}
+}
+
+func (b *blobStore) readRef(uuid, name string) (refEntry, error) {
+	var ref refEntry
+
+	data, err := os.ReadFile(b.refPath(uuid, name))
+	if err != nil {
+		return ref, err
+	}
+
+	err = json.Unmarshal(data, &ref)
+	if err != nil || len(ref.Hash) != sha256.Size*2 {
+		return ref, fmt.Errorf("corrupt reference %s/%s", uuid, name)
+	}
+	return ref, nil
+}
+
+// writeRef replaces a reference file atomically
+func (b *blobStore) writeRef(uuid, name string, ref refEntry) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(b.root, tmpDir), "ref-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), b.refPath(uuid, name))
+}
+
+// countRefs rebuilds the reference counts from the entries on disk
+func (b *blobStore) countRefs() error {
+	owners, err := b.Owners()
+	if err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		names, err := b.names(owner)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			ref, err := b.readRef(owner, name)
+			if err != nil {
+				slog.Warn("skipping unreadable reference", "uuid", owner, "filename", name, "error", err)
+				continue
+			}
+			b.refs[ref.Hash]++
+		}
+	}
+	return nil
+}
+
+// collectGarbage removes blobs that no reference entry points at, e.g. after
+// a crash between writing a blob and its reference
+func (b *blobStore) collectGarbage() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return filepath.WalkDir(filepath.Join(b.root, blobsDir), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		if b.refs[d.Name()] == 0 {
+			slog.Info("removing unreferenced blob", "hash", d.Name())
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// migrateLegacyLayout moves files stored as files/{uuid}/{name} into the store
+func (b *blobStore) migrateLegacyLayout() error {
+	entries, err := os.ReadDir(b.root)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		uuid := entry.Name()
+		if !entry.IsDir() || uuid == blobsDir || uuid == refsDir || uuid == tmpDir {
+			continue
+		}
+
+		legacyDir := filepath.Join(b.root, uuid)
+		files, err := os.ReadDir(legacyDir)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+
+			err = b.migrateFile(uuid, filepath.Join(legacyDir, file.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.Remove(legacyDir)
+		if err != nil {
+			slog.Warn("failed to remove legacy directory", "path", legacyDir, "error", err)
+			continue
+		}
+		slog.Info("migrated legacy files", "uuid", uuid, "files", len(files))
+	}
+	return nil
+}
+
+func (b *blobStore) migrateFile(uuid, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Put(uuid, FileInfo{Name: filepath.Base(path), Size: info.Size()}, f)
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+	return os.Remove(path)
+}
+
+// clearDirectory removes everything inside dir but keeps dir itself
+func clearDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package fsendserver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestBlobStoreRefcounts checks that identical files share one blob, which
+// is removed with the last reference to it
+func TestBlobStoreRefcounts(t *testing.T) {
+	b, err := openBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		op                   string // put or delete
+		owner, name, content string
+		blobs                []string // Contents stored afterwards
+	}{
+		{"put", "alice", "a.txt", "same", []string{"same"}},
+		{"put", "bob", "b.txt", "same", []string{"same"}},
+		{"put", "bob", "c.txt", "other", []string{"same", "other"}},
+		{"delete", "alice", "a.txt", "", []string{"same", "other"}},
+		{"put", "bob", "b.txt", "new", []string{"other", "new"}}, // Replacing releases the old blob
+		{"put", "bob", "c.txt", "other", []string{"other", "new"}},
+		{"delete", "bob", "c.txt", "", []string{"new"}},
+		{"delete", "bob", "b.txt", "", nil},
+	}
+	for i, step := range steps {
+		switch step.op {
+		case "put":
+			mustPut(t, b, step.owner, FileInfo{Name: step.name, Size: int64(len(step.content))}, step.content)
+		case "delete":
+			err := b.Delete(step.owner, step.name)
+			if err != nil {
+				t.Fatalf("step %d: Delete(%s, %s): %v", i, step.owner, step.name, err)
+			}
+		}
+
+		want := hashes(step.blobs...)
+		if got := blobHashes(t, b.root); !slices.Equal(got, want) {
+			t.Errorf("step %d (%s %s/%s): blobs %q, want %q", i, step.op, step.owner, step.name, got, want)
+		}
+		if len(b.refs) != len(want) {
+			t.Errorf("step %d: counting references of %d blobs, want %d", i, len(b.refs), len(want))
+		}
+	}
+}
+
+// TestOpenBlobStore checks that reopening a store counts its references
+// again and cleans up what a crash may have left behind
+func TestOpenBlobStore(t *testing.T) {
+	root := t.TempDir()
+	b, err := openBlobStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, b, "alice", FileInfo{Name: "a.txt", Size: 4}, "same")
+	mustPut(t, b, "bob", FileInfo{Name: "b.txt", Size: 4}, "same")
+
+	// A blob without references and an unfinished upload
+	orphan := sha256Hex("orphan")
+	writeFile(t, filepath.Join(root, blobsDir, orphan[:2], orphan), "orphan")
+	writeFile(t, filepath.Join(root, tmpDir, "upload-1"), "partial")
+
+	b, err = openBlobStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := blobHashes(t, root), hashes("same"); !slices.Equal(got, want) {
+		t.Errorf("blobs after reopening: %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, tmpDir)); len(entries) != 0 {
+		t.Errorf("%d leftovers in %s after reopening", len(entries), tmpDir)
+	}
+	if n := b.refs[sha256Hex("same")]; n != 2 {
+		t.Errorf("counted %d references to the shared blob, want 2", n)
+	}
+
+	// The counts must be right for the blob to survive the first delete
+	err = b.Delete("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, b, "bob", "b.txt"); got != "same" {
+		t.Errorf("bob's file reads %q after alice deleted hers, want %q", got, "same")
+	}
+}
+
+// TestBlobStoreMigration checks that files of the files/{uuid}/{name}
+// layout are moved into the store
+func TestBlobStoreMigration(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy map[string]string // uuid/name -> content
+		blobs  []string
+	}{
+		{
+			name:   "one file",
+			legacy: map[string]string{"alice/a.txt": "hello"},
+			blobs:  []string{"hello"},
+		},
+		{
+			name: "shared content",
+			legacy: map[string]string{
+				"alice/a.txt": "hello",
+				"bob/b.txt":   "hello",
+				"bob/c.txt":   "other",
+			},
+			blobs: []string{"hello", "other"},
+		},
+		{
+			name:   "empty file",
+			legacy: map[string]string{"alice/empty": ""},
+			blobs:  []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for path, content := range tt.legacy {
+				writeFile(t, filepath.Join(root, path), content)
+			}
+
+			b, err := openBlobStore(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for path, content := range tt.legacy {
+				owner, name := filepath.Split(path)
+				owner = filepath.Clean(owner)
+				if got := readAll(t, b, owner, name); got != content {
+					t.Errorf("%s reads %q, want %q", path, got, content)
+				}
+				if _, err := os.Stat(filepath.Join(root, owner)); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("legacy directory %s is still there: %v", owner, err)
+				}
+			}
+			if got, want := blobHashes(t, root), hashes(tt.blobs...); !slices.Equal(got, want) {
+				t.Errorf("blobs %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// blobHashes returns the sorted names of the blobs under root
+func blobHashes(t *testing.T, root string) []string {
+	t.Helper()
+
+	var names []string
+	err := filepath.WalkDir(filepath.Join(root, blobsDir), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			names = append(names, d.Name())
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// hashes returns the sorted SHA-256 of contents
+func hashes(contents ...string) []string {
+	var sums []string
+	for _, c := range contents {
+		sums = append(sums, sha256Hex(c))
+	}
+	slices.Sort(sums)
+	return sums
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
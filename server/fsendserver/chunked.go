@@ -0,0 +1,112 @@
+package fsendserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+)
+
+// sizeUnknown as the file size of putfile or sendToUUID starts a chunked
+// upload, e.g. of a pipe. The data follows as chunks of [len:uint32][bytes],
+// ended by a chunk of length 0, and the server replies a final status once
+// the file is stored.
+const sizeUnknown = math.MaxUint64
+
+// chunkReader reads the data of a chunked upload up to the end marker
+type chunkReader struct {
+	r    io.Reader
+	left uint32 // Bytes left in the current chunk
+	done bool   // Read the end marker
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		err := binary.Read(c.r, binary.LittleEndian, &c.left)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		c.done = c.left == 0
+	}
+
+	if uint32(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= uint32(n)
+	return n, unexpectedEOF(err)
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, the connection closing
+// before the end marker
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// quotaReader claims quota for the data as it is read, failing once the
+// owner or the server runs out of room. It keeps failing after that, as
+// bufio reads on after an error.
+type quotaReader struct {
+	r   io.Reader
+	res *reservation
+	err error
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	n, err := q.r.Read(p)
+	if n > 0 {
+		q.err = q.res.grow(int64(n))
+		if q.err != nil {
+			return n, q.err
+		}
+	}
+	return n, err
+}
+
+// connectionLost reports whether err of receiving a file means the client is
+// gone or out of step, so the connection must be closed
+func connectionLost(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// receiveChunked stores a chunked upload as meta for owner, growing res as
+// the data arrives so it is cut off at the quota, and replies the final
+// status. Unless the connection was lost, the client was told about an
+// error.
+func (s *ServerContext) receiveChunked(conn net.Conn, owner string, meta FileInfo, res *reservation, bufSize int) (FileInfo, error) {
+	chunks := &chunkReader{r: s.transfer(conn)}
+	body := &quotaReader{r: chunks, res: res}
+
+	meta.Size = -1
+	info, err := s.storage.Put(owner, meta, bufio.NewReaderSize(body, bufSize))
+	if err == nil {
+		return info, writeStatus(conn, statusOK, "")
+	}
+	if connectionLost(err) {
+		return info, err
+	}
+
+	// Skip the rest of the upload so the status and the next opcode line up
+	_, drainErr := io.Copy(io.Discard, chunks)
+	if drainErr != nil {
+		return info, drainErr
+	}
+	code := statusError
+	if errors.Is(err, errQuotaExceeded) {
+		code = statusQuotaExceeded
+	}
+	writeStatus(conn, code, err.Error())
+	return info, err
+}
@@ -0,0 +1,230 @@
+package fsendserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// chunk frames data as one chunk of a chunked upload
+func chunk(data string) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+// frames joins chunks and end markers into the bytes a client sends
+func frames(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var endMarker = chunk("")
+
+func TestChunkReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+		err   error
+		left  int // Bytes after the end marker, which must stay unread
+	}{
+		{"one chunk", frames(chunk("hello"), endMarker), "hello", nil, 0},
+		{"several chunks", frames(chunk("hel"), chunk("lo, "), chunk("world"), endMarker), "hello, world", nil, 0},
+		{"no data", endMarker, "", nil, 0},
+		{"data after the end marker", frames(chunk("hi"), endMarker, chunk("next")), "hi", nil, len(chunk("next"))},
+		{"no end marker", chunk("hello"), "hello", io.ErrUnexpectedEOF, 0},
+		{"nothing", nil, "", io.ErrUnexpectedEOF, 0},
+		{"chunk cut short", frames(chunk("hello"))[:6], "he", io.ErrUnexpectedEOF, 0},
+		{"length cut short", []byte{5, 0}, "", io.ErrUnexpectedEOF, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(tt.input)
+			got, err := io.ReadAll(&chunkReader{r: r})
+			if string(got) != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("read %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+			if r.Len() != tt.left {
+				t.Errorf("%d bytes left unread, want %d", r.Len(), tt.left)
+			}
+		})
+	}
+}
+
+// TestReceiveChunked runs chunked uploads over a connection and checks what
+// is stored, the final status and that the connection stays in step for
+// the next request
+func TestReceiveChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   int64
+		input   []byte
+		close   bool   // The client goes away after sending input
+		stored  string // Empty if nothing is stored
+		status  uint8
+		lostErr bool // receiveChunked reports the connection lost
+	}{
+		{
+			name:   "stored",
+			input:  frames(chunk("hello, "), chunk("world"), endMarker),
+			stored: "hello, world",
+			status: statusOK,
+		},
+		{
+			name:   "fits the quota exactly",
+			quota:  10,
+			input:  frames(chunk("hello"), chunk("world"), endMarker),
+			stored: "helloworld",
+			status: statusOK,
+		},
+		{
+			name:   "over the quota",
+			quota:  8,
+			input:  frames(chunk("hello"), chunk("world"), chunk("again"), endMarker),
+			status: statusQuotaExceeded,
+		},
+		{
+			name:    "client gone before the end marker",
+			input:   chunk("hello"),
+			close:   true,
+			lostErr: true,
+		},
+		{
+			name:    "client gone mid-chunk",
+			input:   frames(chunk("hello"))[:6],
+			close:   true,
+			lostErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The filesystem store, whose copy makes bufio read on after
+			// an error
+			b, err := openBlobStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := newQuotaStorage(b, tt.quota, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := DefaultConfig()
+			s := &ServerContext{
+				clients: make(map[net.Conn]*ClientInfo),
+				storage: q,
+				quotas:  q,
+				metrics: newMetrics(),
+				config:  &config,
+			}
+			server, client := net.Pipe()
+			defer server.Close()
+			s.clients[server] = &ClientInfo{limits: &ipLimits{}}
+
+			// The client sends the upload, reads the final status and sends
+			// the next opcode
+			status := make(chan uint8, 1)
+			go func() {
+				defer client.Close()
+				client.Write(tt.input)
+				if tt.close {
+					return
+				}
+				var reply [2]byte
+				io.ReadFull(client, reply[:1])
+				if reply[0] != statusOK {
+					io.ReadFull(client, reply[1:])
+					io.CopyN(io.Discard, client, int64(reply[1]))
+				}
+				status <- reply[0]
+				client.Write([]byte{ping})
+			}()
+
+			res, err := q.reserve("alice", "pipe.txt", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.release()
+			_, err = s.receiveChunked(server, "alice", FileInfo{Name: "pipe.txt"}, res, 1024)
+
+			if tt.lostErr {
+				if err == nil || !connectionLost(err) {
+					t.Errorf("receiveChunked = %v, want the connection lost", err)
+				}
+			} else {
+				if got := <-status; got != tt.status {
+					t.Errorf("status %d, want %d", got, tt.status)
+				}
+				var next [1]byte
+				_, readErr := io.ReadFull(server, next[:])
+				if readErr != nil || next[0] != ping {
+					t.Errorf("next opcode %v, %v, want ping", next[0], readErr)
+				}
+			}
+
+			if tt.stored == "" {
+				if _, err := q.Stat("alice", "pipe.txt"); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("Stat of a failed upload: %v, want os.ErrNotExist", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readAll(t, q, "alice", "pipe.txt"); got != tt.stored {
+				t.Errorf("stored %q, want %q", got, tt.stored)
+			}
+			if used, _, _ := q.Usage("alice"); used != int64(len(tt.stored)) {
+				t.Errorf("quota counts %d bytes, want %d", used, len(tt.stored))
+			}
+		})
+	}
+}
+
+// TestQuotaReaderGrows checks that concurrent chunked uploads share the
+// quota instead of each seeing the room left when it started
+func TestQuotaReaderGrows(t *testing.T) {
+	q, err := newQuotaStorage(newMemStorage(), 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := q.reserve("alice", "a.bin", 0)
+	second, _ := q.reserve("alice", "b.bin", 0)
+	defer first.release()
+	defer second.release()
+
+	steps := []struct {
+		res  *reservation
+		data int
+		ok   bool
+	}{
+		{first, 60, true},
+		{second, 30, true},
+		{second, 20, false}, // 110 of 100
+		{first, 10, true},
+		{second, 1, false}, // Keeps failing
+	}
+	readers := map[*reservation]*quotaReader{}
+	for i, step := range steps {
+		r := readers[step.res]
+		if r == nil {
+			r = &quotaReader{res: step.res}
+			readers[step.res] = r
+		}
+		r.r = strings.NewReader(strings.Repeat("x", step.data))
+
+		_, err := io.ReadAll(r)
+		if step.ok != (err == nil) {
+			t.Errorf("step %d: reading %d bytes: %v, want ok %v", i, step.data, err, step.ok)
+		}
+		if err != nil && !errors.Is(err, errQuotaExceeded) {
+			t.Errorf("step %d: %v, want errQuotaExceeded", i, err)
+		}
+	}
+	if q.reserved["alice"] > 100 {
+		t.Errorf("reserved %d of a quota of 100", q.reserved["alice"])
+	}
+}
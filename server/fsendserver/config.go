@@ -0,0 +1,444 @@
+package fsendserver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config holds all server settings. Every setting has a default, which the
+// JSON config file, then FSEND_* environment variables and finally command
+// line flags can override.
+type Config struct {
+	Listen   string         `json:"listen"`
+	TLS      TLSConfig      `json:"tls"`
+	Storage  StorageConfig  `json:"storage"`
+	Quota    QuotaConfig    `json:"quota"`
+	Expiry   ExpiryConfig   `json:"expiry"`
+	Timeouts TimeoutsConfig `json:"timeouts"`
+	Limits   LimitsConfig   `json:"limits"`
+	Buffers  BuffersConfig  `json:"buffers"`
+	Log      LogConfig      `json:"log"`
+	Metrics  MetricsConfig  `json:"metrics"`
+	Audit    AuditConfig    `json:"audit"`
+	Senders  SendersConfig  `json:"senders"`
+	HTTP     HTTPConfig     `json:"http"`
+	QUIC     QUICConfig     `json:"quic"`
+	MDNS     MDNSConfig     `json:"mdns"`
+}
+
+// TLSConfig enables TLS on the listener when both files are set
+type TLSConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// StorageConfig selects and configures a Storage backend
+type StorageConfig struct {
+	Backend string   `json:"backend"` // "fs", "s3" or "memory"
+	Path    string   `json:"path"`    // Directory for the fs backend
+	S3      S3Config `json:"s3"`
+}
+
+// S3Config configures the s3 backend. Credentials come from the AWS_*
+// environment variables.
+type S3Config struct {
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"`
+	Prefix   string `json:"prefix"`
+}
+
+// QuotaConfig limits stored bytes, 0 = unlimited
+type QuotaConfig struct {
+	PerUUID Size `json:"per_uuid"`
+	Global  Size `json:"global"`
+}
+
+// ExpiryConfig decides how long stored files live
+type ExpiryConfig struct {
+	DefaultTTL      Duration `json:"default_ttl"` // Used when the sender doesn't choose, 0 = forever
+	MaxTTL          Duration `json:"max_ttl"`     // Upper bound for what senders choose, 0 = none
+	OfferTTL        Duration `json:"offer_ttl"`   // Files sent to a UUID that aren't accepted by then are discarded, 0 = kept like accepted files
+	JanitorInterval Duration `json:"janitor_interval"`
+}
+
+// TimeoutsConfig bounds how long connections may stall, 0 = forever
+type TimeoutsConfig struct {
+	Idle     Duration `json:"idle"`     // Between two requests
+	Header   Duration `json:"header"`   // From the opcode to the end of a request's header
+	Progress Duration `json:"progress"` // Without any file data moving during a transfer
+	Shutdown Duration `json:"shutdown"` // For transfers to finish when stopping
+}
+
+// LimitsConfig caps connections and rates, 0 = unlimited
+type LimitsConfig struct {
+	MaxConnections    int     `json:"max_connections"`
+	PerIP             int     `json:"per_ip"`   // Connections from one IP
+	PerUUID           int     `json:"per_uuid"` // Connections registered with one UUID
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	RequestBurst      int     `json:"request_burst"`
+	UploadRate        Size    `json:"upload_rate"` // Bytes per second, per IP
+}
+
+// BuffersConfig sizes the buffers used to copy file data
+type BuffersConfig struct {
+	Copy Size `json:"copy"`
+}
+
+// LogConfig controls server output
+type LogConfig struct {
+	File   string     `json:"file"`   // Append output to this file instead of stdout
+	Level  slog.Level `json:"level"`  // "debug", "info", "warn" or "error"
+	Format string     `json:"format"` // "text" or "json"
+}
+
+// MetricsConfig enables the Prometheus endpoint
+type MetricsConfig struct {
+	Listen  string `json:"listen"`   // HTTP address serving /metrics, empty = off
+	PerUUID bool   `json:"per_uuid"` // Also the bytes stored by each UUID, which tells who uses the server
+}
+
+// AuditConfig enables the audit log of transfers
+type AuditConfig struct {
+	File string `json:"file"` // Hash-chained JSON lines, empty = off
+}
+
+// SendersConfig keeps who may send files to each UUID
+type SendersConfig struct {
+	File string `json:"file"` // JSON file of all sender policies, relative to the fs storage directory, empty = memory only
+}
+
+// HTTPConfig enables the HTTP gateway that serves download and upload links
+// and the WebSocket transport
+type HTTPConfig struct {
+	Listen  string   `json:"listen"`   // Address of the gateway, empty = off
+	URL     string   `json:"url"`      // Start of links, e.g. https://files.example.com, default from the address clients connect to
+	Secret  string   `json:"secret"`   // Key links are sealed with, random per start if empty
+	LinkTTL Duration `json:"link_ttl"` // Longest a link stays valid
+}
+
+// QUICConfig enables the QUIC listener, which needs the TLS certificate
+type QUICConfig struct {
+	Listen string `json:"listen"` // UDP address, empty = off
+}
+
+// MDNSConfig announces the server on the local network, where clients find
+// it when their configured server is unreachable. It is off by default.
+type MDNSConfig struct {
+	Announce bool   `json:"announce"`
+	Name     string `json:"name"` // Shown to clients, default "fsend on <host>"
+}
+
+// DefaultConfig returns the settings used where nothing overrides them
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":3002",
+		Storage: StorageConfig{
+			Backend: "fs",
+			Path:    filesDir,
+			S3: S3Config{
+				Region: "us-east-1",
+			},
+		},
+		Expiry: ExpiryConfig{
+			// Files are kept until deleted, as before expiry existed
+			DefaultTTL:      0,
+			MaxTTL:          0,
+			OfferTTL:        Duration(3 * 24 * time.Hour),
+			JanitorInterval: Duration(time.Minute),
+		},
+		Timeouts: TimeoutsConfig{
+			Idle:     Duration(5 * time.Minute),
+			Header:   Duration(30 * time.Second),
+			Progress: Duration(time.Minute),
+			Shutdown: Duration(30 * time.Second),
+		},
+		Limits: LimitsConfig{
+			MaxConnections:    1000,
+			PerIP:             20,
+			PerUUID:           5,
+			RequestsPerSecond: 20,
+			RequestBurst:      50,
+		},
+		Buffers: BuffersConfig{
+			Copy: 32 * 1024,
+		},
+		Log: LogConfig{
+			Level:  slog.LevelInfo,
+			Format: "text",
+		},
+		Senders: SendersConfig{
+			File: "senders.json",
+		},
+		HTTP: HTTPConfig{
+			LinkTTL: Duration(24 * time.Hour),
+		},
+	}
+}
+
+// registerFlags binds a flag to every setting, using the current values as
+// defaults
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Address to listen on")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "TLS certificate file (enables TLS together with -tls-key)")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "TLS private key file")
+	fs.StringVar(&c.QUIC.Listen, "quic-listen", c.QUIC.Listen, "Also accept QUIC clients on this UDP address, e.g. :3002 (needs -tls-cert and -tls-key, empty = off)")
+	fs.BoolVar(&c.MDNS.Announce, "mdns", c.MDNS.Announce, "Announce the server on the local network with mDNS, so nearby clients find it")
+	fs.StringVar(&c.MDNS.Name, "mdns-name", c.MDNS.Name, "Name nearby clients see (default \"fsend on <host>\")")
+	fs.StringVar(&c.Storage.Backend, "storage", c.Storage.Backend, "Storage backend: fs, s3 or memory")
+	fs.StringVar(&c.Storage.Path, "files", c.Storage.Path, "Directory for the fs storage backend")
+	fs.StringVar(&c.Storage.S3.Endpoint, "s3-endpoint", c.Storage.S3.Endpoint, "S3 endpoint URL, e.g. https://s3.eu-west-1.amazonaws.com")
+	fs.StringVar(&c.Storage.S3.Bucket, "s3-bucket", c.Storage.S3.Bucket, "S3 bucket name")
+	fs.StringVar(&c.Storage.S3.Region, "s3-region", c.Storage.S3.Region, "S3 region")
+	fs.StringVar(&c.Storage.S3.Prefix, "s3-prefix", c.Storage.S3.Prefix, "Key prefix for objects in the S3 bucket")
+	fs.TextVar(&c.Quota.PerUUID, "quota-per-uuid", c.Quota.PerUUID, "Maximum bytes stored per UUID, e.g. 2G (0 = unlimited)")
+	fs.TextVar(&c.Quota.Global, "quota-global", c.Quota.Global, "Maximum bytes stored in total, e.g. 500G (0 = unlimited)")
+	fs.TextVar(&c.Expiry.DefaultTTL, "ttl", c.Expiry.DefaultTTL, "How long files are kept unless the sender chooses otherwise (0 = forever)")
+	fs.TextVar(&c.Expiry.MaxTTL, "max-ttl", c.Expiry.MaxTTL, "Longest lifetime a sender may choose (0 = no limit)")
+	fs.TextVar(&c.Expiry.OfferTTL, "offer-ttl", c.Expiry.OfferTTL, "Discard files sent to a UUID that aren't accepted within this long (0 = keep them like accepted files)")
+	fs.TextVar(&c.Expiry.JanitorInterval, "janitor-interval", c.Expiry.JanitorInterval, "How often expired files are removed")
+	fs.TextVar(&c.Timeouts.Idle, "idle-timeout", c.Timeouts.Idle, "Disconnect clients that send no request for this long (0 = never)")
+	fs.TextVar(&c.Timeouts.Header, "header-timeout", c.Timeouts.Header, "Drop clients that take longer to send a request's header (0 = never)")
+	fs.TextVar(&c.Timeouts.Progress, "progress-timeout", c.Timeouts.Progress, "Drop transfers that move no data for this long (0 = never)")
+	fs.TextVar(&c.Timeouts.Shutdown, "shutdown-timeout", c.Timeouts.Shutdown, "How long running transfers may take to finish on SIGINT/SIGTERM")
+	fs.IntVar(&c.Limits.MaxConnections, "max-connections", c.Limits.MaxConnections, "Maximum concurrent connections (0 = unlimited)")
+	fs.IntVar(&c.Limits.PerIP, "max-connections-per-ip", c.Limits.PerIP, "Maximum concurrent connections from one IP (0 = unlimited)")
+	fs.IntVar(&c.Limits.PerUUID, "max-connections-per-uuid", c.Limits.PerUUID, "Maximum concurrent connections per UUID (0 = unlimited)")
+	fs.Float64Var(&c.Limits.RequestsPerSecond, "request-rate", c.Limits.RequestsPerSecond, "Requests per second allowed from one IP (0 = unlimited)")
+	fs.IntVar(&c.Limits.RequestBurst, "request-burst", c.Limits.RequestBurst, "Requests one IP may make at once on top of -request-rate")
+	fs.TextVar(&c.Limits.UploadRate, "upload-rate", c.Limits.UploadRate, "Upload bytes per second allowed from one IP, e.g. 10M (0 = unlimited)")
+	fs.TextVar(&c.Buffers.Copy, "buffer-size", c.Buffers.Copy, "Buffer size for copying file data, e.g. 64K")
+	fs.StringVar(&c.HTTP.Listen, "http-listen", c.HTTP.Listen, "Serve download and upload links and the WebSocket transport over HTTP on this address, e.g. :8080 (empty = off)")
+	fs.StringVar(&c.HTTP.URL, "http-url", c.HTTP.URL, "Public URL of the HTTP gateway, e.g. https://files.example.com (default: the address clients connect to)")
+	fs.StringVar(&c.HTTP.Secret, "http-secret", c.HTTP.Secret, "Secret download links are signed with (default: random, links stop working on restart)")
+	fs.TextVar(&c.HTTP.LinkTTL, "link-ttl", c.HTTP.LinkTTL, "Longest time a download link stays valid")
+	fs.StringVar(&c.Audit.File, "audit-log", c.Audit.File, "Append an audit log of transfers to this file (empty = off)")
+	fs.StringVar(&c.Senders.File, "senders-file", c.Senders.File, "File that keeps who may send files to each UUID, relative to -files for the fs backend (empty = memory only)")
+	fs.StringVar(&c.Metrics.Listen, "metrics-listen", c.Metrics.Listen, "Serve Prometheus metrics at /metrics on this address, e.g. :9102 (empty = off)")
+	fs.BoolVar(&c.Metrics.PerUUID, "metrics-per-uuid", c.Metrics.PerUUID, "Also export the bytes stored by each UUID, which tells who uses the server")
+	fs.StringVar(&c.Log.File, "log-file", c.Log.File, "Append output to this file instead of stdout")
+	fs.TextVar(&c.Log.Level, "log-level", c.Log.Level, "Log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "Log format: text or json")
+}
+
+// envName returns the environment variable for a flag, e.g. FSEND_S3_BUCKET
+func envName(flagName string) string {
+	return "FSEND_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the configuration from defaults, the config file given
+// by -config or FSEND_CONFIG, the environment and args. printOnly is set if
+// -print-config was given.
+func loadConfig(args []string) (cfg Config, printOnly bool, err error) {
+	// First pass only finds the config file, the rest is parsed once the
+	// file has been applied so flags take precedence
+	var (
+		scratch    = DefaultConfig()
+		configPath = os.Getenv("FSEND_CONFIG")
+	)
+	fs := flag.NewFlagSet("fsend-server", flag.ContinueOnError)
+	scratch.registerFlags(fs)
+	fs.StringVar(&configPath, "config", configPath, "JSON config file (env FSEND_CONFIG)")
+	fs.BoolVar(&printOnly, "print-config", false, "Print the effective configuration and exit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of fsend-server:")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nEvery flag can also be set with an environment variable, e.g. -s3-bucket as FSEND_S3_BUCKET.")
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return cfg, false, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg = DefaultConfig()
+	if configPath != "" {
+		err = cfg.loadFile(configPath)
+		if err != nil {
+			return cfg, false, err
+		}
+	}
+
+	fs = flag.NewFlagSet("fsend-server", flag.ContinueOnError)
+	fs.SetOutput(io.Discard) // Errors were reported by the first pass
+	cfg.registerFlags(fs)
+	fs.String("config", "", "")
+	fs.Bool("print-config", false, "")
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	if err != nil {
+		return cfg, false, err
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return cfg, false, err
+	}
+
+	return cfg, printOnly, cfg.validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if c.Listen == "" {
+		errs = append(errs, errors.New("listen address must not be empty"))
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls needs both cert and key"))
+	}
+	if c.QUIC.Listen != "" && c.TLS.Cert == "" {
+		errs = append(errs, errors.New("quic needs a tls cert and key"))
+	}
+
+	switch c.Storage.Backend {
+	case "fs":
+		if c.Storage.Path == "" {
+			errs = append(errs, errors.New("storage.path must not be empty"))
+		}
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			errs = append(errs, errors.New("storage.s3 needs endpoint and bucket"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage backend %q", c.Storage.Backend))
+	}
+
+	if c.Quota.PerUUID < 0 || c.Quota.Global < 0 {
+		errs = append(errs, errors.New("quotas must not be negative"))
+	}
+	if c.Expiry.DefaultTTL < 0 || c.Expiry.MaxTTL < 0 || c.Expiry.OfferTTL < 0 {
+		errs = append(errs, errors.New("expiry durations must not be negative"))
+	}
+	if c.Expiry.JanitorInterval <= 0 {
+		errs = append(errs, errors.New("expiry.janitor_interval must be positive"))
+	}
+	if c.Timeouts.Idle < 0 || c.Timeouts.Header < 0 || c.Timeouts.Progress < 0 || c.Timeouts.Shutdown < 0 {
+		errs = append(errs, errors.New("timeouts must not be negative"))
+	}
+	if c.Limits.MaxConnections < 0 || c.Limits.PerIP < 0 || c.Limits.PerUUID < 0 ||
+		c.Limits.RequestsPerSecond < 0 || c.Limits.RequestBurst < 0 || c.Limits.UploadRate < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+	if c.Buffers.Copy < 1024 || c.Buffers.Copy > 16*1024*1024 {
+		errs = append(errs, errors.New("buffers.copy must be between 1K and 16M"))
+	}
+
+	if c.HTTP.LinkTTL <= 0 {
+		errs = append(errs, errors.New("http.link_ttl must be positive"))
+	}
+	if c.HTTP.URL != "" {
+		u, err := url.Parse(c.HTTP.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("http.url %q must be an http or https URL", c.HTTP.URL))
+		}
+	}
+	if c.HTTP.Secret != "" && len(c.HTTP.Secret) < 16 {
+		errs = append(errs, errors.New("http.secret must be at least 16 characters"))
+	}
+
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("unknown log format %q", c.Log.Format))
+	}
+
+	return errors.Join(errs...)
+}
+
+// sendersPath is the file sender policies are kept in. A relative
+// Senders.File is inside the storage directory of the fs backend, next to
+// the files.
+func (c *Config) sendersPath() string {
+	p := c.Senders.File
+	if p == "" || filepath.IsAbs(p) || c.Storage.Backend != "fs" {
+		return p
+	}
+	return filepath.Join(c.Storage.Path, p)
+}
+
+// Print writes the configuration as JSON, in the config file format, with
+// the HTTP secret masked as it often ends up in logs and bug reports
+func (c *Config) Print() {
+	masked := *c
+	if masked.HTTP.Secret != "" {
+		masked.HTTP.Secret = "********"
+	}
+	data, _ := json.MarshalIndent(masked, "", "  ")
+	fmt.Println(string(data))
+}
+
+// Duration is a time.Duration written like "90s" or "12h"
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Size is a byte count written like "512", "64K" or "2G"
+type Size int64
+
+func (s Size) MarshalText() ([]byte, error) {
+	n, suffix := int64(s), ""
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		if n == 0 || n%1024 != 0 {
+			break
+		}
+		n /= 1024
+		suffix = unit
+	}
+	return []byte(fmt.Sprintf("%d%s", n, suffix)), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	v, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = Size(v)
+	return nil
+}
@@ -0,0 +1,100 @@
+package fsendserver
+
+import (
+	"log/slog"
+	"time"
+)
+
+// expiresAt returns when a file uploaded now with the sender's requested
+// lifetime in seconds (0 = server default) expires. Zero means never.
+func (s *ServerContext) expiresAt(ttlSeconds uint32) time.Time {
+	ttl := time.Duration(s.config.Expiry.DefaultTTL)
+	if ttlSeconds > 0 {
+		ttl = time.Duration(ttlSeconds) * time.Second
+	}
+	if maxTTL := time.Duration(s.config.Expiry.MaxTTL); maxTTL > 0 && (ttl == 0 || ttl > maxTTL) {
+		ttl = maxTTL
+	}
+
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl).UTC()
+}
+
+// offerExpires returns when a pending file is discarded unless the owner
+// accepts it, the earlier of the offer's and the file's lifetime. Zero means
+// never.
+func (s *ServerContext) offerExpires(f FileInfo) time.Time {
+	ttl := time.Duration(s.config.Expiry.OfferTTL)
+	if ttl == 0 {
+		return f.Expires
+	}
+
+	deadline := f.Created.Add(ttl)
+	if !f.Expires.IsZero() && f.Expires.Before(deadline) {
+		return f.Expires
+	}
+	return deadline
+}
+
+// runJanitor removes expired files, offers nobody accepted and empty UUID
+// directories every interval until Shutdown
+func (s *ServerContext) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.shuttingDown() {
+			return
+		}
+		s.removeExpired(time.Now())
+	}
+}
+
+func (s *ServerContext) removeExpired(now time.Time) {
+	owners, err := s.storage.Owners()
+	if err != nil {
+		slog.Error("janitor failed to list owners", "error", err)
+		return
+	}
+
+	for _, owner := range owners {
+		files, err := s.storage.List(owner)
+		if err != nil {
+			slog.Error("janitor failed to list files", "uuid", owner, "error", err)
+			continue
+		}
+
+		for _, f := range files {
+			reason := "expired"
+			if f.Pending() {
+				reason = "not accepted"
+				f.Expires = s.offerExpires(f)
+			}
+			if !f.Expired(now) {
+				continue
+			}
+
+			err = s.storage.Delete(owner, f.Name)
+			if err != nil {
+				slog.Warn("failed to delete expired file", "uuid", owner, "filename", f.Name, "error", err)
+				continue
+			}
+			s.audit.Record(auditEntry{
+				Event:    auditDelete,
+				UUID:     owner,
+				Filename: f.Name,
+				Hash:     f.Hash,
+				Size:     f.Size,
+				Reason:   reason,
+			})
+			slog.Info("deleted expired file", "uuid", owner, "filename", f.Name, "bytes", f.Size, "reason", reason)
+		}
+
+		err = s.storage.Prune(owner)
+		if err != nil {
+			slog.Warn("failed to prune owner", "uuid", owner, "error", err)
+		}
+	}
+}
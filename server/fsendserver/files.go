@@ -0,0 +1,263 @@
+package fsendserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+const filesDir = "files"
+
+// listFilesForUUID returns all files for a specific UUID that haven't
+// expired, either the accepted ones or the pending offers
+func (s *ServerContext) listFilesForUUID(uuid string, pending bool) ([]FileInfo, error) {
+	infos, err := s.storage.List(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	files := make([]FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if info.Pending() != pending {
+			continue
+		}
+		if pending {
+			info.Expires = s.offerExpires(info)
+		}
+		if !info.Expired(now) {
+			files = append(files, info)
+		}
+	}
+	return files, nil
+}
+
+// handleListFiles sends the list of available files for the client's UUID
+func (s *ServerContext) handleListFiles(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	files, err := s.listFilesForUUID(clientUUID, false)
+	if err != nil {
+		writeStatus(conn, statusError, "failed to list files")
+		return fmt.Errorf("error listing files: %w", err)
+	}
+
+	err = writeStatus(conn, statusOK, "")
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+
+	// Send number of files
+	err = binary.Write(conn, binary.LittleEndian, uint32(len(files)))
+	if err != nil {
+		return fmt.Errorf("error sending file count: %w", err)
+	}
+
+	// Send each filename with its size and expiry time
+	for _, file := range files {
+		nameLen := uint8(len(file.Name))
+		err = binary.Write(conn, binary.LittleEndian, nameLen)
+		if err != nil {
+			return fmt.Errorf("error sending filename length: %w", err)
+		}
+
+		_, err = conn.Write([]byte(file.Name))
+		if err != nil {
+			return fmt.Errorf("error sending filename: %w", err)
+		}
+
+		var expires int64 // Unix seconds, 0 = never
+		if !file.Expires.IsZero() {
+			expires = file.Expires.Unix()
+		}
+
+		err = binary.Write(conn, binary.LittleEndian, []int64{file.Size, expires})
+		if err != nil {
+			return fmt.Errorf("error sending file details: %w", err)
+		}
+	}
+
+	logger.Debug("sent file list", "files", len(files))
+	return nil
+}
+
+// handleStreamFile sends a specific file to the client
+func (s *ServerContext) handleStreamFile(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	start := time.Now()
+
+	// Read filename length
+	var fnameLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &fnameLen)
+	if err != nil {
+		return fmt.Errorf("error reading filename length: %w", err)
+	}
+
+	// Read filename
+	fnameBytes := make([]byte, fnameLen)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %w", err)
+	}
+	fname := string(fnameBytes)
+	logger = logger.With("filename", fname)
+
+	// Open file
+	f, info, err := s.storage.Get(clientUUID, fname, 0, -1)
+	if err == nil && (info.Expired(time.Now()) || info.Pending()) {
+		f.Close()
+		err = os.ErrNotExist // Left for the janitor, or not accepted yet
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Info("file not found")
+			return writeStatus(conn, statusError, "file not found: "+fname)
+		}
+		logger.Error("failed to open file", "error", err)
+		return writeStatus(conn, statusError, "failed to open file")
+	}
+	defer f.Close()
+
+	err = writeStatus(conn, statusOK, "")
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+
+	// Send file size
+	fsize := uint64(info.Size)
+	err = binary.Write(conn, binary.LittleEndian, fsize)
+	if err != nil {
+		return fmt.Errorf("error sending file size: %w", err)
+	}
+
+	// Send file data
+	out := s.transfer(conn)
+	buf := make([]byte, s.config.Buffers.Copy)
+	var written int64
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			_, err = out.Write(buf[:n])
+			if err != nil {
+				return fmt.Errorf("error sending file data: %w", err)
+			}
+			written += int64(n)
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+
+	// Keep the file if the client didn't get all of it, e.g. when the
+	// storage failed partway through. The client can't tell the rest
+	// apart from the next reply, so the connection is closed.
+	if err == nil && written != info.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("download interrupted after %d of %d bytes: %w", written, info.Size, err)
+	}
+
+	// Close file before deleting
+	f.Close()
+
+	s.finishDownload(clientUUID, info, conn.RemoteAddr().String(), logger)
+	logger.Info("file downloaded", "bytes", fsize, "duration", time.Since(start))
+
+	return nil
+}
+
+// finishDownload records a completed download and deletes the file, which is
+// only meant to be fetched once
+func (s *ServerContext) finishDownload(owner string, info FileInfo, remoteAddr string, logger *slog.Logger) {
+	s.audit.Record(auditEntry{
+		Event:      auditDownload,
+		UUID:       owner,
+		Filename:   info.Name,
+		Hash:       info.Hash,
+		Size:       info.Size,
+		RemoteAddr: remoteAddr,
+	})
+
+	err := s.storage.Delete(owner, info.Name)
+	if err != nil {
+		logger.Warn("failed to delete downloaded file", "error", err)
+		return
+	}
+	s.audit.Record(auditEntry{
+		Event:    auditDelete,
+		UUID:     owner,
+		Filename: info.Name,
+		Hash:     info.Hash,
+		Size:     info.Size,
+		Reason:   "downloaded",
+	})
+}
+
+// handleDeleteFile deletes one of the client's files before it is downloaded
+// or expires
+func (s *ServerContext) handleDeleteFile(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	var fnameLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &fnameLen)
+	if err != nil {
+		return fmt.Errorf("failed to read filename length: %w", err)
+	}
+	fnameBytes := make([]byte, fnameLen)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read filename: %w", err)
+	}
+	fname := string(fnameBytes)
+	logger = logger.With("filename", fname)
+
+	info, err := s.storage.Stat(clientUUID, fname)
+	if err == nil && (info.Expired(time.Now()) || info.Pending()) {
+		err = os.ErrNotExist // Left for the janitor, or answered with answerOffer
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return writeStatus(conn, statusError, "file not found: "+fname)
+		}
+		logger.Error("failed to look up file", "error", err)
+		return writeStatus(conn, statusError, "failed to look up file")
+	}
+
+	err = s.storage.Delete(clientUUID, fname)
+	if err != nil {
+		logger.Error("failed to delete file", "error", err)
+		return writeStatus(conn, statusError, "failed to delete file")
+	}
+	s.audit.Record(auditEntry{
+		Event:      auditDelete,
+		UUID:       clientUUID,
+		Filename:   fname,
+		Hash:       info.Hash,
+		Size:       info.Size,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Reason:     "deleted",
+	})
+	logger.Info("file deleted")
+	return writeStatus(conn, statusOK, "")
+}
+
+// handleQuotaInfo sends the client's storage usage, its quota (0 = unlimited)
+// and the bytes it can still upload (-1 = unlimited)
+func (s *ServerContext) handleQuotaInfo(conn net.Conn, clientUUID string) error {
+	used, limit, available := s.quotas.Usage(clientUUID)
+
+	err := writeStatus(conn, statusOK, "")
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, []int64{used, limit, available})
+	if err != nil {
+		return fmt.Errorf("error sending quota: %w", err)
+	}
+	return nil
+}
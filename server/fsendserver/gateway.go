@@ -0,0 +1,317 @@
+package fsendserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// newGateway returns the HTTP server that serves download and upload links
+// and the WebSocket transport
+func (s *ServerContext) newGateway() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /d/{token}/{name}", s.handleLinkDownload)
+	mux.HandleFunc("GET /u/{token}", s.handleUploadPage)
+	mux.HandleFunc("POST /u/{token}", s.handleLinkUpload)
+	mux.HandleFunc("PUT /u/{token}", s.handleLinkUpload) // curl -T
+	mux.HandleFunc("GET /ws", s.handleWebSocket)
+
+	return &http.Server{
+		Addr:              s.config.HTTP.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(s.config.Timeouts.Header),
+		IdleTimeout:       time.Duration(s.config.Timeouts.Idle),
+	}
+}
+
+// serveGateway serves links until the gateway is shut down, over TLS when the
+// TCP listener uses it
+func (s *ServerContext) serveGateway(gateway *http.Server) error {
+	var err error
+	if s.config.TLS.Cert != "" {
+		err = gateway.ListenAndServeTLS(s.config.TLS.Cert, s.config.TLS.Key)
+	} else {
+		err = gateway.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// handleLinkDownload sends the file a link points at. Like handleStreamFile
+// it deletes the file once it was sent completely, so a link works once.
+func (s *ServerContext) handleLinkDownload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	logger := slog.With("remote_addr", r.RemoteAddr)
+
+	l, ok := s.openLink(w, r, linkDownload, logger)
+	if !ok {
+		return
+	}
+	logger = logger.With("uuid", l.UUID, "filename", l.Filename)
+
+	f, info, err := s.storage.Get(l.UUID, l.Filename, 0, -1)
+	if err == nil && (info.Expired(time.Now()) || info.Pending() || len(info.Hash) >= linkHashLen && info.Hash[:linkHashLen] != l.Hash) {
+		f.Close()
+		err = os.ErrNotExist // Expired or replaced since the link was made
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Info("download link to missing file")
+			http.Error(w, "This file is no longer available, it was already downloaded or has expired.", http.StatusGone)
+			return
+		}
+		logger.Error("failed to open file", "error", err)
+		http.Error(w, "Failed to open file.", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Always a download, never rendered on the gateway's origin
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": l.Filename}))
+	h.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// Same progress timeout as transfers on the TCP listener
+	rc := http.NewResponseController(w)
+	buf := make([]byte, s.config.Buffers.Copy)
+	var sent int64
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			rc.SetWriteDeadline(after(s.config.Timeouts.Progress))
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				break
+			}
+			sent += int64(n)
+			s.metrics.bytesOut.Add(int64(n))
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+	if err != nil || sent != info.Size {
+		logger.Warn("link download interrupted", "bytes", sent, "error", err)
+		return
+	}
+
+	f.Close()
+	s.finishDownload(l.UUID, info, r.RemoteAddr, logger)
+	logger.Info("file downloaded via link", "bytes", sent, "duration", time.Since(start))
+}
+
+// openLink returns the valid, unexpired link of kind in the request path. If
+// there is none it answers the request and returns false.
+func (s *ServerContext) openLink(w http.ResponseWriter, r *http.Request, kind string, logger *slog.Logger) (link, bool) {
+	noun := "download"
+	if kind == linkUpload {
+		noun = "upload"
+	}
+
+	l, err := s.links.open(r.PathValue("token"))
+	if err == nil && l.Kind != kind {
+		err = errors.New("link is of another kind")
+	}
+	if err != nil {
+		logger.Info("invalid "+noun+" link", "error", err)
+		http.Error(w, "This "+noun+" link is invalid.", http.StatusNotFound)
+		return l, false
+	}
+
+	if time.Now().Unix() >= l.Expires {
+		logger.Info("expired "+noun+" link", "uuid", l.UUID)
+		http.Error(w, "This "+noun+" link has expired.", http.StatusGone)
+		return l, false
+	}
+	return l, true
+}
+
+var uploadPage = template.Must(template.New("upload").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Send a file with fsend</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 3em auto; padding: 0 1em; color: #222; }
+h1 { color: #3f51b5; font-size: 1.4em; }
+progress { width: 100%; }
+.note { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Send a file with fsend</h1>
+<p>Someone asked you for a file. Pick it and press Send; it goes straight to them. This link works for one file, until {{.Expires}}.</p>
+<form id="form">
+<p><input type="file" id="file" required></p>
+<p><button type="submit" id="send">Send</button></p>
+<progress id="progress" value="0" max="1" hidden></progress>
+<p id="status"></p>
+</form>
+<noscript><p>Please enable JavaScript to upload, or run: curl -T yourfile "this link?name=yourfile"</p></noscript>
+<p class="note">Files are stored until the recipient downloads them or they expire.</p>
+<script>
+const form = document.getElementById("form");
+form.addEventListener("submit", e => {
+  e.preventDefault();
+  const file = document.getElementById("file").files[0];
+  const progress = document.getElementById("progress");
+  const status = document.getElementById("status");
+  const xhr = new XMLHttpRequest();
+  xhr.open("POST", location.pathname + "?name=" + encodeURIComponent(file.name));
+  xhr.upload.onprogress = e => { progress.max = e.total; progress.value = e.loaded; };
+  xhr.onload = () => {
+    status.textContent = xhr.responseText;
+    if (xhr.status === 201) {
+      form.querySelectorAll("input, button").forEach(el => el.disabled = true);
+    }
+  };
+  xhr.onerror = () => { status.textContent = "Upload failed, please try again."; };
+  document.getElementById("send").disabled = true;
+  progress.hidden = false;
+  status.textContent = "Uploading " + file.name + "...";
+  xhr.send(file);
+});
+</script>
+</body>
+</html>
+`))
+
+// handleUploadPage serves the form behind an upload link
+func (s *ServerContext) handleUploadPage(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With("remote_addr", r.RemoteAddr)
+
+	l, ok := s.openLink(w, r, linkUpload, logger)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	uploadPage.Execute(w, struct{ Expires string }{time.Unix(l.Expires, 0).UTC().Format("2006-01-02 15:04 UTC")})
+}
+
+// handleLinkUpload receives the file for an upload link, with its name in the
+// "name" query parameter and its content as the body. It is stored for the
+// link's owner like a file sent with handleSendToUUID, and refused the same
+// way if the owner has a file of that name.
+func (s *ServerContext) handleLinkUpload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	logger := slog.With("remote_addr", r.RemoteAddr)
+
+	l, ok := s.openLink(w, r, linkUpload, logger)
+	if !ok {
+		return
+	}
+
+	fname := r.URL.Query().Get("name")
+	fsize := r.ContentLength
+	logger = logger.With("to", l.UUID, "filename", fname, "bytes", fsize)
+
+	if len(fname) > 255 || !validName(fname) {
+		http.Error(w, "Invalid filename.", http.StatusBadRequest)
+		return
+	}
+	if fsize < 0 {
+		http.Error(w, "The upload needs a Content-Length.", http.StatusLengthRequired)
+		return
+	}
+
+	// The link acts for the owner who asked for the file, whose sender policy
+	// always lets the owner through, but it mustn't replace a file of the
+	// owner
+	err := s.admitSend(l.UUID, l.UUID, fname)
+	if err != nil {
+		logger.Info("link upload refused", "error", err)
+		http.Error(w, "The recipient already has a file with this name, please rename yours.", http.StatusConflict)
+		return
+	}
+
+	if !s.uploads.claim(l) {
+		logger.Info("upload link used again")
+		http.Error(w, "This upload link was already used.", http.StatusGone)
+		return
+	}
+
+	// The recipient's quota applies
+	release, err := s.quotas.Reserve(l.UUID, fname, fsize)
+	if err != nil {
+		s.uploads.unclaim(l)
+		logger.Warn("link upload refused", "error", err)
+		if errors.Is(err, errQuotaExceeded) {
+			// The error tells the recipient's usage, which is none of the sender's business
+			http.Error(w, "The recipient has no room for this file.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "The recipient can't accept this file right now.", http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	// Unlike a file sent with handleSendToUUID this isn't an offer waiting for
+	// the owner's answer: the owner asked for it by creating the link, which
+	// can only bring in one file
+	meta := FileInfo{
+		Name:    fname,
+		Size:    fsize,
+		Expires: s.expiresAt(0),
+	}
+
+	body := progressBody{r.Body, http.NewResponseController(w), s.config.Timeouts.Progress, s.metrics}
+	info, err := s.storage.Put(l.UUID, meta, bufio.NewReaderSize(body, int(s.config.Buffers.Copy)))
+	if err != nil {
+		s.uploads.unclaim(l)
+		logger.Warn("link upload failed", "error", err)
+		http.Error(w, "Upload failed, please try again.", http.StatusBadRequest)
+		return
+	}
+
+	s.audit.Record(auditEntry{
+		Event:      auditSend,
+		Recipient:  l.UUID,
+		Filename:   fname,
+		Hash:       info.Hash,
+		Size:       info.Size,
+		RemoteAddr: r.RemoteAddr,
+	})
+	logger.Info("file received via upload link", "duration", time.Since(start))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Thanks, %s was sent.\n", fname)
+}
+
+// progressBody pushes the read deadline of a request body forward before
+// every read, like progressConn
+type progressBody struct {
+	body    io.Reader
+	rc      *http.ResponseController
+	timeout Duration
+	metrics *metrics
+}
+
+func (b progressBody) Read(p []byte) (int, error) {
+	b.rc.SetReadDeadline(after(b.timeout))
+	n, err := b.body.Read(p)
+	b.metrics.bytesIn.Add(int64(n))
+	return n, err
+}
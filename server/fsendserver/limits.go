@@ -0,0 +1,190 @@
+package fsendserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// limiter caps how many connections the server, every IP and every UUID may
+// have, and hands out the rate limits of each IP. A limit of 0 means
+// unlimited.
+type limiter struct {
+	config LimitsConfig
+
+	mu    sync.Mutex
+	conns int                  // All open connections
+	ips   map[string]*ipLimits // IP -> its connections and rate limits
+	uuids map[string]int       // UUID -> connections registered with it
+}
+
+// ipLimits are shared by all connections from one IP
+type ipLimits struct {
+	conns    int
+	requests *tokenBucket // Requests per second
+	upload   *tokenBucket // Uploaded bytes per second
+}
+
+func newLimiter(config LimitsConfig) *limiter {
+	return &limiter{
+		config: config,
+		ips:    make(map[string]*ipLimits),
+		uuids:  make(map[string]int),
+	}
+}
+
+// connect admits a new connection from ip. Call disconnect once it closes.
+func (l *limiter) connect(ip string) (*ipLimits, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.MaxConnections > 0 && l.conns >= l.config.MaxConnections {
+		return nil, fmt.Errorf("server is busy, too many connections")
+	}
+
+	limits := l.ips[ip]
+	if limits == nil {
+		l.sweep()
+		limits = &ipLimits{
+			requests: newTokenBucket(l.config.RequestsPerSecond, float64(l.config.RequestBurst)),
+			upload:   newTokenBucket(float64(l.config.UploadRate), float64(l.config.UploadRate)),
+		}
+		l.ips[ip] = limits
+	}
+	if l.config.PerIP > 0 && limits.conns >= l.config.PerIP {
+		return nil, fmt.Errorf("too many connections from your address")
+	}
+
+	limits.conns++
+	l.conns++
+	return limits, nil
+}
+
+func (l *limiter) disconnect(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ips[ip].conns--
+	l.conns--
+}
+
+// sweep forgets IPs without connections whose buckets have refilled, so
+// reconnecting doesn't reset a drained bucket
+func (l *limiter) sweep() {
+	now := time.Now()
+	for ip, limits := range l.ips {
+		if limits.conns == 0 && limits.requests.full(now) && limits.upload.full(now) {
+			delete(l.ips, ip)
+		}
+	}
+}
+
+// register admits another connection for uuid. Call unregister once the
+// connection closes or registers again.
+func (l *limiter) register(uuid string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config.PerUUID > 0 && l.uuids[uuid] >= l.config.PerUUID {
+		return fmt.Errorf("too many connections for this UUID")
+	}
+	l.uuids[uuid]++
+	return nil
+}
+
+func (l *limiter) unregister(uuid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.uuids[uuid]--
+	if l.uuids[uuid] <= 0 {
+		delete(l.uuids, uuid)
+	}
+}
+
+// remoteIP returns the IP a connection comes from
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// tokenBucket allows rate events per second with bursts of up to burst. A
+// nil bucket allows everything.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is 0
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last call, b.mu must be held
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// Allow takes a token if one is available
+func (b *tokenBucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait takes n tokens, sleeping until the bucket has earned them
+func (b *tokenBucket) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
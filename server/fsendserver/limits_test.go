@@ -0,0 +1,61 @@
+package fsendserver
+
+import "testing"
+
+// TestLimiterConnect follows connections coming and going against the
+// per-IP and server-wide caps
+func TestLimiterConnect(t *testing.T) {
+	l := newLimiter(LimitsConfig{MaxConnections: 4, PerIP: 2})
+
+	steps := []struct {
+		ip         string
+		disconnect bool
+		ok         bool
+	}{
+		{"10.0.0.1", false, true},
+		{"10.0.0.1", false, true},
+		{"10.0.0.1", false, false}, // Per-IP cap
+		{"10.0.0.2", false, true},  // Other IPs have their own
+		{"10.0.0.1", true, true},
+		{"10.0.0.1", false, true}, // Room again after a disconnect
+		{"10.0.0.3", false, true},
+		{"10.0.0.4", false, false}, // Server full
+	}
+	for i, step := range steps {
+		if step.disconnect {
+			l.disconnect(step.ip)
+			continue
+		}
+		_, err := l.connect(step.ip)
+		if step.ok != (err == nil) {
+			t.Fatalf("step %d: connect(%s) = %v, want ok %v", i, step.ip, err, step.ok)
+		}
+	}
+
+	if l.conns != 4 || l.ips["10.0.0.1"].conns != 2 {
+		t.Errorf("%d connections, %d from 10.0.0.1, want 4 and 2", l.conns, l.ips["10.0.0.1"].conns)
+	}
+}
+
+// TestLimiterRegister checks the cap on connections per UUID
+func TestLimiterRegister(t *testing.T) {
+	l := newLimiter(LimitsConfig{PerUUID: 1})
+
+	if err := l.register("alice"); err != nil {
+		t.Fatalf("first register: %v", err)
+	}
+	if err := l.register("alice"); err == nil {
+		t.Error("second register for alice succeeded, want the cap")
+	}
+	if err := l.register("bob"); err != nil {
+		t.Errorf("register for bob: %v", err)
+	}
+
+	l.unregister("alice")
+	if _, ok := l.uuids["alice"]; ok {
+		t.Error("alice still counted after unregister")
+	}
+	if err := l.register("alice"); err != nil {
+		t.Errorf("register after unregister: %v", err)
+	}
+}
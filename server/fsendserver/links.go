@@ -0,0 +1,272 @@
+package fsendserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// link is what a download or upload URL points at. It travels sealed inside
+// the URL, so the server keeps no state for download links.
+type link struct {
+	Kind     string `json:"k,omitempty"` // linkDownload or linkUpload
+	UUID     string `json:"u"`
+	Filename string `json:"f,omitempty"`
+	Hash     string `json:"h,omitempty"` // Prefix of the file's SHA-256, so a new upload under the same name doesn't match
+	ID       string `json:"i,omitempty"` // Random, to remember used upload links
+	Expires  int64  `json:"e"`           // Unix seconds
+}
+
+// Link kinds
+const (
+	linkDownload = ""
+	linkUpload   = "u"
+)
+
+// linkHashLen is how many hex digits of the file hash a link carries
+const linkHashLen = 16
+
+// linkSealer encrypts and authenticates links with AES-GCM, so they can't be
+// forged or altered and don't reveal the owner's UUID
+type linkSealer struct {
+	aead cipher.AEAD
+}
+
+// newLinkSealer derives the key from secret, or picks a random key if secret
+// is empty. Links then stop working when the server restarts.
+func newLinkSealer(secret string) (*linkSealer, error) {
+	key := make([]byte, sha256.Size)
+	if secret == "" {
+		rand.Read(key)
+	} else {
+		sum := sha256.Sum256([]byte(secret))
+		copy(key, sum[:])
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &linkSealer{aead: aead}, nil
+}
+
+// seal returns the URL-safe token for l
+func (ls *linkSealer) seal(l link) string {
+	payload, _ := json.Marshal(l)
+	nonce := make([]byte, ls.aead.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(ls.aead.Seal(nonce, nonce, payload, nil))
+}
+
+// open returns the link sealed in token
+func (ls *linkSealer) open(token string) (link, error) {
+	var l link
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < ls.aead.NonceSize() {
+		return l, errors.New("malformed link")
+	}
+	nonce, sealed := data[:ls.aead.NonceSize()], data[ls.aead.NonceSize():]
+	payload, err := ls.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return l, errors.New("link was not issued by this server")
+	}
+
+	err = json.Unmarshal(payload, &l)
+	if err != nil {
+		return l, fmt.Errorf("malformed link: %w", err)
+	}
+	return l, nil
+}
+
+// usedLinks remembers upload links that were used until they expire, so
+// each works once. It is kept in memory only.
+type usedLinks struct {
+	mu  sync.Mutex
+	ids map[string]int64 // Link ID -> expiry in Unix seconds
+}
+
+func newUsedLinks() *usedLinks {
+	return &usedLinks{ids: make(map[string]int64)}
+}
+
+// claim marks l used and reports whether it was unused
+func (u *usedLinks) claim(l link) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now().Unix()
+	for id, expires := range u.ids {
+		if expires <= now {
+			delete(u.ids, id) // Expired links are refused anyway
+		}
+	}
+
+	if _, used := u.ids[l.ID]; used {
+		return false
+	}
+	u.ids[l.ID] = l.Expires
+	return true
+}
+
+// unclaim makes l usable again after a failed upload
+func (u *usedLinks) unclaim(l link) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.ids, l.ID)
+}
+
+// linkExpiry returns when a link made now expires if the client asked for
+// ttl seconds (0 = the configured lifetime, which is also the maximum)
+func (s *ServerContext) linkExpiry(ttl uint32) time.Time {
+	lifetime := time.Duration(s.config.HTTP.LinkTTL)
+	if ttl > 0 && time.Duration(ttl)*time.Second < lifetime {
+		lifetime = time.Duration(ttl) * time.Second
+	}
+	return time.Now().Add(lifetime)
+}
+
+// linkBase returns the URL links start with. Unless configured it is the
+// address the client reached this server on, with the gateway's port.
+func (s *ServerContext) linkBase(conn net.Conn) string {
+	if s.config.HTTP.URL != "" {
+		return strings.TrimSuffix(s.config.HTTP.URL, "/")
+	}
+
+	scheme := "http"
+	if s.config.TLS.Cert != "" {
+		scheme = "https"
+	}
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	_, port, _ := net.SplitHostPort(s.config.HTTP.Listen)
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// handleShareLink creates a download link for one of the client's files that
+// works in any browser until it expires or the file is downloaded
+func (s *ServerContext) handleShareLink(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	// Read filename
+	var fnameLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &fnameLen)
+	if err != nil {
+		return fmt.Errorf("error reading filename length: %w", err)
+	}
+
+	fnameBytes := make([]byte, fnameLen)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("error reading filename: %w", err)
+	}
+	fname := string(fnameBytes)
+	logger = logger.With("filename", fname)
+
+	// Read requested lifetime
+	var ttl uint32
+	err = binary.Read(conn, binary.LittleEndian, &ttl)
+	if err != nil {
+		return fmt.Errorf("error reading TTL: %w", err)
+	}
+
+	if s.links == nil {
+		return writeStatus(conn, statusError, "download links are not enabled on this server")
+	}
+
+	info, err := s.storage.Stat(clientUUID, fname)
+	if err == nil && (info.Expired(time.Now()) || info.Pending()) {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return writeStatus(conn, statusError, "file not found: "+fname)
+		}
+		logger.Error("failed to look up file", "error", err)
+		return writeStatus(conn, statusError, "failed to look up file")
+	}
+
+	// The link never outlives the file
+	expires := s.linkExpiry(ttl)
+	if !info.Expires.IsZero() && info.Expires.Before(expires) {
+		expires = info.Expires
+	}
+
+	l := link{Kind: linkDownload, UUID: clientUUID, Filename: fname, Expires: expires.Unix()}
+	if len(info.Hash) >= linkHashLen {
+		l.Hash = info.Hash[:linkHashLen]
+	}
+	u := s.linkBase(conn) + "/d/" + s.links.seal(l) + "/" + url.PathEscape(fname)
+
+	err = writeLink(conn, u, expires)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("download link created", "expires", expires)
+	return nil
+}
+
+// handleRequestLink creates a link to a page where anyone can upload one
+// file into the client's storage, as if it was sent with sendToUUID
+func (s *ServerContext) handleRequestLink(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	// Read requested lifetime
+	var ttl uint32
+	err := binary.Read(conn, binary.LittleEndian, &ttl)
+	if err != nil {
+		return fmt.Errorf("error reading TTL: %w", err)
+	}
+
+	if s.links == nil {
+		return writeStatus(conn, statusError, "upload links are not enabled on this server")
+	}
+
+	expires := s.linkExpiry(ttl)
+	l := link{Kind: linkUpload, UUID: clientUUID, ID: rand.Text(), Expires: expires.Unix()}
+	u := s.linkBase(conn) + "/u/" + s.links.seal(l)
+
+	err = writeLink(conn, u, expires)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("upload link created", "expires", expires)
+	return nil
+}
+
+// writeLink sends a created link: [status][expires:int64][urlLen:uint16][url]
+func writeLink(conn net.Conn, u string, expires time.Time) error {
+	err := writeStatus(conn, statusOK, "")
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, expires.Unix())
+	if err != nil {
+		return fmt.Errorf("error sending link expiry: %w", err)
+	}
+	err = binary.Write(conn, binary.LittleEndian, uint16(len(u)))
+	if err != nil {
+		return fmt.Errorf("error sending link length: %w", err)
+	}
+	_, err = conn.Write([]byte(u))
+	if err != nil {
+		return fmt.Errorf("error sending link: %w", err)
+	}
+	return nil
+}
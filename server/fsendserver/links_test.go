@@ -0,0 +1,194 @@
+package fsendserver
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLinkSecret = "s3cr3ts3cr3ts3cr3t"
+
+func newTestSealer(t *testing.T, secret string) *linkSealer {
+	t.Helper()
+	ls, err := newLinkSealer(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func TestLinkSealer(t *testing.T) {
+	ls := newTestSealer(t, testLinkSecret)
+	l := link{UUID: "alice", Filename: "report.pdf", Hash: "0123456789abcdef", Expires: 1700000000}
+	token := ls.seal(l)
+
+	if strings.Contains(token, "alice") || strings.Contains(token, "report") {
+		t.Errorf("token %s shows what it links to", token)
+	}
+	if ls.seal(l) == token {
+		t.Error("sealing the same link twice gave the same token")
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(token)
+	flipped := append([]byte(nil), raw...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		sealer *linkSealer
+		token  string
+		err    string // Part of the error, empty if the link opens
+	}{
+		{"valid", ls, token, ""},
+		{"same secret after a restart", newTestSealer(t, testLinkSecret), token, ""},
+		{"other secret", newTestSealer(t, "another secret!!"), token, "not issued by this server"},
+		{"random key", newTestSealer(t, ""), token, "not issued by this server"},
+		{"altered", ls, base64.RawURLEncoding.EncodeToString(flipped), "not issued by this server"},
+		{"cut short", ls, token[:10], "malformed"},
+		{"not base64", ls, "not*base64", "malformed"},
+		{"empty", ls, "", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.sealer.open(tt.token)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("open = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != l {
+				t.Errorf("open = %+v, want %+v", got, l)
+			}
+		})
+	}
+}
+
+// TestOpenLink checks the checks every gateway request makes: the link must
+// open, be of the right kind and not have expired
+func TestOpenLink(t *testing.T) {
+	s := &ServerContext{links: newTestSealer(t, testLinkSecret)}
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		link   link
+		token  string // Instead of the sealed link if set
+		kind   string
+		status int // 0 if the link is accepted
+	}{
+		{"download", link{UUID: "alice", Filename: "a.txt", Expires: future}, "", linkDownload, 0},
+		{"upload", link{Kind: linkUpload, UUID: "alice", ID: "1", Expires: future}, "", linkUpload, 0},
+		{"expired", link{UUID: "alice", Filename: "a.txt", Expires: time.Now().Add(-time.Second).Unix()}, "", linkDownload, http.StatusGone},
+		{"expires now", link{UUID: "alice", Filename: "a.txt", Expires: time.Now().Unix()}, "", linkDownload, http.StatusGone},
+		{"upload link to download", link{Kind: linkUpload, UUID: "alice", ID: "1", Expires: future}, "", linkDownload, http.StatusNotFound},
+		{"download link to upload", link{UUID: "alice", Filename: "a.txt", Expires: future}, "", linkUpload, http.StatusNotFound},
+		{"forged", link{}, "Zm9yZ2VkIGxpbmsgdG9rZW4gdGhhdCBpcyBsb25n", linkDownload, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token = s.links.seal(tt.link)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/d/"+token, nil)
+			r.SetPathValue("token", token)
+			w := httptest.NewRecorder()
+
+			got, ok := s.openLink(w, r, tt.kind, slog.Default())
+			if ok != (tt.status == 0) {
+				t.Fatalf("openLink ok = %v, want %v", ok, tt.status == 0)
+			}
+			if ok && got != tt.link {
+				t.Errorf("openLink = %+v, want %+v", got, tt.link)
+			}
+			if !ok && w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+// TestLinkDownload checks what the gateway makes of a link before sending
+// the file: it must open, not have expired and still match the file
+func TestLinkDownload(t *testing.T) {
+	storage := newMemStorage()
+	info := mustPut(t, storage, "alice", FileInfo{Name: "a.txt", Size: 5}, "hello")
+	s := &ServerContext{links: newTestSealer(t, testLinkSecret), storage: storage}
+	future := time.Now().Add(time.Hour).Unix()
+	hash := info.Hash[:linkHashLen]
+
+	tests := []struct {
+		name   string
+		link   link
+		token  string // Instead of the sealed link if set
+		status int
+	}{
+		{"valid", link{UUID: "alice", Filename: "a.txt", Hash: hash, Expires: future}, "", http.StatusOK},
+		{"expired", link{UUID: "alice", Filename: "a.txt", Hash: hash, Expires: time.Now().Add(-time.Second).Unix()}, "", http.StatusGone},
+		{"expires now", link{UUID: "alice", Filename: "a.txt", Hash: hash, Expires: time.Now().Unix()}, "", http.StatusGone},
+		{"file replaced", link{UUID: "alice", Filename: "a.txt", Hash: sha256Hex("old")[:linkHashLen], Expires: future}, "", http.StatusGone},
+		{"file gone", link{UUID: "alice", Filename: "b.txt", Hash: hash, Expires: future}, "", http.StatusGone},
+		{"forged", link{}, "Zm9yZ2VkIGxpbmsgdG9rZW4gdGhhdCBpcyBsb25n", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token = s.links.seal(tt.link)
+			}
+			// HEAD checks the link without sending or deleting the file
+			r := httptest.NewRequest(http.MethodHead, "/d/"+token, nil)
+			r.SetPathValue("token", token)
+			w := httptest.NewRecorder()
+
+			s.handleLinkDownload(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestUsedLinks(t *testing.T) {
+	u := newUsedLinks()
+	future := time.Now().Add(time.Hour).Unix()
+	a := link{Kind: linkUpload, ID: "a", Expires: future}
+	b := link{Kind: linkUpload, ID: "b", Expires: future}
+
+	steps := []struct {
+		op   string // claim or unclaim
+		link link
+		ok   bool
+	}{
+		{"claim", a, true},
+		{"claim", a, false},
+		{"claim", b, true},
+		{"unclaim", a, true}, // After a failed upload
+		{"claim", a, true},
+		{"claim", b, false},
+	}
+	for i, step := range steps {
+		if step.op == "unclaim" {
+			u.unclaim(step.link)
+			continue
+		}
+		if got := u.claim(step.link); got != step.ok {
+			t.Errorf("step %d: claim(%s) = %v, want %v", i, step.link.ID, got, step.ok)
+		}
+	}
+
+	// Expired links are forgotten on the next claim
+	u.ids["old"] = time.Now().Add(-time.Minute).Unix()
+	u.claim(link{ID: "c", Expires: future})
+	if _, ok := u.ids["old"]; ok {
+		t.Error("an expired link is still remembered")
+	}
+}
@@ -0,0 +1,39 @@
+package fsendserver
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// newLogger builds the server's logger from the config
+func newLogger(config LogConfig, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: config.Level}
+	if config.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// connLogger returns the logger for a new connection from addr, tagged with
+// an ID that is unique while the server runs
+func (s *ServerContext) connLogger(addr net.Addr) *slog.Logger {
+	return slog.With("conn", s.connIDs.Add(1), "remote_addr", addr.String())
+}
+
+// requestLogger returns the logger for a request on a connection
+func (s *ServerContext) requestLogger(connLog *slog.Logger, opcode uint8, uuid string) *slog.Logger {
+	logger := connLog.With("req", s.requestIDs.Add(1), "opcode", opcodeName(opcode))
+	if uuid != "" {
+		logger = logger.With("uuid", uuid)
+	}
+	return logger
+}
+
+func opcodeName(opcode uint8) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", opcode)
+}
@@ -0,0 +1,258 @@
+package fsendserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Just enough mDNS (RFC 6762) and DNS-SD (RFC 6763) to announce the server
+// on the local network, clients find it with the same service name. Clients
+// announce themselves with Announce too.
+
+const (
+	MDNSGroup     = "224.0.0.251:5353"
+	mdnsPort      = 5353
+	ServerService = "_fsend._tcp.local."
+	mdnsTTL       = 120                       // Seconds answers may be cached
+	cacheFlush    = dnsmessage.Class(1 << 15) // Marks records only this host answers
+	classUnique   = dnsmessage.ClassINET | cacheFlush
+)
+
+// mdnsService is a DNS-SD service instance answered by announce
+type mdnsService struct {
+	service  string // Service type, e.g. ServerService
+	instance string // Full instance name ending in service
+	host     string // Target of the SRV record, e.g. "desk.local."
+	port     uint16
+	txt      []string // key=value pairs
+}
+
+// AnnounceServer advertises the server as config.MDNS.Name, or after the
+// host if empty
+func AnnounceServer(config *Config) (*net.UDPConn, error) {
+	name := config.MDNS.Name
+	if name == "" {
+		name = "fsend on " + HostLabel()
+	}
+
+	_, portStr, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port %q", portStr)
+	}
+
+	txt := []string{"proto=tcp"}
+	if config.TLS.Cert != "" {
+		txt[0] = "proto=tls"
+	}
+	if config.QUIC.Listen != "" {
+		_, quicPort, err := net.SplitHostPort(config.QUIC.Listen)
+		if err == nil {
+			txt = append(txt, "quic="+quicPort)
+		}
+	}
+
+	return Announce(ServerService, name, uint16(port), txt)
+}
+
+// Announce advertises instance of service, e.g. "fsend on desk" of
+// ServerService, on this host's port with the key=value pairs of txt, until
+// the returned connection is closed
+func Announce(service, instance string, port uint16, txt []string) (*net.UDPConn, error) {
+	return announce(mdnsService{
+		service:  service,
+		instance: instanceLabel(instance) + "." + service,
+		host:     HostLabel() + ".local.",
+		port:     port,
+		txt:      txt,
+	})
+}
+
+// announce answers queries for svc until the returned connection is closed
+func announce(svc mdnsService) (*net.UDPConn, error) {
+	group, err := net.ResolveUDPAddr("udp4", MDNSGroup)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tell listening browsers right away
+	msg, err := svc.response(0, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.WriteToUDP(msg, group)
+
+	go svc.serve(conn, group)
+	return conn, nil
+}
+
+// serve answers the queries arriving on conn. Queries from port 5353 get a
+// multicast answer, others are one-shot queries answered by unicast.
+func (svc *mdnsService) serve(conn *net.UDPConn, group *net.UDPAddr) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed
+		}
+
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil || !svc.asked(questions) {
+			continue
+		}
+
+		to := group
+		var id uint16
+		if src.Port != mdnsPort {
+			to, id = src, h.ID
+		} else {
+			questions = nil
+		}
+		msg, err := svc.response(id, questions)
+		if err != nil {
+			slog.Debug("failed to build mDNS answer", "error", err)
+			continue
+		}
+		conn.WriteToUDP(msg, to)
+	}
+}
+
+// asked reports whether one of the questions is about svc
+func (svc *mdnsService) asked(questions []dnsmessage.Question) bool {
+	for _, q := range questions {
+		name := q.Name.String()
+		switch q.Type {
+		case dnsmessage.TypePTR:
+			if strings.EqualFold(name, svc.service) {
+				return true
+			}
+		case dnsmessage.TypeSRV, dnsmessage.TypeTXT:
+			if strings.EqualFold(name, svc.instance) {
+				return true
+			}
+		case dnsmessage.TypeALL:
+			if strings.EqualFold(name, svc.service) || strings.EqualFold(name, svc.instance) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// response builds the answer to a query, with the records a browser needs
+// in one message. id and questions are echoed for one-shot queries.
+func (svc *mdnsService) response(id uint16, questions []dnsmessage.Question) ([]byte, error) {
+	service, err := dnsmessage.NewName(svc.service)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(svc.instance)
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(svc.host)
+	if err != nil {
+		return nil, err
+	}
+
+	// One-shot queriers aren't mDNS caches, so no cache flush bit for them
+	unique := classUnique
+	if id != 0 {
+		unique = dnsmessage.ClassINET
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	err = b.StartQuestions()
+	for _, q := range questions {
+		if err == nil {
+			err = b.Question(q)
+		}
+	}
+	if err == nil {
+		err = b.StartAnswers()
+	}
+	if err == nil {
+		err = b.PTRResource(dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+			dnsmessage.PTRResource{PTR: instance})
+	}
+	if err == nil {
+		err = b.StartAdditionals()
+	}
+	if err == nil {
+		err = b.SRVResource(dnsmessage.ResourceHeader{Name: instance, Class: unique, TTL: mdnsTTL},
+			dnsmessage.SRVResource{Port: svc.port, Target: host})
+	}
+	if err == nil {
+		err = b.TXTResource(dnsmessage.ResourceHeader{Name: instance, Class: unique, TTL: mdnsTTL},
+			dnsmessage.TXTResource{TXT: svc.txt})
+	}
+	for _, ip := range LocalIPv4s() {
+		if err == nil {
+			err = b.AResource(dnsmessage.ResourceHeader{Name: host, Class: unique, TTL: mdnsTTL},
+				dnsmessage.AResource{A: ip})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// LocalIPv4s returns the IPv4 addresses of the host's interfaces,
+// except loopback
+func LocalIPv4s() [][4]byte {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips [][4]byte
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			ips = append(ips, [4]byte(ip4))
+		}
+	}
+	return ips
+}
+
+// HostLabel returns the host name without its domain, fit for .local
+func HostLabel() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "fsend"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	return instanceLabel(host)
+}
+
+// instanceLabel makes s a single DNS label: no dots, at most 63 bytes
+func instanceLabel(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
@@ -0,0 +1,147 @@
+package fsendserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memFile struct {
+	info FileInfo
+	data []byte
+}
+
+// memStorage keeps all files in memory. Everything is lost on restart, which
+// makes it useful for local testing and throwaway servers.
+type memStorage struct {
+	mu    sync.RWMutex
+	files map[string]map[string]*memFile // owner -> name -> file
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		files: make(map[string]map[string]*memFile),
+	}
+}
+
+func (m *memStorage) Put(owner string, meta FileInfo, r io.Reader) (FileInfo, error) {
+	if !validName(owner) || !validName(meta.Name) {
+		return FileInfo{}, errInvalidName
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if meta.Size >= 0 && n != meta.Size {
+		return FileInfo{}, fmt.Errorf("received %d of %d bytes: %w", n, meta.Size, io.ErrUnexpectedEOF)
+	}
+	meta.Size = n
+
+	sum := sha256.Sum256(buf.Bytes())
+	meta.Hash = hex.EncodeToString(sum[:])
+	meta.Created = time.Now().UTC()
+	f := &memFile{
+		info: meta,
+		data: buf.Bytes(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files[owner] == nil {
+		m.files[owner] = make(map[string]*memFile)
+	}
+	m.files[owner][meta.Name] = f
+
+	return f.info, nil
+}
+
+func (m *memStorage) Get(owner, name string, offset, length int64) (io.ReadCloser, FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[owner][name]
+	if !ok {
+		return nil, FileInfo{}, os.ErrNotExist
+	}
+
+	data := f.data[min(offset, f.info.Size):]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), f.info, nil
+}
+
+func (m *memStorage) List(owner string) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := make([]FileInfo, 0, len(m.files[owner]))
+	for _, f := range m.files[owner] {
+		files = append(files, f.info)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	return files, nil
+}
+
+func (m *memStorage) Stat(owner, name string) (FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[owner][name]
+	if !ok {
+		return FileInfo{}, os.ErrNotExist
+	}
+	return f.info, nil
+}
+
+func (m *memStorage) Accept(owner, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[owner][name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.info.From = ""
+	return nil
+}
+
+func (m *memStorage) Delete(owner, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[owner][name]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(m.files[owner], name)
+	if len(m.files[owner]) == 0 {
+		delete(m.files, owner)
+	}
+	return nil
+}
+
+func (m *memStorage) Owners() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	owners := make([]string, 0, len(m.files))
+	for owner := range m.files {
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+func (m *memStorage) Prune(owner string) error {
+	return nil // Owners without files are dropped right away
+}
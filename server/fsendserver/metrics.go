@@ -0,0 +1,160 @@
+package fsendserver
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the request duration
+// histogram, from quick pings up to large transfers
+var durationBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600}
+
+// metrics collects counters for the Prometheus endpoint. Gauges like open
+// connections are read from the server when scraped.
+type metrics struct {
+	bytesIn  atomic.Int64 // File data received
+	bytesOut atomic.Int64 // File data sent
+	rejected atomic.Int64 // Connections refused by a limit
+
+	mu       sync.Mutex
+	requests map[string]*requestMetrics // Opcode name -> metrics
+}
+
+type requestMetrics struct {
+	count   uint64
+	errors  uint64
+	buckets []uint64 // Cumulative counts per durationBuckets
+	sum     float64  // Seconds
+}
+
+func newMetrics() *metrics {
+	return &metrics{requests: make(map[string]*requestMetrics)}
+}
+
+// observe records a handled request
+func (m *metrics) observe(opcode uint8, d time.Duration, err error) {
+	name, ok := opcodeNames[opcode]
+	if !ok {
+		return // Not worth a label
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.requests[name]
+	if r == nil {
+		r = &requestMetrics{buckets: make([]uint64, len(durationBuckets))}
+		m.requests[name] = r
+	}
+
+	r.count++
+	if err != nil {
+		r.errors++
+	}
+	r.sum += d.Seconds()
+	for i, le := range durationBuckets {
+		if d.Seconds() <= le {
+			r.buckets[i]++
+		}
+	}
+}
+
+// serveMetrics serves the metrics on address until the server exits
+func (s *ServerContext) serveMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return http.ListenAndServe(address, mux)
+}
+
+// handleMetrics writes all metrics in the Prometheus text format
+func (s *ServerContext) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	s.mu.Lock()
+	active := len(s.sessions)
+	uuids := make(map[string]bool)
+	for _, client := range s.clients {
+		if client.session != nil {
+			continue // A QUIC stream, counted with its connection
+		}
+		active++
+		if client.uuid != "" {
+			uuids[client.uuid] = true
+		}
+	}
+	sessions := slices.Collect(maps.Keys(s.sessions))
+	s.mu.Unlock()
+
+	// Registering holds the session lock while taking s.mu
+	for _, session := range sessions {
+		if uuid := session.UUID(); uuid != "" {
+			uuids[uuid] = true
+		}
+	}
+
+	m := s.metrics
+	writeMetric(out, "fsend_connections_active", "gauge", "Open client connections.")
+	fmt.Fprintf(out, "fsend_connections_active %d\n", active)
+	writeMetric(out, "fsend_connections_rejected_total", "counter", "Connections refused by a connection or rate limit.")
+	fmt.Fprintf(out, "fsend_connections_rejected_total %d\n", m.rejected.Load())
+	writeMetric(out, "fsend_clients_registered", "gauge", "Distinct UUIDs with an open connection.")
+	fmt.Fprintf(out, "fsend_clients_registered %d\n", len(uuids))
+	writeMetric(out, "fsend_received_bytes_total", "counter", "File data received from clients.")
+	fmt.Fprintf(out, "fsend_received_bytes_total %d\n", m.bytesIn.Load())
+	writeMetric(out, "fsend_sent_bytes_total", "counter", "File data sent to clients.")
+	fmt.Fprintf(out, "fsend_sent_bytes_total %d\n", m.bytesOut.Load())
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.requests))
+	for name := range m.requests {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	writeMetric(out, "fsend_requests_total", "counter", "Handled requests by opcode.")
+	for _, name := range names {
+		fmt.Fprintf(out, "fsend_requests_total{opcode=%q} %d\n", name, m.requests[name].count)
+	}
+	writeMetric(out, "fsend_request_errors_total", "counter", "Requests by opcode that failed and closed the connection.")
+	for _, name := range names {
+		fmt.Fprintf(out, "fsend_request_errors_total{opcode=%q} %d\n", name, m.requests[name].errors)
+	}
+	writeMetric(out, "fsend_request_duration_seconds", "histogram", "Time to handle a request by opcode, including transfers.")
+	for _, name := range names {
+		req := m.requests[name]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(out, "fsend_request_duration_seconds_bucket{opcode=%q,le=\"%g\"} %d\n", name, le, req.buckets[i])
+		}
+		fmt.Fprintf(out, "fsend_request_duration_seconds_bucket{opcode=%q,le=\"+Inf\"} %d\n", name, req.count)
+		fmt.Fprintf(out, "fsend_request_duration_seconds_sum{opcode=%q} %g\n", name, req.sum)
+		fmt.Fprintf(out, "fsend_request_duration_seconds_count{opcode=%q} %d\n", name, req.count)
+	}
+	m.mu.Unlock()
+
+	writeMetric(out, "fsend_stored_bytes", "gauge", "Bytes stored for all UUIDs.")
+	fmt.Fprintf(out, "fsend_stored_bytes %d\n", s.quotas.Total())
+
+	// A series per UUID tells who uses the server and grows with the
+	// clients, so only on request
+	if !s.config.Metrics.PerUUID {
+		return
+	}
+	usage := s.quotas.UsageByOwner()
+	owners := slices.Sorted(maps.Keys(usage))
+	writeMetric(out, "fsend_stored_bytes_by_uuid", "gauge", "Bytes stored per UUID.")
+	for _, owner := range owners {
+		fmt.Fprintf(out, "fsend_stored_bytes_by_uuid{uuid=%q} %d\n", owner, usage[owner])
+	}
+}
+
+func writeMetric(out *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,132 @@
+package fsendserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// offerRecord encodes a pending file for listOffers and eventOffer:
+// [fnameLen][fname][fromLen][from][size:int64][expires:int64]
+func offerRecord(b []byte, f FileInfo, expires time.Time) []byte {
+	for _, s := range []string{f.Name, f.From} {
+		b = append(b, uint8(len(s)))
+		b = append(b, s...)
+	}
+
+	var unix int64 // 0 = never
+	if !expires.IsZero() {
+		unix = expires.Unix()
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(f.Size))
+	return binary.LittleEndian.AppendUint64(b, uint64(unix))
+}
+
+// offerEvent encodes eventOffer for the recipient of f
+func offerEvent(f FileInfo, expires time.Time) []byte {
+	return offerRecord([]byte{statusOK, eventOffer}, f, expires)
+}
+
+// handleListOffers sends the files other clients sent to the client that it
+// hasn't accepted yet, with the time each is discarded unless accepted
+func (s *ServerContext) handleListOffers(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	offers, err := s.listFilesForUUID(clientUUID, true)
+	if err != nil {
+		writeStatus(conn, statusError, "failed to list offers")
+		return fmt.Errorf("error listing offers: %w", err)
+	}
+
+	b := []byte{statusOK}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(offers)))
+	for _, f := range offers {
+		b = offerRecord(b, f, f.Expires)
+	}
+
+	_, err = conn.Write(b)
+	if err != nil {
+		return fmt.Errorf("error sending offers: %w", err)
+	}
+
+	logger.Debug("sent offer list", "offers", len(offers))
+	return nil
+}
+
+// handleAnswerOffer accepts a pending file, which then is listed and can be
+// downloaded like any other, or rejects it, which deletes it right away
+func (s *ServerContext) handleAnswerOffer(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	var fnameLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &fnameLen)
+	if err != nil {
+		return fmt.Errorf("failed to read filename length: %w", err)
+	}
+	fnameBytes := make([]byte, fnameLen)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read filename: %w", err)
+	}
+	fname := string(fnameBytes)
+
+	var accept uint8
+	err = binary.Read(conn, binary.LittleEndian, &accept)
+	if err != nil {
+		return fmt.Errorf("failed to read answer: %w", err)
+	}
+
+	logger = logger.With("filename", fname)
+
+	info, err := s.storage.Stat(clientUUID, fname)
+	if err == nil {
+		info.Expires = s.offerExpires(info)
+		if !info.Pending() || info.Expired(time.Now()) {
+			err = os.ErrNotExist // Accepted already, or left for the janitor
+		}
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return writeStatus(conn, statusError, "no offer for "+fname)
+		}
+		logger.Error("failed to look up offer", "error", err)
+		return writeStatus(conn, statusError, "failed to look up offer")
+	}
+	logger = logger.With("from", info.From)
+
+	if accept == 0 {
+		err = s.storage.Delete(clientUUID, fname)
+		if err != nil {
+			logger.Error("failed to delete rejected file", "error", err)
+			return writeStatus(conn, statusError, "failed to reject the file")
+		}
+		s.audit.Record(auditEntry{
+			Event:    auditDelete,
+			UUID:     clientUUID,
+			Filename: fname,
+			Hash:     info.Hash,
+			Size:     info.Size,
+			Reason:   "rejected",
+		})
+		logger.Info("offer rejected")
+		return writeStatus(conn, statusOK, "")
+	}
+
+	err = s.storage.Accept(clientUUID, fname)
+	if err != nil {
+		logger.Error("failed to accept file", "error", err)
+		return writeStatus(conn, statusError, "failed to accept the file")
+	}
+	s.audit.Record(auditEntry{
+		Event:      auditAccept,
+		UUID:       clientUUID,
+		Filename:   fname,
+		Hash:       info.Hash,
+		Size:       info.Size,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	s.rememberContacts(logger, contact{clientUUID, info.From})
+	logger.Info("offer accepted")
+	return writeStatus(conn, statusOK, "")
+}
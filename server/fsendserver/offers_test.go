@@ -0,0 +1,87 @@
+package fsendserver
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestAnswerOffer answers offers over a connection and checks what is left
+// in storage
+func TestAnswerOffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		accept  bool
+		status  uint8
+		kept    bool // offer.txt is still stored
+		pending bool // and still waits for an answer
+	}{
+		{"rejected is deleted", "offer.txt", false, statusOK, false, false},
+		{"accepted is kept", "offer.txt", true, statusOK, true, false},
+		{"no such offer", "other.txt", false, statusError, true, true},
+		{"not an offer", "own.txt", false, statusError, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemStorage()
+			mustPut(t, m, "alice", FileInfo{Name: "offer.txt", From: "bob", Size: 5}, "hello")
+			mustPut(t, m, "alice", FileInfo{Name: "own.txt", Size: 4}, "mine")
+			q, err := newQuotaStorage(m, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			senders, err := openSenderPolicies("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := DefaultConfig()
+			s := &ServerContext{storage: q, quotas: q, senders: senders, config: &config}
+
+			server, client := net.Pipe()
+			defer server.Close()
+			status := make(chan uint8, 1)
+			go func() {
+				defer client.Close()
+				answer := uint8(0)
+				if tt.accept {
+					answer = 1
+				}
+				msg := append([]byte{uint8(len(tt.file))}, tt.file...)
+				client.Write(append(msg, answer))
+				var reply [1]byte
+				io.ReadFull(client, reply[:])
+				status <- reply[0]
+				io.Copy(io.Discard, client)
+			}()
+
+			err = s.handleAnswerOffer(server, "alice", slog.Default())
+			if err != nil {
+				t.Fatalf("handleAnswerOffer: %v", err)
+			}
+			if got := <-status; got != tt.status {
+				t.Errorf("status %d, want %d", got, tt.status)
+			}
+
+			info, err := q.Stat("alice", "offer.txt")
+			if !tt.kept {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("Stat of a rejected offer: %v, want os.ErrNotExist", err)
+				}
+				if used, _, _ := q.Usage("alice"); used != int64(len("mine")) {
+					t.Errorf("quota counts %d bytes, want only own.txt", used)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Pending() != tt.pending {
+				t.Errorf("offer pending %v, want %v", info.Pending(), tt.pending)
+			}
+		})
+	}
+}
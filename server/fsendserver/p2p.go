@@ -0,0 +1,457 @@
+package fsendserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Events sent to subscribed clients, each after a statusOK
+const (
+	eventIncoming uint8 = iota // A client wants to send a file live
+	eventOffer                 // A client sent a file that waits for answerOffer
+)
+
+// Answers of the recipient to eventIncoming
+const (
+	answerConnected uint8 = iota // Connected to the sender directly
+	answerRelay                  // Direct failed, relay through the server
+	answerReject                 // The recipient declined the file
+)
+
+// How a live send goes, the sender learns it in the reply to sendDirect
+const (
+	modeDirect uint8 = iota
+	modeRelay
+)
+
+// directAnswerTimeout is how long a sender waits for the recipient to try
+// the direct connection
+const directAnswerTimeout = 30 * time.Second
+
+// maxCandidates bounds the addresses a sender may offer
+const maxCandidates = 16
+
+// broker pairs the two clients of live sends. It keeps no files, data goes
+// directly between the clients or through the relay.
+type broker struct {
+	mu          sync.Mutex
+	subscribers map[string]*subscriber // UUID -> its newest subscription
+	pending     map[string]*liveSend   // Token -> send waiting for the recipient
+}
+
+// subscriber is a connection that receives events for a UUID
+type subscriber struct {
+	events chan []byte // Encoded events, the subscription writes them
+}
+
+// liveSend is a sendDirect waiting for the recipient's answer
+type liveSend struct {
+	from    string
+	to      string
+	answers chan liveAnswer
+}
+
+// liveAnswer is the recipient's answer. For the relay conn is the recipient's
+// connection; the sender's handler replies on it, copies the file to it and
+// reports on done.
+type liveAnswer struct {
+	answer uint8
+	conn   net.Conn
+	done   chan error
+}
+
+func newBroker() *broker {
+	return &broker{
+		subscribers: make(map[string]*subscriber),
+		pending:     make(map[string]*liveSend),
+	}
+}
+
+func (b *broker) subscribe(uuid string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[uuid] = sub
+}
+
+func (b *broker) unsubscribe(uuid string, sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[uuid] == sub {
+		delete(b.subscribers, uuid)
+	}
+}
+
+// offer announces ls to its recipient with event and returns the token the
+// recipient answers with. It fails if the recipient isn't subscribed.
+func (b *broker) offer(ls *liveSend, event func(token string) []byte) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := b.subscribers[ls.to]
+	if sub == nil {
+		return "", errors.New("recipient is not online")
+	}
+
+	token := rand.Text()
+	select {
+	case sub.events <- event(token):
+	default:
+		return "", errors.New("recipient is busy")
+	}
+	b.pending[token] = ls
+	return token, nil
+}
+
+// notify sends event to uuid if it is subscribed. Events that don't fit in
+// the queue are dropped, they are only a hint.
+func (b *broker) notify(uuid string, event []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := b.subscribers[uuid]
+	if sub == nil {
+		return
+	}
+	select {
+	case sub.events <- event:
+	default:
+	}
+}
+
+// take removes and returns the send to recipient that token stands for, nil
+// if there is none or it timed out
+func (b *broker) take(token, recipient string) *liveSend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ls := b.pending[token]
+	if ls == nil || ls.to != recipient {
+		return nil
+	}
+	delete(b.pending, token)
+	return ls
+}
+
+// handleSubscribe turns the connection into a stream of events for the
+// client, until the client disconnects or the server shuts down. The client
+// sends a byte now and then so the idle timeout doesn't hit.
+func (s *ServerContext) handleSubscribe(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	sub := &subscriber{events: make(chan []byte, 8)}
+	s.broker.subscribe(clientUUID, sub)
+	defer s.broker.unsubscribe(clientUUID, sub)
+
+	err := writeStatus(conn, statusOK, "")
+	if err != nil {
+		return fmt.Errorf("error sending status: %w", err)
+	}
+	logger.Info("client subscribed")
+
+	// Idle from here on, so Shutdown wakes up the reader
+	gone := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		for s.setBusy(conn, false) {
+			_, err := conn.Read(buf)
+			if err != nil {
+				gone <- err
+				return
+			}
+		}
+		gone <- nil
+	}()
+
+	for {
+		select {
+		case event := <-sub.events:
+			conn.SetWriteDeadline(after(s.config.Timeouts.Progress))
+			_, err = conn.Write(event)
+			if err != nil {
+				return fmt.Errorf("error sending event: %w", err)
+			}
+		case err = <-gone:
+			if s.shuttingDown() {
+				notifyShutdown(conn)
+				return nil
+			}
+			logger.Debug("subscription ended", "error", err)
+			return nil
+		}
+	}
+}
+
+// handleSendDirect offers a file to an online client. The request carries the
+// addresses the sender listens on and a secret the recipient proves itself
+// with there; the recipient tries to connect and answers with answerDirect.
+// If the direct connection fails the file goes through the server without
+// being stored.
+func (s *ServerContext) handleSendDirect(conn net.Conn, senderUUID string, logger *slog.Logger) error {
+	// Read target UUID
+	var targetUUIDLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &targetUUIDLen)
+	if err != nil {
+		return fmt.Errorf("failed to read target UUID length: %w", err)
+	}
+	targetUUIDBytes := make([]byte, targetUUIDLen)
+	_, err = io.ReadFull(conn, targetUUIDBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read target UUID: %w", err)
+	}
+	targetUUID := string(targetUUIDBytes)
+
+	// Read filename
+	var fnameLen uint8
+	err = binary.Read(conn, binary.LittleEndian, &fnameLen)
+	if err != nil {
+		return fmt.Errorf("failed to read filename length: %w", err)
+	}
+	fnameBytes := make([]byte, fnameLen)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read filename: %w", err)
+	}
+	fname := string(fnameBytes)
+
+	// Read file size
+	var fsize uint64
+	err = binary.Read(conn, binary.LittleEndian, &fsize)
+	if err != nil {
+		return fmt.Errorf("failed to read file size: %w", err)
+	}
+
+	// Read the secret the recipient proves itself to the sender with
+	var secretLen uint8
+	err = binary.Read(conn, binary.LittleEndian, &secretLen)
+	if err != nil {
+		return fmt.Errorf("failed to read secret length: %w", err)
+	}
+	secret := make([]byte, secretLen)
+	_, err = io.ReadFull(conn, secret)
+	if err != nil {
+		return fmt.Errorf("failed to read secret: %w", err)
+	}
+
+	// Read the sender's addresses
+	var count uint8
+	err = binary.Read(conn, binary.LittleEndian, &count)
+	if err != nil {
+		return fmt.Errorf("failed to read address count: %w", err)
+	}
+	var candidates []string
+	for range count {
+		var addrLen uint8
+		err = binary.Read(conn, binary.LittleEndian, &addrLen)
+		if err != nil {
+			return fmt.Errorf("failed to read address length: %w", err)
+		}
+		addr := make([]byte, addrLen)
+		_, err = io.ReadFull(conn, addr)
+		if err != nil {
+			return fmt.Errorf("failed to read address: %w", err)
+		}
+		candidates = append(candidates, string(addr))
+	}
+	candidates = publicCandidates(conn, candidates)
+
+	logger = logger.With("to", targetUUID, "filename", fname, "bytes", fsize)
+
+	if !validName(fname) {
+		return writeStatus(conn, statusError, "invalid filename")
+	}
+	if targetUUID == senderUUID {
+		return writeStatus(conn, statusUnavailable, "can't send live to yourself")
+	}
+	if !s.senders.permitted(targetUUID, senderUUID) {
+		logger.Warn("live send refused", "error", "not permitted")
+		return writeStatus(conn, statusNotPermitted, notPermittedMsg)
+	}
+
+	ls := &liveSend{from: senderUUID, to: targetUUID, answers: make(chan liveAnswer, 1)}
+	token, err := s.broker.offer(ls, func(token string) []byte {
+		return incomingEvent(token, senderUUID, fname, fsize, string(secret), candidates)
+	})
+	if err != nil {
+		logger.Info("live send refused", "error", err)
+		return writeStatus(conn, statusUnavailable, err.Error())
+	}
+
+	var (
+		a        liveAnswer
+		answered bool
+	)
+	select {
+	case a = <-ls.answers:
+		answered = true
+	case <-time.After(directAnswerTimeout):
+	}
+
+	// The request may have waited longer than the header timeout
+	conn.SetWriteDeadline(after(s.config.Timeouts.Progress))
+
+	if !answered {
+		if s.broker.take(token, targetUUID) != nil {
+			logger.Info("recipient did not answer")
+			return writeStatus(conn, statusUnavailable, "recipient did not answer")
+		}
+		a = <-ls.answers // Answered just now
+	}
+
+	if a.answer == answerReject {
+		logger.Info("recipient declined the file")
+		return writeStatus(conn, statusError, "the recipient declined the file")
+	}
+
+	if a.answer == answerConnected {
+		_, err = conn.Write([]byte{statusOK, modeDirect})
+		if err != nil {
+			return fmt.Errorf("error sending mode: %w", err)
+		}
+		// The data bypasses the server, which never learns whether the
+		// transfer finished, so only the connection is recorded
+		s.audit.Record(auditEntry{
+			Event:      auditDirect,
+			UUID:       senderUUID,
+			Recipient:  targetUUID,
+			Filename:   fname,
+			Size:       int64(fsize),
+			RemoteAddr: conn.RemoteAddr().String(),
+		})
+		s.rememberContacts(logger, contact{senderUUID, targetUUID}, contact{targetUUID, senderUUID})
+		logger.Info("direct connection established")
+		return nil
+	}
+
+	start := time.Now()
+	err = s.relay(conn, a.conn, fsize)
+	a.done <- err
+	if err != nil {
+		return fmt.Errorf("relay failed: %w", err)
+	}
+	s.audit.Record(auditEntry{
+		Event:      auditRelay,
+		UUID:       senderUUID,
+		Recipient:  targetUUID,
+		Filename:   fname,
+		Size:       int64(fsize),
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	s.rememberContacts(logger, contact{senderUUID, targetUUID}, contact{targetUUID, senderUUID})
+	logger.Info("file relayed", "duration", time.Since(start))
+	return nil
+}
+
+// relay answers both clients, copies size bytes from the sender to the
+// recipient and then confirms to the sender that they were passed on
+func (s *ServerContext) relay(sender, recipient net.Conn, size uint64) error {
+	in, out := s.transfer(sender), s.transfer(recipient)
+
+	err := writeStatus(out, statusOK, "")
+	if err != nil {
+		return fmt.Errorf("error sending status to recipient: %w", err)
+	}
+	_, err = in.Write([]byte{statusOK, modeRelay})
+	if err != nil {
+		return fmt.Errorf("error sending mode: %w", err)
+	}
+
+	buf := make([]byte, s.config.Buffers.Copy)
+	_, err = io.CopyBuffer(out, io.LimitReader(in, int64(size)), buf)
+	if err != nil {
+		return err
+	}
+	return writeStatus(in, statusOK, "")
+}
+
+// handleAnswerDirect takes the recipient's answer to eventIncoming: it
+// connected directly, wants the relay or declines the file. For the relay
+// the file follows the reply.
+func (s *ServerContext) handleAnswerDirect(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	var tokenLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &tokenLen)
+	if err != nil {
+		return fmt.Errorf("failed to read token length: %w", err)
+	}
+	token := make([]byte, tokenLen)
+	_, err = io.ReadFull(conn, token)
+	if err != nil {
+		return fmt.Errorf("failed to read token: %w", err)
+	}
+
+	var answer uint8
+	err = binary.Read(conn, binary.LittleEndian, &answer)
+	if err != nil {
+		return fmt.Errorf("failed to read answer: %w", err)
+	}
+
+	if answer > answerReject {
+		return writeStatus(conn, statusError, "unknown answer")
+	}
+
+	ls := s.broker.take(string(token), clientUUID)
+	if ls == nil {
+		return writeStatus(conn, statusError, "the sender gave up")
+	}
+	logger = logger.With("from", ls.from)
+
+	if answer != answerRelay {
+		ls.answers <- liveAnswer{answer: answer}
+		return writeStatus(conn, statusOK, "")
+	}
+
+	// The sender's handler replies and moves the data
+	a := liveAnswer{answer: answerRelay, conn: conn, done: make(chan error, 1)}
+	ls.answers <- a
+	err = <-a.done
+	if err != nil {
+		return fmt.Errorf("relay failed: %w", err)
+	}
+	logger.Debug("relayed file received")
+	return nil
+}
+
+// publicCandidates adds the address the sender connected from, with the
+// ports of its own addresses, for a sender that is reachable from outside
+func publicCandidates(conn net.Conn, candidates []string) []string {
+	public := remoteIP(conn.RemoteAddr())
+	seen := make(map[string]bool)
+	var all []string
+	for _, c := range candidates {
+		_, port, err := net.SplitHostPort(c)
+		if err != nil {
+			continue
+		}
+		for _, addr := range []string{c, net.JoinHostPort(public, port)} {
+			if !seen[addr] && len(all) < maxCandidates {
+				seen[addr] = true
+				all = append(all, addr)
+			}
+		}
+	}
+	return all
+}
+
+// incomingEvent encodes eventIncoming: [status][event][tokenLen][token]
+// [fromLen][from][fnameLen][fname][size:uint64][secretLen][secret]
+// [count]{[addrLen][addr]}
+func incomingEvent(token, from, fname string, size uint64, secret string, candidates []string) []byte {
+	b := []byte{statusOK, eventIncoming}
+	for _, s := range []string{token, from, fname} {
+		b = append(b, uint8(len(s)))
+		b = append(b, s...)
+	}
+	b = binary.LittleEndian.AppendUint64(b, size)
+	b = append(b, uint8(len(secret)))
+	b = append(b, secret...)
+	b = append(b, uint8(len(candidates)))
+	for _, c := range candidates {
+		b = append(b, uint8(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
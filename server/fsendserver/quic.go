@@ -0,0 +1,190 @@
+package fsendserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol QUIC clients ask for
+const quicALPN = "fsend"
+
+// quicSession is a QUIC connection. Every request comes on its own stream,
+// so a slow transfer doesn't hold up the others; the UUID and the limits are
+// shared by all streams.
+type quicSession struct {
+	conn   *quic.Conn
+	limits *ipLimits
+	log    *slog.Logger
+
+	mu   sync.Mutex // Held while registering
+	uuid string
+}
+
+func (q *quicSession) UUID() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.uuid
+}
+
+// quicStream is a stream of a QUIC connection used as a net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// Close ends both directions, a client still sending a refused upload is told
+// to stop
+func (s quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// ListenQUIC accepts QUIC clients on address until Shutdown is called. QUIC
+// always uses TLS, with the same certificate as the TCP listener.
+func (s *ServerContext) ListenQUIC(address string) error {
+	cert, err := tls.LoadX509KeyPair(s.config.TLS.Cert, s.config.TLS.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+	}
+
+	lis, err := quic.ListenAddr(address, tlsConf, &quic.Config{
+		MaxIdleTimeout: time.Duration(s.config.Timeouts.Idle),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		lis.Close()
+		return nil
+	}
+	s.quicLis = lis
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept(context.Background())
+		if err != nil {
+			if s.shuttingDown() {
+				return nil
+			}
+			return err
+		}
+		go s.handleQUICConn(conn)
+	}
+}
+
+// handleQUICConn accepts the streams of a QUIC connection until it is closed
+func (s *ServerContext) handleQUICConn(conn *quic.Conn) {
+	session := &quicSession{conn: conn, log: s.connLogger(conn.RemoteAddr()).With("transport", "quic")}
+
+	ip := remoteIP(conn.RemoteAddr())
+	limits, err := s.limiter.connect(ip)
+	if err != nil {
+		session.log.Warn("connection refused", "error", err)
+		s.metrics.rejected.Add(1)
+		conn.CloseWithError(quic.ApplicationErrorCode(statusLimited), err.Error())
+		return
+	}
+	defer s.limiter.disconnect(ip)
+	session.limits = limits
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		conn.CloseWithError(quic.ApplicationErrorCode(statusShuttingDown), "server is shutting down")
+		return
+	}
+	s.sessions[session] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, session)
+		s.mu.Unlock()
+		if uuid := session.UUID(); uuid != "" {
+			s.limiter.unregister(uuid)
+		}
+	}()
+	session.log.Debug("connection opened")
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			session.log.Debug("connection closed", "error", err)
+			return
+		}
+
+		// Requests that come in after Shutdown are refused
+		if !s.track() {
+			go notifyShutdown(quicStream{stream, conn})
+			continue
+		}
+		go s.handleQUICStream(session, quicStream{stream, conn})
+	}
+}
+
+// handleQUICStream handles the one request on a stream
+func (s *ServerContext) handleQUICStream(session *quicSession, stream quicStream) {
+	defer s.wg.Done()
+
+	s.mu.Lock()
+	s.clients[stream] = &ClientInfo{uuid: session.UUID(), conn: stream, limits: session.limits, session: session}
+	s.mu.Unlock()
+
+	defer func() {
+		stream.Close()
+		s.mu.Lock()
+		delete(s.clients, stream)
+		s.mu.Unlock()
+	}()
+
+	if !s.setBusy(stream, true) {
+		notifyShutdown(stream)
+		return
+	}
+
+	var o uint8
+	err := binary.Read(stream, binary.LittleEndian, &o)
+	if err != nil {
+		session.log.Debug("stream closed without request", "error", err)
+		return
+	}
+
+	if o == register {
+		// The UUID is shared by all streams, one registration at a time
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		session.uuid, _ = s.handleRequest(stream, o, session.uuid, session.limits, s.requestLogger(session.log, o, session.uuid))
+		return
+	}
+
+	uuid := session.UUID()
+	s.handleRequest(stream, o, uuid, session.limits, s.requestLogger(session.log, o, uuid))
+}
+
+// closeSessions tells QUIC clients that the server is going away
+func (s *ServerContext) closeSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for session := range s.sessions {
+		session.conn.CloseWithError(quic.ApplicationErrorCode(statusShuttingDown), "server is shutting down")
+	}
+}
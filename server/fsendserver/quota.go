@@ -0,0 +1,251 @@
+package fsendserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaStorage wraps a Storage and keeps track of how many bytes every UUID
+// and the server as a whole store, so uploads can be refused up front. A
+// limit of 0 means unlimited.
+type quotaStorage struct {
+	Storage
+
+	perUUID int64
+	global  int64
+
+	mu       sync.Mutex
+	usage    map[string]int64 // owner -> stored bytes
+	total    int64            // stored bytes of all owners
+	reserved map[string]int64 // owner -> bytes of uploads in progress
+	pending  int64            // bytes of all uploads in progress
+}
+
+// newQuotaStorage wraps storage and counts what it already holds
+func newQuotaStorage(storage Storage, perUUID, global int64) (*quotaStorage, error) {
+	q := &quotaStorage{
+		Storage:  storage,
+		perUUID:  perUUID,
+		global:   global,
+		usage:    make(map[string]int64),
+		reserved: make(map[string]int64),
+	}
+
+	owners, err := storage.Owners()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, owner := range owners {
+		files, err := storage.List(owner)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			q.usage[owner] += f.Size
+			q.total += f.Size
+		}
+	}
+	return q, nil
+}
+
+// Reserve claims size bytes for an upload of name to owner, or fails with
+// errQuotaExceeded. The returned func gives the claim back and must be
+// called once the upload is done, successful or not.
+func (q *quotaStorage) Reserve(owner, name string, size int64) (release func(), err error) {
+	r, err := q.reserve(owner, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return r.release, nil
+}
+
+// reservation is the room claimed by an upload in progress. Uploads of
+// unknown length start small and grow it as their data arrives.
+type reservation struct {
+	q        *quotaStorage
+	owner    string
+	replaced int64 // Size of the file the upload replaces, which frees it
+	size     int64 // Bytes of the upload claimed so far
+}
+
+// reserve is Reserve returning the reservation, to grow it later
+func (q *quotaStorage) reserve(owner, name string, size int64) (*reservation, error) {
+	r := &reservation{q: q, owner: owner}
+	if info, err := q.Storage.Stat(owner, name); err == nil {
+		r.replaced = info.Size
+	}
+	return r, r.grow(size)
+}
+
+// grow claims n more bytes, or fails with errQuotaExceeded and keeps the
+// claim as it was
+func (r *reservation) grow(n int64) error {
+	q := r.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Only the part beyond the replaced file counts, held is in reserved
+	// already
+	held := max(r.size-r.replaced, 0)
+	need := r.size + n - r.replaced
+	if q.perUUID > 0 && q.usage[r.owner]+q.reserved[r.owner]-held+need > q.perUUID {
+		return fmt.Errorf("%w: %s of %s used", errQuotaExceeded,
+			FormatSize(q.usage[r.owner]), FormatSize(q.perUUID))
+	}
+	if q.global > 0 && q.total+q.pending-held+need > q.global {
+		return fmt.Errorf("%w: server storage is full", errQuotaExceeded)
+	}
+
+	need = max(need, 0)
+	q.reserved[r.owner] += need - held
+	q.pending += need - held
+	if q.reserved[r.owner] == 0 {
+		delete(q.reserved, r.owner)
+	}
+	r.size += n
+	return nil
+}
+
+// release gives the claim back once the upload is done, successful or not.
+// Calling it again does nothing.
+func (r *reservation) release() {
+	q := r.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	held := max(r.size-r.replaced, 0)
+	q.reserved[r.owner] -= held
+	q.pending -= held
+	if q.reserved[r.owner] == 0 {
+		delete(q.reserved, r.owner)
+	}
+	r.size = 0
+}
+
+// Usage returns the bytes stored by owner, its limit and how much it can
+// still upload considering the global limit as well
+func (q *quotaStorage) Usage(owner string) (used, limit, available int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	used = q.usage[owner]
+	available = -1 // Unlimited
+
+	if q.perUUID > 0 {
+		available = max(q.perUUID-used-q.reserved[owner], 0)
+	}
+	if q.global > 0 {
+		free := max(q.global-q.total-q.pending, 0)
+		if available < 0 || free < available {
+			available = free
+		}
+	}
+	return used, q.perUUID, available
+}
+
+// UsageByOwner returns the bytes stored by every owner
+func (q *quotaStorage) UsageByOwner() map[string]int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return maps.Clone(q.usage)
+}
+
+// Total returns the bytes stored by all owners
+func (q *quotaStorage) Total() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total
+}
+
+func (q *quotaStorage) Put(owner string, meta FileInfo, r io.Reader) (FileInfo, error) {
+	var replaced int64
+	if info, err := q.Storage.Stat(owner, meta.Name); err == nil {
+		replaced = info.Size
+	}
+
+	info, err := q.Storage.Put(owner, meta, r)
+	if err != nil {
+		return info, err
+	}
+
+	q.add(owner, info.Size-replaced)
+	return info, nil
+}
+
+func (q *quotaStorage) Delete(owner, name string) error {
+	info, err := q.Storage.Stat(owner, name)
+	if err != nil {
+		return err
+	}
+
+	err = q.Storage.Delete(owner, name)
+	if err != nil {
+		return err
+	}
+
+	q.add(owner, -info.Size)
+	return nil
+}
+
+func (q *quotaStorage) add(owner string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.usage[owner] += n
+	q.total += n
+	if q.usage[owner] <= 0 {
+		delete(q.usage, owner)
+	}
+}
+
+// ParseSize parses sizes like "512", "100K", "20MB" or "1.5G" (powers of 1024)
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// FormatSize formats a byte count for humans
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
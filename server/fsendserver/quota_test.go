@@ -0,0 +1,140 @@
+package fsendserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newTestQuotas returns a quotaStorage over a memStorage that already holds
+// files of the given sizes, by owner and name
+func newTestQuotas(t *testing.T, perUUID, global int64, stored map[string]map[string]int64) *quotaStorage {
+	t.Helper()
+
+	s := newMemStorage()
+	for owner, files := range stored {
+		for name, size := range files {
+			mustPut(t, s, owner, FileInfo{Name: name, Size: size}, strings.Repeat("x", int(size)))
+		}
+	}
+
+	q, err := newQuotaStorage(s, perUUID, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQuotaReserve(t *testing.T) {
+	stored := map[string]map[string]int64{
+		"alice": {"a.txt": 60},
+		"bob":   {"b.txt": 30},
+	}
+	tests := []struct {
+		name            string
+		perUUID, global int64
+		file            string
+		size            int64
+		ok              bool
+	}{
+		{"unlimited", 0, 0, "new.txt", 1 << 40, true},
+		{"fits exactly", 100, 0, "new.txt", 40, true},
+		{"over the limit", 100, 0, "new.txt", 41, false},
+		{"replacing frees the old size", 100, 0, "a.txt", 100, true},
+		{"replacing with more", 100, 0, "a.txt", 101, false},
+		{"others count globally", 0, 100, "new.txt", 10, true},
+		{"server full", 0, 100, "new.txt", 11, false},
+		{"both limits", 200, 100, "new.txt", 50, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQuotas(t, tt.perUUID, tt.global, stored)
+
+			release, err := q.Reserve("alice", tt.file, tt.size)
+			if tt.ok != (err == nil) {
+				t.Fatalf("Reserve(%d) = %v, want ok %v", tt.size, err, tt.ok)
+			}
+			if err != nil {
+				if !errors.Is(err, errQuotaExceeded) {
+					t.Errorf("Reserve failed with %v, want errQuotaExceeded", err)
+				}
+				return
+			}
+
+			// Only what the upload adds to the stored files is reserved
+			if want := max(tt.size-stored["alice"][tt.file], 0); q.reserved["alice"] != want || q.pending != want {
+				t.Errorf("reserved %d, %d pending, want %d", q.reserved["alice"], q.pending, want)
+			}
+			release()
+			if len(q.reserved) != 0 || q.pending != 0 {
+				t.Errorf("released reservation leaves %v, %d pending", q.reserved, q.pending)
+			}
+		})
+	}
+}
+
+// TestQuotaUsage follows the usage of an owner as files come and go
+func TestQuotaUsage(t *testing.T) {
+	q := newTestQuotas(t, 100, 150, map[string]map[string]int64{
+		"alice": {"a.txt": 10},
+		"bob":   {"b.txt": 70},
+	})
+
+	steps := []struct {
+		op        string // put or delete, of alice's files
+		name      string
+		size      int64
+		used      int64
+		available int64
+	}{
+		{"", "", 0, 10, 70}, // The global limit leaves less than alice's own
+		{"put", "c.txt", 20, 30, 50},
+		{"put", "c.txt", 5, 15, 65}, // Replacing
+		{"delete", "a.txt", 0, 5, 75},
+		{"delete", "c.txt", 0, 0, 80},
+	}
+	for i, step := range steps {
+		switch step.op {
+		case "put":
+			mustPut(t, q, "alice", FileInfo{Name: step.name, Size: step.size}, strings.Repeat("x", int(step.size)))
+		case "delete":
+			err := q.Delete("alice", step.name)
+			if err != nil {
+				t.Fatalf("step %d: %v", i, err)
+			}
+		}
+
+		used, limit, available := q.Usage("alice")
+		if used != step.used || limit != 100 || available != step.available {
+			t.Errorf("step %d (%s %s): Usage = %d, %d, %d, want %d, 100, %d", i, step.op, step.name, used, limit, available, step.used, step.available)
+		}
+		if total := q.Total(); total != step.used+70 {
+			t.Errorf("step %d: Total = %d, want %d", i, total, step.used+70)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"100K", 100 << 10, true},
+		{"20MB", 20 << 20, true},
+		{"1.5G", 3 << 29, true},
+		{"2 GiB", 2 << 30, true},
+		{"1t", 1 << 40, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"lots", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if tt.ok != (err == nil) || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d (ok %v)", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package fsendserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Object metadata holding FileInfo.Expires and FileInfo.From
+const (
+	s3MetaExpires = "x-amz-meta-fsend-expires"
+	s3MetaFrom    = "x-amz-meta-fsend-from"
+)
+
+// s3Storage stores files as objects {prefix}{owner}/{name} in a bucket of an
+// S3-compatible service (AWS S3, MinIO, ...). Requests are path-style and
+// signed with AWS Signature Version 4, so no SDK is needed.
+type s3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// newS3Storage creates an S3 backend. Credentials are taken from the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+func newS3Storage(endpoint, bucket, region, prefix string) (*s3Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket configured")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	s := &s3Storage{
+		endpoint:     u,
+		bucket:       bucket,
+		region:       region,
+		prefix:       prefix,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return s, nil
+}
+
+func (s *s3Storage) key(owner, name string) string {
+	return s.prefix + owner + "/" + name
+}
+
+func (s *s3Storage) Put(owner string, meta FileInfo, r io.Reader) (FileInfo, error) {
+	if !validName(owner) || !validName(meta.Name) {
+		return FileInfo{}, errInvalidName
+	}
+
+	size := meta.Size
+	if size < 0 {
+		// S3 needs the length up front
+		tmp, err := spool(r)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err = tmp.Seek(0, io.SeekCurrent)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return FileInfo{}, err
+		}
+		r = tmp
+	}
+	hr := &hashingReader{r: io.LimitReader(r, size), h: sha256.New()}
+	req, err := s.newRequest(http.MethodPut, s.key(owner, meta.Name), nil, hr)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	setMeta(req, meta)
+
+	// The transport aborts the request if the body ends before ContentLength
+	resp, err := s.do(req)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	if hr.n != size {
+		return FileInfo{}, fmt.Errorf("received %d of %d bytes: %w", hr.n, size, io.ErrUnexpectedEOF)
+	}
+
+	meta.Size = size
+	meta.Hash = hex.EncodeToString(hr.h.Sum(nil))
+	meta.Created = time.Now().UTC()
+	return meta, nil
+}
+
+func (s *s3Storage) Get(owner, name string, offset, length int64) (io.ReadCloser, FileInfo, error) {
+	if !validName(owner) || !validName(name) {
+		return nil, FileInfo{}, os.ErrNotExist
+	}
+
+	if length == 0 {
+		info, err := s.Stat(owner, name)
+		if err != nil {
+			return nil, FileInfo{}, err
+		}
+		return io.NopCloser(strings.NewReader("")), info, nil
+	}
+
+	req, err := s.newRequest(http.MethodGet, s.key(owner, name), nil, nil)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	if length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return resp.Body, s.info(name, resp), nil
+}
+
+func (s *s3Storage) List(owner string) ([]FileInfo, error) {
+	if !validName(owner) {
+		return nil, errInvalidName
+	}
+
+	prefix := s.key(owner, "")
+	var names []string
+
+	err := s.listObjects(prefix, func(obj s3Object) {
+		names = append(names, strings.TrimPrefix(obj.Key, prefix))
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Listings don't include user metadata such as the expiry time
+	files := make([]FileInfo, 0, len(names))
+	for _, name := range names {
+		info, err := s.Stat(owner, name)
+		if err != nil {
+			continue // Removed meanwhile
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+func (s *s3Storage) Owners() ([]string, error) {
+	var owners []string
+
+	err := s.listObjects(s.prefix, nil, func(prefix string) {
+		owner := strings.TrimSuffix(strings.TrimPrefix(prefix, s.prefix), "/")
+		owners = append(owners, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+func (s *s3Storage) Prune(owner string) error {
+	return nil // There are no directories in a bucket
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// listObjects lists the objects and "directories" directly below prefix,
+// following continuation tokens until the listing is complete
+func (s *s3Storage) listObjects(prefix string, object func(s3Object), dir func(string)) error {
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := s.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.do(req)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Contents       []s3Object
+			CommonPrefixes []struct {
+				Prefix string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: invalid list response: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			if object != nil {
+				object(obj)
+			}
+		}
+		for _, p := range result.CommonPrefixes {
+			if dir != nil {
+				dir(p.Prefix)
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Stat(owner, name string) (FileInfo, error) {
+	if !validName(owner) || !validName(name) {
+		return FileInfo{}, os.ErrNotExist
+	}
+
+	req, err := s.newRequest(http.MethodHead, s.key(owner, name), nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	return s.info(name, resp), nil
+}
+
+// Accept copies the object onto itself with new metadata, S3 can't change
+// metadata in place
+func (s *s3Storage) Accept(owner, name string) error {
+	info, err := s.Stat(owner, name)
+	if err != nil {
+		return err
+	}
+	info.From = ""
+
+	req, err := s.newRequest(http.MethodPut, s.key(owner, name), nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-copy-source", "/"+awsEscape(s.bucket, false)+"/"+awsEscape(s.key(owner, name), false))
+	req.Header.Set("x-amz-metadata-directive", "REPLACE")
+	setMeta(req, info)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Delete(owner, name string) error {
+	// S3 happily deletes keys that don't exist
+	_, err := s.Stat(owner, name)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodDelete, s.key(owner, name), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// info builds a FileInfo from the headers of a GET or HEAD response
+func (s *s3Storage) info(name string, resp *http.Response) FileInfo {
+	info := FileInfo{
+		Name: name,
+		Size: resp.ContentLength,
+	}
+
+	// "bytes 0-99/1234" for range requests
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+			if total, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				info.Size = total
+			}
+		}
+	}
+
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.Created = t.UTC()
+	}
+	if t, err := time.Parse(time.RFC3339, resp.Header.Get(s3MetaExpires)); err == nil {
+		info.Expires = t
+	}
+	info.From = resp.Header.Get(s3MetaFrom)
+	return info
+}
+
+// spool copies an upload of unknown length to a temporary file, which is
+// left at its end
+func spool(r io.Reader) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "fsend-upload-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// setMeta adds the metadata headers of an upload
+func setMeta(req *http.Request, meta FileInfo) {
+	if !meta.Expires.IsZero() {
+		req.Header.Set(s3MetaExpires, meta.Expires.UTC().Format(time.RFC3339))
+	}
+	if meta.From != "" {
+		req.Header.Set(s3MetaFrom, meta.From)
+	}
+}
+
+func (s *s3Storage) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	u.RawPath = "/" + awsEscape(s.bucket, false) + "/" + awsEscape(key, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return http.NewRequest(method, u.String(), body)
+}
+
+// do signs and sends a request. Error responses are turned into errors, with
+// 404 mapped to os.ErrNotExist.
+func (s *s3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+
+	var s3err struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&s3err)
+	if s3err.Code == "" {
+		s3err.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3: %s: %s", s3err.Code, s3err.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header. The payload is
+// not part of the signature so uploads can be streamed.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	signedHeaders := []string{"host"}
+	for k := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			signedHeaders = append(signedHeaders, k)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	var headers strings.Builder
+	for _, k := range signedHeaders {
+		v := req.URL.Host
+		if k != "host" {
+			v = strings.TrimSpace(req.Header.Get(k))
+		}
+		headers.WriteString(k + ":" + v + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except unreserved characters, and
+// slashes unless encodeSlash is set
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hashingReader hashes and counts everything read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
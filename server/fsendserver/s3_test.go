@@ -0,0 +1,329 @@
+package fsendserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeS3Bucket = "fsend-test"
+	fakeS3Region = "eu-west-1"
+	fakeS3Key    = "AKIDEXAMPLE"
+	fakeS3Secret = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 is an in-memory stand-in for the parts of the S3 API s3Storage uses:
+// path-style PUT (with x-amz-copy-source), GET with Range, HEAD, DELETE and
+// ListObjectsV2 with prefix, delimiter and continuation tokens. Requests
+// must carry a valid Signature Version 4, which it checks on its own rather
+// than with s3Storage.sign.
+type fakeS3 struct {
+	pageSize int // Objects per listing page, small to exercise continuation
+
+	mu      sync.Mutex
+	objects map[string]fakeObject // Key without the bucket
+}
+
+type fakeObject struct {
+	data     []byte
+	meta     http.Header // x-amz-meta-* headers
+	modified time.Time
+}
+
+// newTestS3Storage returns an s3Storage using a fakeS3 that lives as long as
+// the test
+func newTestS3Storage(t *testing.T) *s3Storage {
+	t.Helper()
+
+	fake := &fakeS3{pageSize: 2, objects: make(map[string]fakeObject)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", fakeS3Key)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", fakeS3Secret)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	s, err := newS3Storage(srv.URL, fakeS3Bucket, fakeS3Region, "files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != "" {
+		fakeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err)
+		return
+	}
+
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	path, err := url.PathUnescape(path)
+	if err != nil {
+		fakeS3Error(w, http.StatusBadRequest, "InvalidURI", err.Error())
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		f.put(w, r, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		http.ServeContent(w, r, "", obj.modified, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (f *fakeS3) put(w http.ResponseWriter, r *http.Request, key string) {
+	meta := make(http.Header)
+	for k, v := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[k] = v
+		}
+	}
+
+	var data []byte
+	if src := r.Header.Get("x-amz-copy-source"); src != "" {
+		src, _ = url.PathUnescape(src)
+		obj, ok := f.objects[strings.TrimPrefix(src, "/"+fakeS3Bucket+"/")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey", src)
+			return
+		}
+		data = obj.data
+		if r.Header.Get("x-amz-metadata-directive") != "REPLACE" {
+			meta = obj.meta
+		}
+	} else {
+		var err error
+		data, err = io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody", "body doesn't match Content-Length")
+			return
+		}
+	}
+
+	// Last-Modified has second precision
+	f.objects[key] = fakeObject{data: data, meta: meta, modified: time.Now().UTC().Truncate(time.Second)}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	if query.Get("list-type") != "2" {
+		fakeS3Error(w, http.StatusBadRequest, "InvalidArgument", "only ListObjectsV2 is supported")
+		return
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	// Objects and common prefixes in key order, as S3 returns them
+	type entry struct {
+		key string
+		dir bool
+	}
+	var entries []entry
+	seen := make(map[string]bool)
+	for key := range f.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			dir := prefix + rest[:i+len(delimiter)]
+			if !seen[dir] {
+				seen[dir] = true
+				entries = append(entries, entry{dir, true})
+			}
+			continue
+		}
+		entries = append(entries, entry{key, false})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	start := 0
+	if token := query.Get("continuation-token"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := min(start+f.pageSize, len(entries))
+
+	type object struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		CommonPrefixes        []commonPrefix
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{IsTruncated: end < len(entries)}
+	if result.IsTruncated {
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	for _, e := range entries[start:end] {
+		if e.dir {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{e.key})
+			continue
+		}
+		obj := f.objects[e.key]
+		result.Contents = append(result.Contents, object{e.key, int64(len(obj.data)), obj.modified})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verify checks the Signature Version 4 of r the way S3 does and returns
+// what is wrong with it
+func (f *fakeS3) verify(r *http.Request) string {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "not signed with AWS4-HMAC-SHA256"
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+
+	amzDate := r.Header.Get("x-amz-date")
+	date, _, _ := strings.Cut(amzDate, "T")
+	scope := date + "/" + fakeS3Region + "/s3/aws4_request"
+	if fields["Credential"] != fakeS3Key+"/"+scope {
+		return "wrong credential scope " + fields["Credential"]
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) || !slices.Contains(signed, "host") {
+		return "signed headers must be sorted and include host"
+	}
+	var headers strings.Builder
+	for _, k := range signed {
+		v := r.Host
+		if k != "host" {
+			v = strings.TrimSpace(r.Header.Get(k))
+		}
+		headers.WriteString(k + ":" + v + "\n")
+	}
+	for k := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") && !slices.Contains(signed, k) {
+			return "unsigned header " + k
+		}
+	}
+
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+
+	// S3 signs the query with its parameters sorted and encoded strictly
+	var params []string
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			params = append(params, strictEscape(k)+"="+strictEscape(v))
+		}
+	}
+	sort.Strings(params)
+
+	canonical := strings.Join([]string{
+		r.Method,
+		path,
+		strings.Join(params, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + fakeS3Secret)
+	for _, part := range []string{date, fakeS3Region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if hex.EncodeToString(key) != fields["Signature"] {
+		return "signature doesn't match"
+	}
+	return ""
+}
+
+// strictEscape percent-encodes like RFC 3986 asks: everything but letters,
+// digits and -._~
+func strictEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: msg})
+}
+
+func TestS3SignatureRejected(t *testing.T) {
+	s := newTestS3Storage(t)
+	s.secretKey = "wrong"
+
+	_, err := s.List("alice")
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("List with a wrong secret: got %v, want SignatureDoesNotMatch", err)
+	}
+}
+
+func TestAWSEscape(t *testing.T) {
+	tests := []struct {
+		in          string
+		encodeSlash bool
+		want        string
+	}{
+		{"files/alice/a.txt", false, "files/alice/a.txt"},
+		{"files/alice/a.txt", true, "files%2Falice%2Fa.txt"},
+		{"report (final).pdf", false, "report%20%28final%29.pdf"},
+		{"a+b=c&d", true, "a%2Bb%3Dc%26d"},
+		{"~user-_.", false, "~user-_."},
+		{"ü", false, "%C3%BC"},
+	}
+	for _, tt := range tests {
+		if got := awsEscape(tt.in, tt.encodeSlash); got != tt.want {
+			t.Errorf("awsEscape(%q, %v) = %q, want %q", tt.in, tt.encodeSlash, got, tt.want)
+		}
+	}
+}
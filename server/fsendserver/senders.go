@@ -0,0 +1,286 @@
+package fsendserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Who may send files to a UUID, see senderPolicy
+const (
+	allowEveryone  uint8 = iota
+	allowContacts        // Contacts and the allowlist
+	allowAllowlist       // Only the allowlist
+)
+
+// allowNames are the allow modes as written to the policy file
+var allowNames = []string{"everyone", "contacts", "allowlist"}
+
+// maxPolicyEntries bounds every list of a policy
+const maxPolicyEntries = 1000
+
+// senderPolicy decides who may send files to its owner. The blocklist
+// applies in every mode.
+type senderPolicy struct {
+	Allow     string   `json:"allow"` // One of allowNames
+	Allowlist []string `json:"allowlist,omitempty"`
+	Blocklist []string `json:"blocklist,omitempty"`
+	Contacts  []string `json:"contacts,omitempty"` // Sent files to or accepted files from, oldest first
+}
+
+// permits reports whether sender may send to the owner
+func (p *senderPolicy) permits(sender string) bool {
+	if slices.Contains(p.Blocklist, sender) {
+		return false
+	}
+
+	switch p.Allow {
+	case allowNames[allowContacts]:
+		return slices.Contains(p.Contacts, sender) || slices.Contains(p.Allowlist, sender)
+	case allowNames[allowAllowlist]:
+		return slices.Contains(p.Allowlist, sender)
+	}
+	return true
+}
+
+// senderPolicies keeps the policies of all UUIDs in a JSON file, which is
+// rewritten on every change. Without a file they live in memory only.
+type senderPolicies struct {
+	mu       sync.Mutex
+	path     string
+	policies map[string]*senderPolicy // UUID -> policy, missing = everyone
+}
+
+// openSenderPolicies loads the policies from path, which needn't exist yet
+func openSenderPolicies(path string) (*senderPolicies, error) {
+	sp := &senderPolicies{path: path, policies: make(map[string]*senderPolicy)}
+	if path == "" {
+		return sp, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &sp.policies)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt sender policies %s: %w", path, err)
+	}
+	return sp, nil
+}
+
+// permitted reports whether sender may send files to recipient. Clients may
+// always send to themselves.
+func (sp *senderPolicies) permitted(recipient, sender string) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	p := sp.policies[recipient]
+	return p == nil || recipient == sender || p.permits(sender)
+}
+
+// get returns a copy of owner's policy
+func (sp *senderPolicies) get(owner string) senderPolicy {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	p := sp.policies[owner]
+	if p == nil {
+		return senderPolicy{Allow: allowNames[allowEveryone]}
+	}
+	return senderPolicy{
+		Allow:     p.Allow,
+		Allowlist: slices.Clone(p.Allowlist),
+		Blocklist: slices.Clone(p.Blocklist),
+		Contacts:  slices.Clone(p.Contacts),
+	}
+}
+
+// set replaces owner's allow mode and lists, keeping its contacts
+func (sp *senderPolicies) set(owner string, allow uint8, allowlist, blocklist []string) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	p := sp.policies[owner]
+	if p == nil {
+		p = &senderPolicy{}
+		sp.policies[owner] = p
+	}
+	p.Allow = allowNames[allow]
+	p.Allowlist = allowlist
+	p.Blocklist = blocklist
+	return sp.save()
+}
+
+// contact is a UUID to add to owner's contacts
+type contact struct {
+	owner, uuid string
+}
+
+// addContacts remembers contacts. Contacts only matter to owners that chose
+// who may send them files, so owners without a policy don't get one. The
+// file is only rewritten if a contact is new.
+func (sp *senderPolicies) addContacts(contacts ...contact) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	changed := false
+	for _, c := range contacts {
+		p := sp.policies[c.owner]
+		if p != nil && p.addContact(c.owner, c.uuid) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return sp.save()
+}
+
+// addContact adds uuid to the contacts of owner, whose policy p is, and
+// reports whether it is new. The oldest contacts are forgotten beyond
+// maxPolicyEntries.
+func (p *senderPolicy) addContact(owner, uuid string) bool {
+	if uuid == owner || slices.Contains(p.Contacts, uuid) {
+		return false
+	}
+	p.Contacts = append(p.Contacts, uuid)
+	if len(p.Contacts) > maxPolicyEntries {
+		p.Contacts = slices.Delete(p.Contacts, 0, len(p.Contacts)-maxPolicyEntries)
+	}
+	return true
+}
+
+// save writes all policies to the file atomically. The caller holds mu.
+func (sp *senderPolicies) save() error {
+	if sp.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(sp.policies, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(sp.path), ".senders-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), sp.path)
+}
+
+// rememberContacts adds contacts, logging failures
+func (s *ServerContext) rememberContacts(logger *slog.Logger, contacts ...contact) {
+	err := s.senders.addContacts(contacts...)
+	if err != nil {
+		logger.Warn("failed to save contact", "error", err)
+	}
+}
+
+// handleGetSenders sends the client's sender policy:
+// [allow][count:uint16]{allowlist}[count:uint16]{blocklist}[count:uint16]{contacts},
+// each UUID as [len][uuid]
+func (s *ServerContext) handleGetSenders(conn net.Conn, clientUUID string) error {
+	p := s.senders.get(clientUUID)
+
+	allow := max(slices.Index(allowNames, p.Allow), 0) // Unknown modes allow everyone
+
+	b := []byte{statusOK, uint8(allow)}
+	for _, list := range [][]string{p.Allowlist, p.Blocklist, p.Contacts} {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(list)))
+		for _, uuid := range list {
+			b = append(b, uint8(len(uuid)))
+			b = append(b, uuid...)
+		}
+	}
+
+	_, err := conn.Write(b)
+	if err != nil {
+		return fmt.Errorf("error sending sender policy: %w", err)
+	}
+	return nil
+}
+
+// handleSetSenders replaces the client's sender policy:
+// [allow][count:uint16]{allowlist}[count:uint16]{blocklist}
+func (s *ServerContext) handleSetSenders(conn net.Conn, clientUUID string, logger *slog.Logger) error {
+	var allow uint8
+	err := binary.Read(conn, binary.LittleEndian, &allow)
+	if err != nil {
+		return fmt.Errorf("failed to read allow mode: %w", err)
+	}
+
+	var lists [2][]string // Allowlist, blocklist
+	for i := range lists {
+		lists[i], err = readUUIDList(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if int(allow) >= len(allowNames) {
+		return writeStatus(conn, statusError, "unknown allow mode")
+	}
+	for _, list := range lists {
+		if len(list) > maxPolicyEntries {
+			return writeStatus(conn, statusError, fmt.Sprintf("lists are limited to %d UUIDs", maxPolicyEntries))
+		}
+	}
+
+	err = s.senders.set(clientUUID, allow, lists[0], lists[1])
+	if err != nil {
+		logger.Error("failed to save sender policy", "error", err)
+		return writeStatus(conn, statusError, "failed to save the settings")
+	}
+
+	logger.Info("sender policy changed", "allow", allowNames[allow], "allowlist", len(lists[0]), "blocklist", len(lists[1]))
+	return writeStatus(conn, statusOK, "")
+}
+
+// readUUIDList reads [count:uint16] UUIDs of [len][uuid], without duplicates
+func readUUIDList(conn net.Conn) ([]string, error) {
+	var count uint16
+	err := binary.Read(conn, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UUID count: %w", err)
+	}
+
+	var list []string
+	for range count {
+		var n uint8
+		err = binary.Read(conn, binary.LittleEndian, &n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UUID length: %w", err)
+		}
+		uuid := make([]byte, n)
+		_, err = io.ReadFull(conn, uuid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read UUID: %w", err)
+		}
+		if !slices.Contains(list, string(uuid)) {
+			list = append(list, string(uuid))
+		}
+	}
+	return list, nil
+}
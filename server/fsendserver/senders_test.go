@@ -0,0 +1,97 @@
+package fsendserver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSendersPermitted(t *testing.T) {
+	sp, err := openSenderPolicies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.policies = map[string]*senderPolicy{
+		"alice": {Allow: "everyone", Blocklist: []string{"mallory"}},
+		"carol": {Allow: "contacts", Contacts: []string{"bob", "mallory"}, Allowlist: []string{"dave"}, Blocklist: []string{"mallory"}},
+		"erin":  {Allow: "allowlist", Allowlist: []string{"bob"}, Contacts: []string{"dave"}},
+	}
+
+	tests := []struct {
+		name              string
+		recipient, sender string
+		ok                bool
+	}{
+		{"no policy", "frank", "mallory", true},
+		{"everyone", "alice", "bob", true},
+		{"blocked", "alice", "mallory", false},
+		{"contact", "carol", "bob", true},
+		{"allowlisted under contacts", "carol", "dave", true},
+		{"not a contact", "carol", "erin", false},
+		{"blocked contact", "carol", "mallory", false},
+		{"allowlisted", "erin", "bob", true},
+		{"contact under allowlist", "erin", "dave", false},
+		{"to themselves", "erin", "erin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sp.permitted(tt.recipient, tt.sender); got != tt.ok {
+				t.Errorf("permitted(%s, %s) = %v, want %v", tt.recipient, tt.sender, got, tt.ok)
+			}
+		})
+	}
+}
+
+// TestSendersAddContacts checks that contacts are only kept for owners with
+// a policy and that the file is only written when one is new
+func TestSendersAddContacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "senders.json")
+	sp, err := openSenderPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sp.addContacts(contact{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sp.policies) != 0 {
+		t.Errorf("owner without a policy got %v", sp.policies)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file written without a change: %v", err)
+	}
+
+	err = sp.set("alice", allowContacts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sp.addContacts(contact{"alice", "bob"}, contact{"alice", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contacts survive a restart
+	reopened, err := openSenderPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.get("alice").Contacts; !slices.Equal(got, []string{"bob"}) {
+		t.Errorf("contacts %v, want [bob]", got)
+	}
+	if !reopened.permitted("alice", "bob") || reopened.permitted("alice", "carol") {
+		t.Error("contacts mode doesn't follow the contacts")
+	}
+
+	// A known contact doesn't rewrite the file
+	os.Remove(path)
+	err = sp.addContacts(contact{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file rewritten for a known contact: %v", err)
+	}
+}
@@ -0,0 +1,842 @@
+// Package fsendserver is the fsend server, run by the server command and by
+// clients that host a server for the local network.
+package fsendserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	putfile uint8 = iota
+	listFiles
+	streamFile
+	ping
+	bye
+	register     // Register client UUID
+	sendToUUID   // Send file to another client's UUID
+	quotaInfo    // Query storage usage and quota
+	shareLink    // Create a download link for the HTTP gateway
+	requestLink  // Create an upload link for the HTTP gateway
+	subscribe    // Receive events such as live sends on this connection
+	sendDirect   // Send a file live to an online client
+	answerDirect // Answer a live send offered with eventIncoming
+	listOffers   // List files sent to the client that it hasn't accepted yet
+	answerOffer  // Accept or reject a file sent to the client
+	getSenders   // Query who may send files to the client
+	setSenders   // Change who may send files to the client
+	deleteFile   // Delete one of the client's files
+)
+
+// opcodeNames labels requests in logs and metrics
+var opcodeNames = map[uint8]string{
+	putfile:      "putfile",
+	listFiles:    "listFiles",
+	streamFile:   "streamFile",
+	ping:         "ping",
+	bye:          "bye",
+	register:     "register",
+	sendToUUID:   "sendToUUID",
+	quotaInfo:    "quotaInfo",
+	shareLink:    "shareLink",
+	requestLink:  "requestLink",
+	subscribe:    "subscribe",
+	sendDirect:   "sendDirect",
+	answerDirect: "answerDirect",
+	listOffers:   "listOffers",
+	answerOffer:  "answerOffer",
+	getSenders:   "getSenders",
+	setSenders:   "setSenders",
+	deleteFile:   "deleteFile",
+}
+
+// Reply status, every reply starts with one
+const (
+	statusOK uint8 = iota
+	statusError
+	statusQuotaExceeded
+	statusShuttingDown
+	statusLimited      // Connection or rate limit hit
+	statusUnavailable  // Recipient of a live send is not online or didn't answer
+	statusNotPermitted // The recipient doesn't accept files from the sender
+)
+
+// notPermittedMsg is the message of statusNotPermitted
+const notPermittedMsg = "not permitted: the recipient doesn't accept files from you"
+
+type ClientInfo struct {
+	uuid    string
+	conn    net.Conn
+	busy    bool // Handling a request
+	limits  *ipLimits
+	session *quicSession // Set if conn is a QUIC stream
+}
+
+type ServerContext struct {
+	clients    map[net.Conn]*ClientInfo // Changed to store client info
+	storage    Storage
+	quotas     *quotaStorage
+	limiter    *limiter
+	metrics    *metrics
+	audit      *auditLog
+	links      *linkSealer // Nil without the HTTP gateway
+	uploads    *usedLinks
+	broker     *broker
+	senders    *senderPolicies
+	config     *Config
+	lis        net.Listener
+	quicLis    *quic.Listener
+	sessions   map[*quicSession]bool // QUIC connections
+	connIDs    atomic.Uint64         // Last connection ID handed out
+	requestIDs atomic.Uint64         // Last request ID handed out
+	closing    bool                  // Shutdown has been called
+	wg         sync.WaitGroup        // Running handleClient and QUIC stream goroutines
+	mu         sync.Mutex
+}
+
+// writeStatus replies to a request. Anything but statusOK carries a message
+// for the user.
+func writeStatus(conn net.Conn, code uint8, msg string) error {
+	if code == statusOK {
+		_, err := conn.Write([]byte{code})
+		return err
+	}
+
+	if len(msg) > 255 {
+		msg = msg[:255]
+	}
+	_, err := conn.Write(append([]byte{code, uint8(len(msg))}, msg...))
+	return err
+}
+
+// refuse replies to whatever the client sent last with an error status before
+// the connection is closed
+func refuse(conn net.Conn, code uint8, msg string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writeStatus(conn, code, msg)
+
+	// Take whatever the client still sends, closing with unread data would
+	// reset the connection before the reply arrives
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, conn)
+}
+
+// admitUpload decides whether size bytes may be stored as name for owner and
+// tells the client. On success the returned reservation must be released
+// once the upload is done.
+func (s *ServerContext) admitUpload(conn net.Conn, owner, name string, size int64) (*reservation, error) {
+	if !validName(owner) || !validName(name) {
+		err := fmt.Errorf("invalid filename or UUID: %q", name)
+		writeStatus(conn, statusError, err.Error())
+		return nil, err
+	}
+
+	res, err := s.quotas.reserve(owner, name, size)
+	if err != nil {
+		code := statusError
+		if errors.Is(err, errQuotaExceeded) {
+			code = statusQuotaExceeded
+		}
+		writeStatus(conn, code, err.Error())
+		return nil, err
+	}
+
+	err = writeStatus(conn, statusOK, "")
+	if err != nil {
+		res.release()
+		return nil, err
+	}
+	return res, nil
+}
+
+// Reasons admitSend refuses a file
+var (
+	errNotPermitted = errors.New("not permitted")
+	errNameTaken    = errors.New("name taken")
+)
+
+// admitSend checks that sender may send a file named name to recipient: the
+// recipient's sender policy must permit it, and senders may replace their
+// own offers but no file of the recipient
+func (s *ServerContext) admitSend(recipient, sender, name string) error {
+	if !s.senders.permitted(recipient, sender) {
+		return errNotPermitted
+	}
+
+	info, err := s.storage.Stat(recipient, name)
+	if err == nil && info.From != sender && !info.Expired(time.Now()) {
+		return errNameTaken
+	}
+	return nil
+}
+
+// putFile receives a file from the client and saves it to its own storage
+func (s *ServerContext) putFile(conn net.Conn, targetUUID string, logger *slog.Logger) error {
+	start := time.Now()
+
+	var (
+		fnameSize uint8
+		fname     string
+
+		fsize   uint64
+		bufSize uint32
+		ttl     uint32
+	)
+
+	err := binary.Read(conn, binary.LittleEndian, &fnameSize)
+	if err != nil {
+		return fmt.Errorf("failed to read filename length: %w", err)
+	}
+
+	var fnameBytes = make([]byte, fnameSize)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read filename: %w", err)
+	}
+	fname = string(fnameBytes)
+
+	err = binary.Read(conn, binary.LittleEndian, &fsize)
+	if err != nil {
+		return fmt.Errorf("failed to read file size: %w", err)
+	}
+
+	err = binary.Read(conn, binary.LittleEndian, &bufSize)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer size: %w", err)
+	}
+
+	err = binary.Read(conn, binary.LittleEndian, &ttl)
+	if err != nil {
+		return fmt.Errorf("failed to read TTL: %w", err)
+	}
+
+	if bufSize == 0 {
+		bufSize = uint32(s.config.Buffers.Copy)
+	}
+
+	chunked := fsize == sizeUnknown
+	if chunked {
+		logger = logger.With("filename", fname, "chunked", true)
+	} else {
+		logger = logger.With("filename", fname, "bytes", fsize)
+	}
+
+	// Chunked uploads reserve quota as they arrive
+	size := int64(fsize)
+	if chunked {
+		size = 0
+	}
+	res, err := s.admitUpload(conn, targetUUID, fname, size)
+	if err != nil {
+		logger.Warn("upload refused", "error", err)
+		return nil
+	}
+	defer res.release()
+
+	meta := FileInfo{
+		Name:    fname,
+		Size:    size,
+		Expires: s.expiresAt(ttl),
+	}
+
+	var info FileInfo
+	if chunked {
+		info, err = s.receiveChunked(conn, targetUUID, meta, res, int(bufSize))
+	} else {
+		lr := bufio.NewReaderSize(io.LimitReader(s.transfer(conn), size), int(bufSize))
+		info, err = s.storage.Put(targetUUID, meta, lr)
+		if err != nil && !connectionLost(err) {
+			// Skip the rest of the upload so the next opcode lines up
+			io.Copy(io.Discard, lr)
+		}
+	}
+	if err != nil {
+		if connectionLost(err) {
+			return fmt.Errorf("failed to receive file %s: %w", fname, err)
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			logger.Warn("upload refused", "error", err)
+			return nil
+		}
+		logger.Error("storing upload failed", "error", err)
+		return nil
+	}
+
+	s.audit.Record(auditEntry{
+		Event:      auditUpload,
+		UUID:       targetUUID,
+		Filename:   fname,
+		Hash:       info.Hash,
+		Size:       info.Size,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	if chunked {
+		logger = logger.With("bytes", info.Size)
+	}
+	logger.Info("file uploaded", "duration", time.Since(start))
+	return nil
+}
+
+// handleSendToUUID receives a file from one client and saves it to another
+// client's UUID storage as an offer, which the recipient accepts or rejects
+// with answerOffer
+func (s *ServerContext) handleSendToUUID(conn net.Conn, senderUUID string, logger *slog.Logger) error {
+	start := time.Now()
+
+	// Read target UUID length
+	var targetUUIDLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &targetUUIDLen)
+	if err != nil {
+		return fmt.Errorf("failed to read target UUID length: %w", err)
+	}
+
+	// Read target UUID
+	targetUUIDBytes := make([]byte, targetUUIDLen)
+	_, err = io.ReadFull(conn, targetUUIDBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read target UUID: %w", err)
+	}
+	targetUUID := string(targetUUIDBytes)
+
+	// Read filename length
+	var fnameLen uint8
+	err = binary.Read(conn, binary.LittleEndian, &fnameLen)
+	if err != nil {
+		return fmt.Errorf("failed to read filename length: %w", err)
+	}
+
+	// Read filename
+	fnameBytes := make([]byte, fnameLen)
+	_, err = io.ReadFull(conn, fnameBytes)
+	if err != nil {
+		return fmt.Errorf("failed to read filename: %w", err)
+	}
+	fname := string(fnameBytes)
+
+	// Read file size
+	var fsize uint64
+	err = binary.Read(conn, binary.LittleEndian, &fsize)
+	if err != nil {
+		return fmt.Errorf("failed to read file size: %w", err)
+	}
+
+	// Read requested lifetime
+	var ttl uint32
+	err = binary.Read(conn, binary.LittleEndian, &ttl)
+	if err != nil {
+		return fmt.Errorf("failed to read TTL: %w", err)
+	}
+
+	chunked := fsize == sizeUnknown
+	if chunked {
+		logger = logger.With("to", targetUUID, "filename", fname, "chunked", true)
+	} else {
+		logger = logger.With("to", targetUUID, "filename", fname, "bytes", fsize)
+	}
+
+	err = s.admitSend(targetUUID, senderUUID, fname)
+	if err != nil {
+		logger.Warn("send refused", "error", err)
+		if errors.Is(err, errNameTaken) {
+			writeStatus(conn, statusError, "the recipient already has a file named "+fname)
+		} else {
+			writeStatus(conn, statusNotPermitted, notPermittedMsg)
+		}
+		return nil
+	}
+
+	// The recipient's quota applies, reserved for chunked sends as they
+	// arrive
+	size := int64(fsize)
+	if chunked {
+		size = 0
+	}
+	res, err := s.admitUpload(conn, targetUUID, fname, size)
+	if err != nil {
+		logger.Warn("send refused", "error", err)
+		return nil
+	}
+	defer res.release()
+
+	// Store file in target UUID's storage, pending until accepted. Files
+	// sent to oneself need no answer.
+	meta := FileInfo{
+		Name:    fname,
+		Size:    size,
+		Expires: s.expiresAt(ttl),
+	}
+	if senderUUID != targetUUID {
+		meta.From = senderUUID
+	}
+
+	var info FileInfo
+	if chunked {
+		info, err = s.receiveChunked(conn, targetUUID, meta, res, int(s.config.Buffers.Copy))
+		if err != nil && !connectionLost(err) {
+			logger.Warn("send refused", "error", err)
+			return nil
+		}
+	} else {
+		lr := bufio.NewReaderSize(io.LimitReader(s.transfer(conn), size), int(s.config.Buffers.Copy))
+		info, err = s.storage.Put(targetUUID, meta, lr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+	if info.Pending() {
+		s.broker.notify(targetUUID, offerEvent(info, s.offerExpires(info)))
+	}
+	s.rememberContacts(logger, contact{senderUUID, targetUUID})
+
+	s.audit.Record(auditEntry{
+		Event:      auditSend,
+		UUID:       senderUUID,
+		Recipient:  targetUUID,
+		Filename:   fname,
+		Hash:       info.Hash,
+		Size:       info.Size,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	if chunked {
+		logger = logger.With("bytes", info.Size)
+	}
+	logger.Info("file sent", "duration", time.Since(start))
+	return nil
+}
+
+func (s *ServerContext) handleClient(conn net.Conn) {
+	defer s.wg.Done()
+
+	client := &ClientInfo{conn: conn}
+	s.mu.Lock()
+	s.clients[conn] = client
+	s.mu.Unlock()
+
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.clients, conn)
+		s.mu.Unlock()
+	}()
+
+	connLog := s.connLogger(conn.RemoteAddr())
+	connLog.Debug("connection opened")
+
+	ip := remoteIP(conn.RemoteAddr())
+	limits, err := s.limiter.connect(ip)
+	if err != nil {
+		connLog.Warn("connection refused", "error", err)
+		s.metrics.rejected.Add(1)
+		refuse(conn, statusLimited, err.Error())
+		return
+	}
+	defer s.limiter.disconnect(ip)
+
+	s.mu.Lock()
+	client.limits = limits
+	s.mu.Unlock()
+
+	var clientUUID string
+	defer func() {
+		if clientUUID != "" {
+			s.limiter.unregister(clientUUID)
+		}
+	}()
+
+	for {
+		if !s.setBusy(conn, false) {
+			notifyShutdown(conn)
+			return
+		}
+
+		var o uint8
+		err := binary.Read(conn, binary.LittleEndian, &o)
+		if err != nil {
+			if s.shuttingDown() {
+				connLog.Debug("notifying idle client of shutdown")
+				notifyShutdown(conn)
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				connLog.Debug("connection closed")
+			} else {
+				connLog.Info("connection closed", "error", err)
+			}
+			return
+		}
+		logger := s.requestLogger(connLog, o, clientUUID)
+
+		// Requests that come in after Shutdown are refused
+		if !s.setBusy(conn, true) {
+			notifyShutdown(conn)
+			return
+		}
+
+		var ok bool
+		clientUUID, ok = s.handleRequest(conn, o, clientUUID, limits, logger)
+		if !ok {
+			return
+		}
+	}
+}
+
+// handleRequest handles a request after its opcode o was read. It returns
+// the UUID the client is registered with afterwards, and false if the
+// connection must be closed.
+func (s *ServerContext) handleRequest(conn net.Conn, o uint8, clientUUID string, limits *ipLimits, logger *slog.Logger) (string, bool) {
+	if !limits.requests.Allow() {
+		logger.Warn("rate limited")
+		s.metrics.rejected.Add(1)
+		refuse(conn, statusLimited, "too many requests, try again later")
+		return clientUUID, false
+	}
+
+	if clientUUID == "" && o != register && o != ping && o != bye {
+		logger.Warn("request before register")
+		return clientUUID, false
+	}
+
+	var err error
+	start := time.Now()
+	switch o {
+	case register:
+		clientUUID, err = s.handleRegister(conn, clientUUID, logger)
+	case putfile:
+		err = s.putFile(conn, clientUUID, logger)
+	case listFiles:
+		err = s.handleListFiles(conn, clientUUID, logger)
+	case streamFile:
+		err = s.handleStreamFile(conn, clientUUID, logger)
+	case sendToUUID:
+		err = s.handleSendToUUID(conn, clientUUID, logger)
+	case quotaInfo:
+		err = s.handleQuotaInfo(conn, clientUUID)
+	case shareLink:
+		err = s.handleShareLink(conn, clientUUID, logger)
+	case requestLink:
+		err = s.handleRequestLink(conn, clientUUID, logger)
+	case subscribe:
+		// The connection only carries events from now on
+		err = s.handleSubscribe(conn, clientUUID, logger)
+		if err == nil {
+			return clientUUID, false
+		}
+	case sendDirect:
+		err = s.handleSendDirect(conn, clientUUID, logger)
+	case answerDirect:
+		err = s.handleAnswerDirect(conn, clientUUID, logger)
+	case listOffers:
+		err = s.handleListOffers(conn, clientUUID, logger)
+	case answerOffer:
+		err = s.handleAnswerOffer(conn, clientUUID, logger)
+	case getSenders:
+		err = s.handleGetSenders(conn, clientUUID)
+	case setSenders:
+		err = s.handleSetSenders(conn, clientUUID, logger)
+	case deleteFile:
+		err = s.handleDeleteFile(conn, clientUUID, logger)
+	case ping:
+		_, err = conn.Write([]byte{statusOK, 'p', 'o', 'n', 'g'})
+	case bye:
+		return clientUUID, false
+	}
+
+	duration := time.Since(start)
+	s.metrics.observe(o, duration, err)
+	if err != nil {
+		logger.Error("request failed", "duration", duration, "error", err)
+		return clientUUID, false
+	}
+	logger.Debug("request done", "duration", duration)
+	return clientUUID, true
+}
+
+// handleRegister reads the client's UUID. It returns the UUID the connection
+// is registered with afterwards, current if registering failed.
+func (s *ServerContext) handleRegister(conn net.Conn, current string, logger *slog.Logger) (string, error) {
+	// Read UUID length
+	var uuidLen uint8
+	err := binary.Read(conn, binary.LittleEndian, &uuidLen)
+	if err != nil {
+		return current, fmt.Errorf("error reading UUID length: %w", err)
+	}
+
+	// Read UUID
+	uuidBytes := make([]byte, uuidLen)
+	_, err = io.ReadFull(conn, uuidBytes)
+	if err != nil {
+		return current, fmt.Errorf("error reading UUID: %w", err)
+	}
+	uuid := string(uuidBytes)
+
+	// The UUID names the client's storage
+	if !validName(uuid) {
+		writeStatus(conn, statusError, "invalid UUID")
+		return current, fmt.Errorf("invalid UUID: %q", uuid)
+	}
+
+	if uuid != current {
+		err = s.limiter.register(uuid)
+		if err != nil {
+			s.metrics.rejected.Add(1)
+			refuse(conn, statusLimited, err.Error())
+			return current, fmt.Errorf("refused client %s: %w", uuid, err)
+		}
+		if current != "" {
+			s.limiter.unregister(current)
+		}
+	}
+
+	s.mu.Lock()
+	s.clients[conn].uuid = uuid
+	s.mu.Unlock()
+
+	err = writeStatus(conn, statusOK, "")
+	if err != nil {
+		return uuid, err
+	}
+
+	s.audit.Record(auditEntry{
+		Event:      auditRegister,
+		UUID:       uuid,
+		RemoteAddr: conn.RemoteAddr().String(),
+	})
+	logger.Info("client registered", "uuid", uuid)
+	return uuid, nil
+}
+
+// Listen accepts clients on address until Shutdown is called
+func (s *ServerContext) Listen(address string) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+// Serve accepts clients on lis until Shutdown is called, using TLS if the
+// config has a certificate
+func (s *ServerContext) Serve(lis net.Listener) error {
+	if s.config.TLS.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.TLS.Cert, s.config.TLS.Key)
+		if err != nil {
+			lis.Close()
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		lis = tls.NewListener(lis, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		lis.Close()
+		return nil
+	}
+	s.lis = lis
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return nil
+			}
+			slog.Error("accept failed", "error", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleClient(conn)
+	}
+}
+
+// NewServer opens the storage and the files config names. The server
+// removes expired files from then on and accepts clients once Listen or
+// Serve is called.
+func NewServer(config Config) (*ServerContext, error) {
+	storage, err := openStorage(config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s storage: %w", config.Storage.Backend, err)
+	}
+
+	quotas, err := newQuotaStorage(storage, int64(config.Quota.PerUUID), int64(config.Quota.Global))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count stored files: %w", err)
+	}
+
+	senders, err := openSenderPolicies(config.sendersPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sender policies: %w", err)
+	}
+
+	var audit *auditLog
+	if config.Audit.File != "" {
+		audit, err = openAuditLog(config.Audit.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+
+	server := &ServerContext{
+		clients:  make(map[net.Conn]*ClientInfo),
+		sessions: make(map[*quicSession]bool),
+		storage:  quotas,
+		quotas:   quotas,
+		limiter:  newLimiter(config.Limits),
+		metrics:  newMetrics(),
+		uploads:  newUsedLinks(),
+		broker:   newBroker(),
+		senders:  senders,
+		audit:    audit,
+		config:   &config,
+	}
+
+	go server.runJanitor(time.Duration(config.Expiry.JanitorInterval))
+	return server, nil
+}
+
+// Main runs the server command line, args without the program name
+func Main(args []string) {
+	if len(args) > 0 && args[0] == "audit" {
+		err := runAuditCommand(args[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, printOnly, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+
+	if printOnly {
+		config.Print()
+		return
+	}
+
+	if config.Log.File != "" {
+		logFile, err := os.OpenFile(config.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		os.Stdout = logFile
+		os.Stderr = logFile
+	}
+	slog.SetDefault(newLogger(config.Log, os.Stdout))
+
+	server, err := NewServer(config)
+	if err != nil {
+		slog.Error("failed to start", "error", err)
+		os.Exit(1)
+	}
+	defer server.audit.Close()
+
+	if config.Metrics.Listen != "" {
+		go func() {
+			slog.Info("serving metrics", "addr", config.Metrics.Listen)
+			err := server.serveMetrics(config.Metrics.Listen)
+			slog.Error("metrics listener stopped", "error", err)
+		}()
+	}
+
+	var gateway *http.Server
+	if config.HTTP.Listen != "" {
+		server.links, err = newLinkSealer(config.HTTP.Secret)
+		if err != nil {
+			slog.Error("failed to set up download links", "error", err)
+			os.Exit(1)
+		}
+		if config.HTTP.Secret == "" {
+			slog.Warn("no http secret set, download links stop working when the server restarts")
+		}
+
+		gateway = server.newGateway()
+		go func() {
+			slog.Info("serving download links", "addr", config.HTTP.Listen)
+			err := server.serveGateway(gateway)
+			if err != nil {
+				slog.Error("http gateway stopped", "error", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listenErr := make(chan error, 2)
+	go func() {
+		listenErr <- server.Listen(config.Listen)
+	}()
+	slog.Info("listening", "addr", config.Listen, "tls", config.TLS.Cert != "")
+
+	if config.QUIC.Listen != "" {
+		go func() {
+			listenErr <- server.ListenQUIC(config.QUIC.Listen)
+		}()
+		slog.Info("listening for QUIC", "addr", config.QUIC.Listen)
+	}
+
+	if config.MDNS.Announce {
+		mdns, err := AnnounceServer(&config)
+		if err != nil {
+			slog.Warn("can't announce the server on the local network", "error", err)
+		} else {
+			defer mdns.Close()
+			slog.Info("announcing on the local network", "service", ServerService)
+		}
+	}
+
+	select {
+	case err = <-listenErr:
+		slog.Error("listener failed", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop() // A second signal kills the server right away
+
+	slog.Info("shutting down, waiting for running transfers", "timeout", time.Duration(config.Timeouts.Shutdown))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeouts.Shutdown))
+	defer cancel()
+
+	gatewayDone := make(chan struct{})
+	go func() {
+		if gateway != nil && gateway.Shutdown(ctx) != nil {
+			gateway.Close() // Cuts off downloads still running
+		}
+		close(gatewayDone)
+	}()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("aborted unfinished transfers", "error", err)
+	}
+	<-gatewayDone
+	slog.Info("server stopped")
+}
@@ -0,0 +1,101 @@
+package fsendserver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// setBusy marks whether conn is handling a request and arms the idle timeout
+// between requests or the header timeout of a new request. It returns false
+// once the server is shutting down, the client must then be told with
+// notifyShutdown.
+func (s *ServerContext) setBusy(conn net.Conn, busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.clients[conn].busy = busy
+
+	if busy {
+		conn.SetDeadline(after(s.config.Timeouts.Header))
+	} else {
+		conn.SetReadDeadline(after(s.config.Timeouts.Idle))
+		conn.SetWriteDeadline(time.Time{})
+	}
+	return true
+}
+
+// track counts a connection that was accepted outside Listen in s.wg. It
+// returns false once the server is shutting down, the connection must then
+// be refused. Checking under the lock keeps Add from racing with Wait.
+func (s *ServerContext) track() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *ServerContext) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// notifyShutdown tells the client that the server is going away. Every reply
+// starts with a status, so the client reads this as the answer to its next
+// (or current) request.
+func notifyShutdown(conn net.Conn) {
+	refuse(conn, statusShuttingDown, "server is shutting down")
+}
+
+// Shutdown stops accepting connections, notifies idle clients and waits for
+// running requests to finish. QUIC connections are closed once their
+// requests are done. When ctx is done first the remaining connections
+// are closed; the storage backends throw away the partial uploads.
+func (s *ServerContext) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.lis != nil {
+		s.lis.Close()
+	}
+	if s.quicLis != nil {
+		s.quicLis.Close()
+	}
+	for conn, client := range s.clients {
+		if !client.busy {
+			conn.SetReadDeadline(time.Now()) // Wakes up handleClient
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.closeSessions()
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	for conn := range s.clients {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.closeSessions()
+
+	// Let the handlers clean up after their aborted transfers
+	<-done
+	return ctx.Err()
+}
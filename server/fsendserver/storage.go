@@ -0,0 +1,74 @@
+package fsendserver
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Hash    string // Hex SHA-256 of the content, empty if the backend doesn't know it
+	Created time.Time
+	Expires time.Time // Zero if the file never expires
+	From    string    // Sender of an offer the owner hasn't accepted yet, see Pending
+}
+
+// Expired reports whether the file's lifetime has ended at t
+func (f FileInfo) Expired(t time.Time) bool {
+	return !f.Expires.IsZero() && !t.Before(f.Expires)
+}
+
+// Pending reports whether the file was sent to the owner, who hasn't
+// accepted it yet. Pending files are only listed as offers and can't be
+// downloaded.
+func (f FileInfo) Pending() bool {
+	return f.From != ""
+}
+
+// Storage keeps the files of every UUID (the owner). Missing files are
+// reported with an error matching os.ErrNotExist.
+type Storage interface {
+	// Put stores meta.Size bytes read from r as meta.Name for owner,
+	// replacing any existing file, or everything up to EOF if meta.Size is
+	// negative. Nothing is stored if r ends early or fails. The returned
+	// FileInfo has Size, Hash and Created filled in.
+	Put(owner string, meta FileInfo, r io.Reader) (FileInfo, error)
+
+	// Get returns length bytes of a file starting at offset. A negative
+	// length reads until the end of the file.
+	Get(owner, name string, offset, length int64) (io.ReadCloser, FileInfo, error)
+
+	// List returns all files of owner
+	List(owner string) ([]FileInfo, error)
+
+	// Stat returns information about a single file
+	Stat(owner, name string) (FileInfo, error)
+
+	// Accept clears From of a pending file, which makes it a regular one
+	Accept(owner, name string) error
+
+	// Delete removes a file
+	Delete(owner, name string) error
+
+	// Owners returns every owner that has stored files
+	Owners() ([]string, error)
+
+	// Prune removes what is left of an owner without files, such as an
+	// empty directory
+	Prune(owner string) error
+}
+
+func openStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Backend {
+	case "fs":
+		return openBlobStore(cfg.Path)
+	case "s3":
+		return newS3Storage(cfg.S3.Endpoint, cfg.S3.Bucket, cfg.S3.Region, cfg.S3.Prefix)
+	case "memory":
+		return newMemStorage(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+}
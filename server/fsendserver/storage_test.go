@@ -0,0 +1,222 @@
+package fsendserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storageBackends creates an empty instance of every Storage backend
+var storageBackends = map[string]func(t *testing.T) Storage{
+	"fs": func(t *testing.T) Storage {
+		b, err := openBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	},
+	"memory": func(t *testing.T) Storage {
+		return newMemStorage()
+	},
+	"s3": func(t *testing.T) Storage {
+		return newTestS3Storage(t)
+	},
+}
+
+// TestStorage checks that every backend behaves as the Storage interface
+// describes
+func TestStorage(t *testing.T) {
+	for name, open := range storageBackends {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, open(t))
+		})
+	}
+}
+
+func testStorage(t *testing.T, s Storage) {
+	// Backends keep the expiry time to the second
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	const content = "hello, world"
+
+	info := mustPut(t, s, "alice", FileInfo{Name: "a.txt", Size: int64(len(content)), Expires: expires, From: "bob"}, content)
+	if info.Size != int64(len(content)) || info.Created.IsZero() {
+		t.Errorf("Put returned %+v, want size %d and a creation time", info, len(content))
+	}
+	if want := sha256Hex(content); info.Hash != want {
+		t.Errorf("Put returned hash %q, want %q", info.Hash, want)
+	}
+
+	// Size -1 stores everything up to EOF
+	info = mustPut(t, s, "alice", FileInfo{Name: "report (final).pdf", Size: -1}, "unknown length")
+	if info.Size != int64(len("unknown length")) {
+		t.Errorf("Put of unknown length returned size %d, want %d", info.Size, len("unknown length"))
+	}
+	mustPut(t, s, "bob", FileInfo{Name: "b.txt", Size: 3}, "bob")
+
+	// Nothing is stored if the data ends early
+	_, err := s.Put("alice", FileInfo{Name: "short.txt", Size: 100}, strings.NewReader("too short"))
+	if err == nil {
+		t.Error("Put of a short upload succeeded")
+	}
+	if _, err := s.Stat("alice", "short.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after a short upload: got %v, want os.ErrNotExist", err)
+	}
+
+	_, err = s.Put("alice", FileInfo{Name: "../escape", Size: 1}, strings.NewReader("x"))
+	if err == nil {
+		t.Error("Put with a name containing a slash succeeded")
+	}
+
+	info, err = s.Stat("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) || !info.Expires.Equal(expires) || info.From != "bob" || !info.Pending() {
+		t.Errorf("Stat returned %+v, want size %d, expiry %v and pending from bob", info, len(content), expires)
+	}
+
+	gets := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, content},
+		{7, 5, "world"},
+		{7, -1, "world"},
+		{0, 5, "hello"},
+		{0, 0, ""},
+	}
+	for _, g := range gets {
+		r, info, err := s.Get("alice", "a.txt", g.offset, g.length)
+		if err != nil {
+			t.Errorf("Get(%d, %d): %v", g.offset, g.length, err)
+			continue
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != g.want {
+			t.Errorf("Get(%d, %d) read %q, %v, want %q", g.offset, g.length, data, err, g.want)
+		}
+		if info.Size != int64(len(content)) {
+			t.Errorf("Get(%d, %d) reported size %d, want the file's %d", g.offset, g.length, info.Size, len(content))
+		}
+	}
+	if _, _, err := s.Get("alice", "missing.txt", 0, -1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of a missing file: got %v, want os.ErrNotExist", err)
+	}
+
+	if got, want := listNames(t, s, "alice"), []string{"a.txt", "report (final).pdf"}; !slices.Equal(got, want) {
+		t.Errorf("List = %q, want %q", got, want)
+	}
+	if got := listNames(t, s, "carol"); len(got) != 0 {
+		t.Errorf("List of an owner without files = %q, want none", got)
+	}
+
+	err = s.Accept("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = s.Stat("alice", "a.txt")
+	if err != nil || info.Pending() || !info.Expires.Equal(expires) {
+		t.Errorf("Stat after Accept returned %+v, %v, want not pending and the expiry kept", info, err)
+	}
+
+	// Put replaces a file
+	mustPut(t, s, "alice", FileInfo{Name: "a.txt", Size: 7}, "goodbye")
+	if got := readAll(t, s, "alice", "a.txt"); got != "goodbye" {
+		t.Errorf("Get after replacing read %q, want %q", got, "goodbye")
+	}
+
+	owners, err := s.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(owners)
+	if want := []string{"alice", "bob"}; !slices.Equal(owners, want) {
+		t.Errorf("Owners = %q, want %q", owners, want)
+	}
+
+	err = s.Delete("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("alice", "a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Delete: got %v, want os.ErrNotExist", err)
+	}
+	if err := s.Delete("alice", "a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("second Delete: got %v, want os.ErrNotExist", err)
+	}
+
+	// Prune leaves owners with files alone and forgets those without
+	err = s.Prune("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, s, "alice"); len(got) != 1 {
+		t.Errorf("Prune removed files: List = %q", got)
+	}
+	err = s.Delete("alice", "report (final).pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Prune("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err = s.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"bob"}; !slices.Equal(owners, want) {
+		t.Errorf("Owners after pruning = %q, want %q", owners, want)
+	}
+}
+
+func mustPut(t *testing.T, s Storage, owner string, meta FileInfo, content string) FileInfo {
+	t.Helper()
+	info, err := s.Put(owner, meta, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put(%s, %s): %v", owner, meta.Name, err)
+	}
+	return info
+}
+
+func readAll(t *testing.T, s Storage, owner, name string) string {
+	t.Helper()
+	r, _, err := s.Get(owner, name, 0, -1)
+	if err != nil {
+		t.Fatalf("Get(%s, %s): %v", owner, name, err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func listNames(t *testing.T, s Storage, owner string) []string {
+	t.Helper()
+	files, err := s.List(owner)
+	if err != nil {
+		t.Fatalf("List(%s): %v", owner, err)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,53 @@
+package fsendserver
+
+import (
+	"net"
+	"time"
+)
+
+// after returns the deadline for timeout starting now, zero for no timeout
+func after(timeout Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(timeout))
+}
+
+// progressConn pushes the deadline forward before every read and write, so a
+// transfer of any size only times out when it stops moving. Reads are
+// throttled by the upload limit.
+type progressConn struct {
+	net.Conn
+	timeout Duration
+	upload  *tokenBucket
+	metrics *metrics
+}
+
+func (c progressConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(after(c.timeout))
+	n, err := c.Conn.Read(p)
+	c.metrics.bytesIn.Add(int64(n))
+	c.upload.Wait(n)
+	return n, err
+}
+
+func (c progressConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(after(c.timeout))
+	n, err := c.Conn.Write(p)
+	c.metrics.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// transfer returns conn for moving file data
+func (s *ServerContext) transfer(conn net.Conn) net.Conn {
+	s.mu.Lock()
+	limits := s.clients[conn].limits
+	s.mu.Unlock()
+
+	return progressConn{
+		Conn:    conn,
+		timeout: s.config.Timeouts.Progress,
+		upload:  limits.upload,
+		metrics: s.metrics,
+	}
+}
@@ -0,0 +1,28 @@
+package fsendserver
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+// handleWebSocket runs the binary protocol over a WebSocket, for networks
+// that only let HTTP through. Every protocol write is one binary message.
+func (s *ServerContext) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.track() {
+		http.Error(w, "The server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		s.wg.Done()
+		slog.Info("websocket handshake failed", "remote_addr", r.RemoteAddr, "error", err)
+		return
+	}
+
+	// The connection outlives the request context
+	s.handleClient(websocket.NetConn(context.Background(), c, websocket.MessageBinary))
+}
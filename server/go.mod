@@ -1,3 +1,14 @@
 module github.com/leonwijng/fsend/server
 
 go 1.25.2
+
+require (
+	github.com/coder/websocket v1.8.14
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/net v0.43.0
+)
+
+require (
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)